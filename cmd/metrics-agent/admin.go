@@ -0,0 +1,188 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/decorate"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const unixPrefix = "unix://"
+
+// pullView holds the metrics served on /metrics
+var pullView = new(pullSource)
+
+// pullSource holds the decorated families of the last gather of the current
+// pipeline. /metrics serves them instead of gathering again so pulls do not
+// affect collectors which keep state between collections, e.g. StatsD sets
+type pullSource struct {
+	mu      sync.Mutex
+	enabled bool
+	dec     decorate.Decorator
+	mfs     []*dto.MetricFamily
+}
+
+// enable makes the source keep the gathered families, it is only needed when
+// /metrics is served
+func (s *pullSource) enable() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enabled = true
+}
+
+// set picks up the decorators of p for the following gathers
+func (s *pullSource) set(p pipeline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dec = p.dec
+}
+
+// gathered decorates a copy of mfs and keeps it until the next gather
+func (s *pullSource) gathered(mfs []*dto.MetricFamily) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.enabled {
+		return
+	}
+
+	mfs = copyFamilies(mfs)
+	if s.dec != nil {
+		s.dec.Decorate(mfs)
+	}
+	s.mfs = mfs
+}
+
+func (s *pullSource) get() []*dto.MetricFamily {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mfs
+}
+
+// parseListenAddress returns the network and address to listen on for the
+// admin server. Only unix sockets and loopback addresses are allowed since
+// the server is not authenticated
+func parseListenAddress(addr string) (network, address string, err error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		if !filepath.IsAbs(path) {
+			return "", "", errors.Errorf("unix socket path %q must be absolute", path)
+		}
+		return "unix", path, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid admin listen address %q", addr)
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return "", "", errors.Errorf("admin listen address %q must be on localhost or a unix socket", addr)
+		}
+	}
+	return "tcp", addr, nil
+}
+
+// startAdmin serves the admin endpoints on addr until the returned server is
+// closed. /metrics is only served if metrics is true
+func startAdmin(addr string, metrics bool) (*http.Server, error) {
+	network, address, err := parseListenAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		// remove a socket left behind by a previous run
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start admin server")
+	}
+
+	srv := &http.Server{Handler: adminHandler(metrics)}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("admin server failed: %+v", err)
+		}
+	}()
+
+	log.Info("admin server listening on %s", addr)
+	return srv, nil
+}
+
+func adminHandler(metrics bool) http.Handler {
+	mux := http.NewServeMux()
+	if metrics {
+		pullView.enable()
+		mux.HandleFunc("/metrics", serveMetrics)
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ok, reason := status.ready(); !ok {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(status.report()); err != nil {
+			log.Error("failed to write status: %+v", err)
+		}
+	})
+	return mux
+}
+
+// serveMetrics writes the families of the last gather in the format
+// negotiated with the client, so the pulled metrics match the ones pushed to
+// sonar
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	mfs := pullView.get()
+	if mfs == nil {
+		http.Error(w, "no metrics gathered yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	format := expfmt.Negotiate(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	enc := expfmt.NewEncoder(w, format)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			log.Error("failed to encode metric family %q: %v", mf.GetName(), err)
+			return
+		}
+	}
+}
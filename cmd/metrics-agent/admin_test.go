@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/pkg/clients/tsclient"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSonarThrottler struct {
+	constThrottler
+	status tsclient.Status
+}
+
+func (t *fakeSonarThrottler) Status() tsclient.Status { return t.status }
+
+func TestParseListenAddress(t *testing.T) {
+	valid := map[string][2]string{
+		"localhost:9100":           {"tcp", "localhost:9100"},
+		"127.0.0.1:9100":           {"tcp", "127.0.0.1:9100"},
+		"[::1]:9100":               {"tcp", "[::1]:9100"},
+		"unix:///run/metrics.sock": {"unix", "/run/metrics.sock"},
+	}
+	for addr, expected := range valid {
+		network, address, err := parseListenAddress(addr)
+		require.NoError(t, err, addr)
+		assert.Equal(t, expected, [2]string{network, address})
+	}
+
+	for _, addr := range []string{":9100", "0.0.0.0:9100", "10.0.0.1:9100", "localhost", "unix://relative.sock"} {
+		_, _, err := parseListenAddress(addr)
+		assert.Error(t, err, addr)
+	}
+}
+
+func get(t *testing.T, h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestAdminReadyAfterBootstrap(t *testing.T) {
+	defer func(s *agentStatus) { status = s }(status)
+	status = newAgentStatus()
+	h := adminHandler(false)
+
+	assert.Equal(t, http.StatusOK, get(t, h, "/healthz").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, get(t, h, "/readyz").Code)
+
+	th := new(fakeSonarThrottler)
+	status.setPipeline(pipeline{sinks: []sink{{cfg: writerConfig{Type: writerSonar}, th: th}}})
+	assert.Equal(t, http.StatusServiceUnavailable, get(t, h, "/readyz").Code)
+
+	th.status.Bootstrapped = true
+	status.wrote("sonar", nil, th)
+	assert.Equal(t, http.StatusOK, get(t, h, "/readyz").Code)
+}
+
+func TestAdminReadyWithoutSonar(t *testing.T) {
+	defer func(s *agentStatus) { status = s }(status)
+	status = newAgentStatus()
+
+	status.setPipeline(pipeline{sinks: []sink{{cfg: writerConfig{Type: writerStdout}, th: &constThrottler{}}}})
+	assert.Equal(t, http.StatusOK, get(t, adminHandler(false), "/readyz").Code)
+}
+
+func TestAdminStatus(t *testing.T) {
+	defer func(s *agentStatus) { status = s }(status)
+	status = newAgentStatus()
+
+	th := &fakeSonarThrottler{status: tsclient.Status{ConsecutiveFailures: 4, CircuitBreakerOpen: true}}
+	status.setPipeline(pipeline{
+		collectors: []string{"cpu", "meminfo"},
+		sinks: []sink{
+			{cfg: writerConfig{Type: writerSonar}, th: th},
+			{cfg: writerConfig{Type: writerStdout}, th: &constThrottler{}},
+		},
+	})
+	status.gathered(nil)
+	status.wrote("sonar", errors.New("circuit breaker is open"), th)
+	status.wrote("stdout", nil, nil)
+	next := time.Now().Add(time.Minute)
+	status.scheduled("sonar", next.Add(time.Minute))
+	status.scheduled("stdout", next)
+
+	rec := get(t, adminHandler(false), "/status")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var r statusReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &r))
+	assert.False(t, r.Ready)
+	assert.Equal(t, []string{"cpu", "meminfo"}, r.Collectors)
+	assert.NotNil(t, r.Gather.LastSuccess)
+	require.Len(t, r.Writers, 2)
+	assert.Equal(t, "sonar", r.Writers[0].Name)
+	assert.Equal(t, "circuit breaker is open", r.Writers[0].LastError)
+	assert.Nil(t, r.Writers[0].LastSuccess)
+	assert.NotNil(t, r.Writers[1].LastSuccess)
+	assert.Equal(t, &tsclientReport{ConsecutiveFailures: 4, CircuitBreakerOpen: true}, r.TSClient)
+	require.NotNil(t, r.NextRun)
+	assert.True(t, next.Equal(*r.NextRun))
+}
+
+func TestStartAdminOnUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "admin.sock")
+	srv, err := startAdmin(unixPrefix+path, false)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	c := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := c.Get("http://admin/healthz")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAdminServesDecoratedMetrics(t *testing.T) {
+	defer func(s *pullSource) { pullView = s }(pullView)
+	pullView = new(pullSource)
+
+	name := "original"
+	shared := sharedGatherer{{Name: &name, Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}}}}
+	h := adminHandler(true)
+	assert.Equal(t, http.StatusServiceUnavailable, get(t, h, "/metrics").Code)
+
+	pullView.set(pipeline{g: shared, dec: renameDecorator("renamed")})
+	pullView.gathered(shared)
+	assert.Equal(t, "original", shared[0].GetName())
+
+	rec := get(t, h, "/metrics")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, string(expfmt.FmtText), rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# TYPE renamed gauge\nrenamed 1\n", rec.Body.String())
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, string(expfmt.FmtProtoDelim), rec.Header().Get("Content-Type"))
+
+	var mf dto.MetricFamily
+	require.NoError(t, expfmt.NewDecoder(rec.Body, expfmt.FmtProtoDelim).Decode(&mf))
+	assert.Equal(t, "renamed", mf.GetName())
+}
+
+func TestAdminServesLastGatheredMetrics(t *testing.T) {
+	defer func(s *pullSource) { pullView = s }(pullView)
+	pullView = new(pullSource)
+	h := adminHandler(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g := new(countingGatherer)
+	w := new(fakeWriter)
+	done := make(chan struct{})
+	go func() {
+		run(ctx, pipeline{g: g, dec: decorateNothing{},
+			sinks: []sink{{w: w, th: &constThrottler{wait: time.Hour}, dec: decorateNothing{}}}}, nil)
+		close(done)
+	}()
+	for w.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := get(t, h, "/metrics")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "# TYPE gathers counter\ngathers 1\n", rec.Body.String())
+	}
+	cancel()
+	<-done
+	assert.Equal(t, 1, g.count())
+}
+
+func TestAdminServesMetricsOnlyWhenEnabled(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, get(t, adminHandler(false), "/metrics").Code)
+}
+
+// sharedGatherer returns the same families on every gather
+type sharedGatherer []*dto.MetricFamily
+
+func (g sharedGatherer) Gather() ([]*dto.MetricFamily, error) { return g, nil }
+
+// countingGatherer returns the number of times it was gathered
+type countingGatherer struct {
+	m sync.Mutex
+	n int
+}
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.n++
+	return []*dto.MetricFamily{{
+		Name:   proto.String("gathers"),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(float64(g.n))}}},
+	}}, nil
+}
+
+func (g *countingGatherer) count() int {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.n
+}
@@ -0,0 +1,220 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/decorate"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	formatText      = "text"
+	formatProtoText = "proto-text"
+	formatProtobuf  = "protobuf"
+	formatJSON      = "json"
+
+	compatPrefix = "compat."
+)
+
+var (
+	collectCmd = kingpin.Command("collect", "Gather and decorate metrics once, print them to stdout and exit")
+
+	collectOpts struct {
+		once    bool
+		format  string
+		compat  bool
+		filter  *regexp.Regexp
+		explain bool
+	}
+)
+
+func init() {
+	// adding commands makes kingpin require one, running the agent stays the
+	// default
+	kingpin.Command("run", "Run the agent. This is the default command").Default()
+
+	collectCmd.Flag("once", "Collect a single time and exit").
+		Required().
+		BoolVar(&collectOpts.once)
+
+	collectCmd.Flag("format", "Output format, one of: text, proto-text, protobuf, json").
+		Default(formatText).
+		EnumVar(&collectOpts.format, formatText, formatProtoText, formatProtobuf, formatJSON)
+
+	collectCmd.Flag("compat", "Apply the compat decorators. Use --no-compat to see the names of node_exporter").
+		Default("true").
+		BoolVar(&collectOpts.compat)
+
+	collectCmd.Flag("filter", "Only print families whose original or decorated name matches this regular expression").
+		RegexpVar(&collectOpts.filter)
+
+	collectCmd.Flag("explain", "Show which decorators rewrote each family").
+		Default("false").
+		BoolVar(&collectOpts.explain)
+}
+
+// collectedFamily is a decorated family and the decorators which changed it
+type collectedFamily struct {
+	mf           *dto.MetricFamily
+	originalName string
+	rewrittenBy  []string
+}
+
+// collect gathers metrics once, decorates them and prints them to w
+func collect(w io.Writer) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	if collectOpts.explain && collectOpts.format == formatProtobuf {
+		return errors.New("--explain is not supported with --format=protobuf")
+	}
+
+	names := config.decorators
+	if !collectOpts.compat {
+		names = withoutCompat(names)
+	}
+	chain, err := initDecorator(names)
+	if err != nil {
+		return err
+	}
+
+	g, _, err := newGatherer()
+	if err != nil {
+		return err
+	}
+	discoverOnce(g.targets)
+	if err := runPluginsOnce(g.layer()); err != nil {
+		return err
+	}
+	mfs, err := g.Gather()
+	if err != nil {
+		if len(mfs) == 0 {
+			return errors.Wrap(err, "failed to gather metrics")
+		}
+		log.Error("some collectors failed, printing what was gathered: %v", err)
+	}
+
+	fams := decorateExplained(chain, mfs)
+	if collectOpts.filter != nil {
+		fams = filterFamilies(fams, collectOpts.filter)
+	}
+
+	return printFamilies(w, fams, collectOpts.format, collectOpts.explain)
+}
+
+// withoutCompat removes the compat decorators from names
+func withoutCompat(names []string) []string {
+	res := []string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, compatPrefix) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// decorateExplained applies the decorators of chain one at a time and
+// records which of them changed each family
+func decorateExplained(chain decorate.Chain, mfs []*dto.MetricFamily) []collectedFamily {
+	fams := make([]collectedFamily, len(mfs))
+	for i, mf := range mfs {
+		fams[i] = collectedFamily{mf: mf, originalName: mf.GetName()}
+	}
+
+	for _, d := range chain {
+		before := copyFamilies(mfs)
+		d.Decorate(mfs)
+		for i, mf := range mfs {
+			if !proto.Equal(before[i], mf) {
+				fams[i].rewrittenBy = append(fams[i].rewrittenBy, d.Name())
+			}
+		}
+	}
+	return fams
+}
+
+// filterFamilies keeps the families whose original or decorated name matches
+// re
+func filterFamilies(fams []collectedFamily, re *regexp.Regexp) []collectedFamily {
+	res := []collectedFamily{}
+	for _, f := range fams {
+		if re.MatchString(f.originalName) || re.MatchString(f.mf.GetName()) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// jsonFamily is the JSON representation of a collected family
+type jsonFamily struct {
+	Name         string        `json:"name"`
+	Help         string        `json:"help,omitempty"`
+	Type         string        `json:"type"`
+	Metrics      []*dto.Metric `json:"metrics"`
+	OriginalName string        `json:"original_name,omitempty"`
+	RewrittenBy  []string      `json:"rewritten_by,omitempty"`
+}
+
+func printFamilies(w io.Writer, fams []collectedFamily, format string, explain bool) error {
+	if format == formatJSON {
+		res := make([]jsonFamily, len(fams))
+		for i, f := range fams {
+			res[i] = jsonFamily{
+				Name:    f.mf.GetName(),
+				Help:    f.mf.GetHelp(),
+				Type:    f.mf.GetType().String(),
+				Metrics: f.mf.Metric,
+			}
+			if explain {
+				res[i].OriginalName = f.originalName
+				res[i].RewrittenBy = f.rewrittenBy
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(res), "failed to write metrics")
+	}
+
+	expFormat := expfmt.FmtText
+	switch format {
+	case formatProtoText:
+		expFormat = expfmt.FmtProtoText
+	case formatProtobuf:
+		expFormat = expfmt.FmtProtoDelim
+	}
+
+	enc := expfmt.NewEncoder(w, expFormat)
+	for _, f := range fams {
+		if explain && len(f.rewrittenBy) > 0 {
+			fmt.Fprintf(w, "# %s rewritten by %s\n", f.originalName, strings.Join(f.rewrittenBy, ", "))
+		}
+		if err := enc.Encode(f.mf); err != nil {
+			return errors.Wrapf(err, "failed to write metric family %q", f.mf.GetName())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/digitalocean/metrics-agent/pkg/decorate"
+	"github.com/digitalocean/metrics-agent/pkg/decorate/compat"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(name string, v float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(v)}}},
+	}
+}
+
+func TestDecorateExplainedRecordsRewrites(t *testing.T) {
+	mfs := []*dto.MetricFamily{gauge("node_load1", 1), gauge("Node_Custom", 2), gauge("untouched", 3)}
+	chain := decorate.Chain{compat.Names{}, decorate.LowercaseNames{}}
+
+	fams := decorateExplained(chain, mfs)
+	require.Len(t, fams, 3)
+	assert.Equal(t, "sonar_load1", fams[0].mf.GetName())
+	assert.Equal(t, "node_load1", fams[0].originalName)
+	assert.Equal(t, []string{"compat.Names"}, fams[0].rewrittenBy)
+	assert.Equal(t, []string{"LowercaseNames"}, fams[1].rewrittenBy)
+	assert.Empty(t, fams[2].rewrittenBy)
+}
+
+func TestFilterFamiliesMatchesOriginalAndDecoratedNames(t *testing.T) {
+	fams := decorateExplained(decorate.Chain{compat.Names{}}, []*dto.MetricFamily{
+		gauge("node_load1", 1), gauge("node_load5", 5), gauge("other", 0),
+	})
+
+	byOriginal := filterFamilies(fams, regexp.MustCompile("^node_load1$"))
+	require.Len(t, byOriginal, 1)
+	assert.Equal(t, "sonar_load1", byOriginal[0].mf.GetName())
+
+	assert.Len(t, filterFamilies(fams, regexp.MustCompile("^sonar_")), 2)
+}
+
+func TestWithoutCompat(t *testing.T) {
+	assert.Equal(t, []string{"LowercaseNames"}, withoutCompat(decoratorNames()))
+}
+
+func TestPrintFamiliesExplainsText(t *testing.T) {
+	fams := decorateExplained(decorate.Chain{compat.Names{}}, []*dto.MetricFamily{gauge("node_load1", 1), gauge("other", 2)})
+
+	var buf bytes.Buffer
+	require.NoError(t, printFamilies(&buf, fams, formatText, true))
+	assert.Equal(t, `# node_load1 rewritten by compat.Names
+# TYPE sonar_load1 gauge
+sonar_load1 1
+# TYPE other gauge
+other 2
+`, buf.String())
+}
+
+func TestPrintFamiliesJSON(t *testing.T) {
+	fams := decorateExplained(decorate.Chain{compat.Names{}}, []*dto.MetricFamily{gauge("node_load1", 1)})
+
+	var buf bytes.Buffer
+	require.NoError(t, printFamilies(&buf, fams, formatJSON, true))
+
+	var res []jsonFamily
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &res))
+	require.Len(t, res, 1)
+	assert.Equal(t, "sonar_load1", res[0].Name)
+	assert.Equal(t, "GAUGE", res[0].Type)
+	assert.Equal(t, "node_load1", res[0].OriginalName)
+	assert.Equal(t, []string{"compat.Names"}, res[0].RewrittenBy)
+	assert.Equal(t, 1.0, res[0].Metrics[0].Gauge.GetValue())
+}
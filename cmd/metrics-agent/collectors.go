@@ -0,0 +1,198 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	collectorFlagPrefix = "collector."
+
+	platformsAll = "all"
+)
+
+// collectorPlatforms are the platforms each node_exporter collector is built
+// for according to its build tags, a ! excludes a platform
+var collectorPlatforms = map[string]string{
+	"arp":          "linux",
+	"bcache":       "linux",
+	"bonding":      "linux",
+	"boottime":     "darwin,dragonfly,freebsd,netbsd,openbsd",
+	"buddyinfo":    "!netbsd",
+	"conntrack":    "linux",
+	"cpu":          "darwin,dragonfly,freebsd,linux,openbsd",
+	"devstat":      "dragonfly,freebsd",
+	"diskstats":    "darwin,linux",
+	"drbd":         "linux",
+	"edac":         "linux",
+	"entropy":      "linux",
+	"exec":         "dragonfly,freebsd",
+	"filefd":       "linux",
+	"filesystem":   "darwin/amd64,dragonfly,freebsd,linux,openbsd",
+	"hwmon":        "linux",
+	"infiniband":   "linux",
+	"interrupts":   "linux,openbsd",
+	"ipvs":         "linux",
+	"ksmd":         "linux",
+	"loadavg":      "darwin,dragonfly,freebsd,linux,netbsd,openbsd,solaris",
+	"logind":       "linux",
+	"mdadm":        "linux",
+	"meminfo":      "darwin,dragonfly,freebsd,linux,openbsd",
+	"meminfo_numa": "linux",
+	"mountstats":   "linux",
+	"netdev":       "darwin,dragonfly,freebsd,linux,openbsd",
+	"netstat":      "linux",
+	"nfs":          "linux",
+	"nfsd":         "linux",
+	"ntp":          platformsAll,
+	"qdisc":        "linux",
+	"runit":        platformsAll,
+	"sockstat":     "linux",
+	"stat":         "linux",
+	"supervisord":  platformsAll,
+	"systemd":      "linux",
+	"tcpstat":      "linux",
+	"textfile":     platformsAll,
+	"time":         platformsAll,
+	"timex":        "linux",
+	"uname":        "linux",
+	"vmstat":       "linux",
+	"wifi":         "linux",
+	"xfs":          "linux",
+	"zfs":          "linux",
+}
+
+var collectorsCmd = kingpin.Command("collectors", "List the node_exporter collectors of this platform and whether they are enabled")
+
+// nodeCollectors returns the names of all collectors registered by
+// node_exporter on this platform
+func nodeCollectors() []string {
+	names := []string{}
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		name := strings.TrimPrefix(f.Name, collectorFlagPrefix)
+		if name != f.Name && isNodeCollector(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unknownCollectorError describes an unknown collector and suggests the
+// closest registered one
+func unknownCollectorError(name string) error {
+	if s := suggestCollector(name); s != "" {
+		return errors.Errorf("unknown collector %q, did you mean %q?", name, s)
+	}
+	return errors.Errorf("unknown collector %q, run `metrics-agent collectors` to list them", name)
+}
+
+// suggestCollector returns the registered collector closest to name or an
+// empty string if none is close enough
+func suggestCollector(name string) string {
+	maxDist := len(name) / 3
+	if maxDist < 2 {
+		maxDist = 2
+	}
+
+	best, bestDist := "", maxDist+1
+	for _, c := range nodeCollectors() {
+		if d := levenshtein(strings.ToLower(name), c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// listCollectors prints every collector of this platform, whether it is
+// enabled with the current configuration, whether it is by default and the
+// platforms it is built for
+func listCollectors(w io.Writer) error {
+	if err := checkCollectors(); err != nil {
+		return err
+	}
+	if err := applyCollectorFlags(); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTOR\tENABLED\tDEFAULT\tPLATFORMS")
+	for _, name := range nodeCollectors() {
+		f := kingpin.CommandLine.GetFlag(collectorFlag(name)).Model()
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", name, f.Value.String(), defaultEnabled(name), platforms(name))
+	}
+	return errors.Wrap(tw.Flush(), "failed to write collectors")
+}
+
+// platforms returns the platforms the collector is built for. A collector
+// missing from collectorPlatforms is at least built for this one
+func platforms(name string) string {
+	if p, ok := collectorPlatforms[name]; ok {
+		return p
+	}
+	return runtime.GOOS
+}
+
+// defaultEnabled reports whether the collector is enabled when neither the
+// config file nor a flag mention it
+func defaultEnabled(name string) bool {
+	if _, ok := disabledCollectors[name]; ok {
+		return false
+	}
+	f := kingpin.CommandLine.GetFlag(collectorFlag(name)).Model()
+	return len(f.Default) > 0 && f.Default[0] == "true"
+}
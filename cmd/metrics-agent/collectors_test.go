@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b string
+		d    int
+	}{
+		{"", "", 0},
+		{"cpu", "cpu", 0},
+		{"cpu", "", 3},
+		{"systmd", "systemd", 1},
+		{"loadvag", "loadavg", 2},
+		{"kitten", "sitting", 3},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.d, levenshtein(c.a, c.b), "%s -> %s", c.a, c.b)
+	}
+}
+
+func TestNodeCollectorsListsRegisteredCollectors(t *testing.T) {
+	names := nodeCollectors()
+	assert.Contains(t, names, "cpu")
+	for _, name := range names {
+		assert.True(t, isNodeCollector(name), name)
+	}
+}
+
+func TestUnknownCollectorSuggestsClosest(t *testing.T) {
+	assert.Contains(t, unknownCollectorError("cpuu").Error(), `did you mean "cpu"?`)
+	assert.Contains(t, unknownCollectorError("CPU").Error(), `did you mean "cpu"?`)
+	assert.NotContains(t, unknownCollectorError("zzzzzzzzzz").Error(), "did you mean")
+}
+
+func TestListCollectors(t *testing.T) {
+	config.collectors = map[string]bool{"cpu": false}
+	defer func() {
+		config.collectors = nil
+		applyCollectorFlags()
+	}()
+
+	var buf bytes.Buffer
+	require.NoError(t, listCollectors(&buf))
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, []string{"COLLECTOR", "ENABLED", "DEFAULT", "PLATFORMS"}, strings.Fields(lines[0]))
+
+	rows := map[string][]string{}
+	for _, line := range lines[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			rows[fields[0]] = fields
+		}
+	}
+	assert.Equal(t, []string{"cpu", "false", "true", "darwin,dragonfly,freebsd,linux,openbsd"}, rows["cpu"])
+	assert.Equal(t, "linux", rows["systemd"][3])
+	assert.Equal(t, "all", rows["textfile"][3])
+}
+
+func TestCollectorPlatformsCoversRegisteredCollectors(t *testing.T) {
+	for _, name := range nodeCollectors() {
+		p, ok := collectorPlatforms[name]
+		switch {
+		case !assert.True(t, ok, name), p == platformsAll:
+		case strings.HasPrefix(p, "!"):
+			assert.NotContains(t, strings.Split(p, ","), "!"+runtime.GOOS, name)
+		default:
+			assert.Contains(t, p, runtime.GOOS, name)
+		}
+	}
+}
+
+func TestFileConfigSetsCollectorTimeouts(t *testing.T) {
+	path := writeConfigFile(t, "collectors:\n  timeout: 2s\n  max_concurrency: 3\n  timeouts:\n    filesystem: 500ms\n")
+	defer os.Remove(path)
+
+	fc, err := readConfigFile(path)
+	require.NoError(t, err)
+	require.NoError(t, fc.apply())
+	defer func() {
+		setFlag("collectors.timeout", defaultCollectorTimeout.String())
+		setFlag("collectors.max-concurrency", "0")
+		config.collectorTimeouts = nil
+	}()
+
+	assert.Equal(t, 2*time.Second, config.collectorTimeout)
+	assert.Equal(t, 3, config.collectorConcurrency)
+	assert.Equal(t, map[string]time.Duration{"filesystem": 500 * time.Millisecond}, config.collectorTimeouts)
+	assert.NoError(t, checkCollectors())
+
+	config.collectorTimeouts = map[string]time.Duration{"filesystm": time.Second}
+	assert.Contains(t, checkCollectors().Error(), `did you mean "filesystem"?`)
+}
@@ -19,48 +19,111 @@ import (
 	"context"
 	"fmt"
 	"net/url"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/clients"
 	"github.com/digitalocean/metrics-agent/pkg/clients/tsclient"
 	"github.com/digitalocean/metrics-agent/pkg/collector"
 	"github.com/digitalocean/metrics-agent/pkg/decorate"
 	"github.com/digitalocean/metrics-agent/pkg/decorate/compat"
-	"github.com/digitalocean/metrics-agent/pkg/writer"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+// agentConfig is the configuration of the agent after merging the command line
+// flags with the config file
+type agentConfig struct {
+	file                 string
+	targets              map[string]targetConfig
+	targetFlags          map[string]string
+	targetTimeout        time.Duration
+	scrapeConcurrency    int
+	scrapeBodySizeLimit  units.Base2Bytes
+	scrapeSampleLimit    int
+	processGroups        []processGroupConfig
+	processTop           int
+	cgroups              bool
+	cgroupsInclude       []string
+	cgroupsExclude       []string
+	fileSDDir            string
+	fileSDInterval       time.Duration
+	fileSDDebounce       time.Duration
+	statsdUDP            string
+	statsdTCP            string
+	statsdMaxSeries      int
+	statsdMappings       []statsdMappingConfig
+	statsdBuckets        []float64
+	textfileDir          string
+	textfileMaxFileSize  units.Base2Bytes
+	textfileMaxSeries    int
+	textfileStaleness    time.Duration
+	plugins              []pluginConfig
+	pluginConcurrency    int
+	metadataURL          *url.URL
+	authURL              *url.URL
+	sonarEndpoint        string
+	stdoutOnly           bool
+	debug                bool
+	syslog               bool
+	shutdownTimeout      time.Duration
+	adminListen          string
+	adminMetrics         bool
+	scheduleAlign        bool
+	scheduleJitter       time.Duration
+	decorators           []string
+	writers              []writerConfig
+	collectors           map[string]bool
+	collectorTimeout     time.Duration
+	collectorTimeouts    map[string]time.Duration
+	collectorConcurrency int
+	ignoredMountPoints   []string
+	ignoredFSTypes       []string
+}
+
 var (
-	config struct {
-		targets       map[string]string
-		metadataURL   *url.URL
-		authURL       *url.URL
-		sonarEndpoint string
-		stdoutOnly    bool
-		debug         bool
-		syslog        bool
-	}
-
-	// additionalParams is a list of extra command line flags to append
-	// this is mostly needed for appending node_exporter flags when necessary.
-	additionalParams = []string{}
-
-	// disabledCollectors is a hash used by disableCollectors to prevent
-	// duplicate entries
+	config agentConfig
+
+	// scrapePool limits how many targets of the current pipeline are scraped
+	// at once. It is replaced by initScrapers
+	scrapePool *collector.ScrapePool
+
+	// disabledCollectors is the set of node_exporter collectors disabled by
+	// default on this platform. It is populated by disableCollectors
 	disabledCollectors = map[string]interface{}{}
+
+	// availableDecorators is the list of decorators which can be enabled by
+	// name. They are applied in this order unless configured otherwise
+	availableDecorators = []decorate.Decorator{
+		compat.Names{},
+		compat.Disk{},
+		compat.CPU{},
+		decorate.LowercaseNames{},
+	}
 )
 
 const (
 	defaultMetadataURL = "http://169.254.169.254/metadata"
 	defaultAuthURL     = "https://sonar.digitalocean.com"
 	defaultSonarURL    = ""
+
+	defaultShutdownTimeout  = 10 * time.Second
+	defaultTargetTimeout    = 5 * time.Second
+	defaultCollectorTimeout = 10 * time.Second
+
+	defaultScrapeConcurrency = 4
 )
 
 func init() {
+	kingpin.Flag("config.file", "Path to a YAML configuration file. Command line flags take precedence over its values").
+		StringVar(&config.file)
+
 	kingpin.Flag("auth-host", "Endpoint to use for obtaining droplet app key").
 		Default(defaultAuthURL).
 		URLVar(&config.authURL)
@@ -73,45 +136,257 @@ func init() {
 		Default(defaultSonarURL).
 		StringVar(&config.sonarEndpoint)
 
-	kingpin.Flag("stdout-only", "write all metrics to stdout only").
+	kingpin.Flag("stdout-only", "write all metrics to stdout only, replacing any configured writers").
+		Default("false").
 		BoolVar(&config.stdoutOnly)
 
 	kingpin.Flag("debug", "display debug information to stdout").
+		Default("false").
 		BoolVar(&config.debug)
 
 	kingpin.Flag("syslog", "enable logging to syslog").
+		Default("false").
 		BoolVar(&config.syslog)
+
+	kingpin.Flag("shutdown-timeout", "maximum time to wait for the current collection and a final write when shutting down").
+		Default(defaultShutdownTimeout.String()).
+		DurationVar(&config.shutdownTimeout)
+
+	kingpin.Flag("admin.listen-address", "Address to serve /healthz, /readyz and /status on, either localhost:port or unix:///path/to.sock. Disabled by default").
+		Default("").
+		StringVar(&config.adminListen)
+
+	kingpin.Flag("admin.metrics", "Serve the decorated metrics on /metrics of the admin server for Prometheus to scrape").
+		Default("false").
+		BoolVar(&config.adminMetrics)
+
+	kingpin.Flag("schedule.align", "Align collections to multiples of the write interval instead of starting them when the agent starts").
+		Default("true").
+		BoolVar(&config.scheduleAlign)
+
+	kingpin.Flag("schedule.jitter", "Maximum offset from the aligned schedule. Every host gets a fixed offset derived from its droplet ID so the fleet does not write in lockstep").
+		Default(defaultScheduleJitter.String()).
+		DurationVar(&config.scheduleJitter)
+
+	kingpin.Flag("collectors.timeout", "Time every node_exporter collector has to finish. Collectors which take longer are skipped for that collection, 0 disables the timeout").
+		Default(defaultCollectorTimeout.String()).
+		DurationVar(&config.collectorTimeout)
+
+	kingpin.Flag("collectors.max-concurrency", "Maximum number of node_exporter collectors running at once, 0 means no limit").
+		Default("0").
+		IntVar(&config.collectorConcurrency)
+
+	config.targetFlags = map[string]string{}
+	kingpin.Flag("target", "Remote endpoint to scrape metrics from as name=url. The url is either http(s) or unix:///path/to.sock:/path, /metrics is used when it has no path. Can be repeated").
+		StringMapVar(&config.targetFlags)
+
+	kingpin.Flag("target-timeout", "Timeout for scraping targets which do not set their own").
+		Default(defaultTargetTimeout.String()).
+		DurationVar(&config.targetTimeout)
+
+	kingpin.Flag("processes.top", "Report the resource usage of the N process names using the most CPU and the N using the most memory, 0 disables it").
+		Default("0").
+		IntVar(&config.processTop)
+
+	kingpin.Flag("cgroups.enabled", "Report CPU, memory and block IO usage of every cgroup, e.g. containers and systemd services").
+		Default("false").
+		BoolVar(&config.cgroups)
+
+	kingpin.Flag("textfile.directory", "Directory of *.prom files in the Prometheus text format whose metrics are reported, e.g. written by cron jobs. Disabled by default").
+		Default("").
+		StringVar(&config.textfileDir)
+
+	kingpin.Flag("textfile.max-file-size", "Size above which a textfile is skipped, e.g. 1MB").
+		Default(units.Base2Bytes(collector.DefaultTextfileMaxFileSize).String()).
+		BytesVar(&config.textfileMaxFileSize)
+
+	kingpin.Flag("textfile.max-series", "Number of series above which a textfile is skipped").
+		Default(strconv.Itoa(collector.DefaultTextfileMaxSeries)).
+		IntVar(&config.textfileMaxSeries)
+
+	kingpin.Flag("textfile.staleness", "Age after which the metrics of a textfile are ignored, 0 never ignores them").
+		Default("0s").
+		DurationVar(&config.textfileStaleness)
+
+	kingpin.Flag("plugins.max-concurrency", "Maximum number of exec plugins running at once, 0 means no limit").
+		Default(strconv.Itoa(defaultPluginConcurrency)).
+		IntVar(&config.pluginConcurrency)
+
+	kingpin.Flag("scrape.concurrency", "Maximum number of targets scraped at once, 0 means no limit").
+		Default(strconv.Itoa(defaultScrapeConcurrency)).
+		IntVar(&config.scrapeConcurrency)
+
+	kingpin.Flag("scrape.body-size-limit", "Size of the uncompressed response body of a target above which its scrape fails, e.g. 10MB. Used for targets which do not set their own, 0 means no limit").
+		Default("0").
+		BytesVar(&config.scrapeBodySizeLimit)
+
+	kingpin.Flag("scrape.sample-limit", "Number of samples of a target above which its scrape fails. Used for targets which do not set their own, 0 means no limit").
+		Default("0").
+		IntVar(&config.scrapeSampleLimit)
+
+	kingpin.Flag("file-sd.directory", "Directory of JSON and YAML files listing targets to scrape in the file_sd format of Prometheus. Changes are picked up without a restart").
+		Default("").
+		StringVar(&config.fileSDDir)
+
+	kingpin.Flag("file-sd.interval", "How often the file_sd directory is checked for changes").
+		Default(defaultFileSDInterval.String()).
+		DurationVar(&config.fileSDInterval)
+
+	kingpin.Flag("statsd.udp-address", "Address to receive StatsD and DogStatsD packets on, e.g. :8125. Disabled by default").
+		Default("").
+		StringVar(&config.statsdUDP)
+
+	kingpin.Flag("statsd.tcp-address", "Address to accept newline separated StatsD lines on. Disabled by default").
+		Default("").
+		StringVar(&config.statsdTCP)
+
+	kingpin.Flag("statsd.max-series", "Maximum number of series kept from StatsD, lines for new series are dropped once it is reached").
+		Default(strconv.Itoa(collector.DefaultStatsDMaxSeries)).
+		IntVar(&config.statsdMaxSeries)
+
+	kingpin.Flag("file-sd.debounce", "Time the file_sd directory has to stay unchanged before changes are applied").
+		Default(defaultFileSDDebounce.String()).
+		DurationVar(&config.fileSDDebounce)
 }
 
 func checkConfig() error {
 	var err error
-	for name, uri := range config.targets {
-		if _, err = url.Parse(uri); err != nil {
+	for name, t := range config.targets {
+		// colons are valid in metric names but reserved for recording rules
+		if !model.IsValidMetricName(model.LabelValue(name)) || strings.Contains(name, ":") {
+			return errors.Errorf("target name %q is not valid, it may only contain letters, digits and underscores and not start with a digit", name)
+		}
+		if _, _, err = collector.ParseTarget(t.URL); err != nil {
 			return errors.Wrapf(err, "url for target %q is not valid", name)
 		}
+		if t.Timeout <= 0 {
+			return errors.Errorf("timeout for target %q must be positive", name)
+		}
+		if t.BasicAuth != nil && t.BasicAuth.Username == "" {
+			return errors.Errorf("basic auth for target %q has no username", name)
+		}
+		if t.BodySizeLimit < 0 || t.SampleLimit < 0 {
+			return errors.Errorf("limits for target %q must not be negative", name)
+		}
+	}
+	if config.processTop < 0 {
+		return errors.New("number of top processes must not be negative")
+	}
+	if _, err := newProcessCollector(); err != nil {
+		return err
+	}
+	if _, err := newCgroupCollector(); err != nil {
+		return err
+	}
+	if _, err := newTextfileCollector(); err != nil {
+		return err
+	}
+	if _, err := newExecCollector(); err != nil {
+		return err
+	}
+
+	if err := checkStatsD(); err != nil {
+		return err
+	}
+
+	if config.scrapeConcurrency < 0 {
+		return errors.New("scrape concurrency must not be negative")
+	}
+	if config.scrapeBodySizeLimit < 0 || config.scrapeSampleLimit < 0 {
+		return errors.New("scrape limits must not be negative")
+	}
+
+	for _, name := range config.decorators {
+		if _, ok := findDecorator(name); !ok {
+			return errors.Errorf("unknown decorator %q, must be one of: %s",
+				name, strings.Join(decoratorNames(), ", "))
+		}
+	}
+
+	if err := checkCollectors(); err != nil {
+		return err
+	}
+
+	if config.fileSDDir != "" {
+		if config.fileSDInterval <= 0 {
+			return errors.New("file_sd interval must be positive")
+		}
+		if config.fileSDDebounce < 0 {
+			return errors.New("file_sd debounce must not be negative")
+		}
+	}
+
+	if config.scheduleJitter < 0 {
+		return errors.New("schedule jitter must not be negative")
+	}
+
+	if config.adminListen != "" {
+		if _, _, err := parseListenAddress(config.adminListen); err != nil {
+			return err
+		}
+	} else if config.adminMetrics {
+		return errors.New("serving /metrics requires an admin listen address")
+	}
+
+	return checkWriters()
+}
+
+// checkCollectors validates the configured collectors against the ones
+// registered by node_exporter
+func checkCollectors() error {
+	for name := range config.collectors {
+		if !isNodeCollector(name) {
+			return unknownCollectorError(name)
+		}
+	}
+
+	if config.collectorTimeout < 0 {
+		return errors.New("collector timeout must not be negative")
+	}
+	if config.collectorConcurrency < 0 {
+		return errors.New("collector max concurrency must not be negative")
+	}
+	for name, d := range config.collectorTimeouts {
+		if !isNodeCollector(name) {
+			return unknownCollectorError(name)
+		}
+		if d < 0 {
+			return errors.Errorf("timeout for collector %q must not be negative", name)
+		}
 	}
 	return nil
 }
 
-func initWriter(ctx context.Context) (metricWriter, throttler) {
-	if config.stdoutOnly {
-		return writer.NewFile(os.Stdout), &constThrottler{wait: 10 * time.Second}
+// initDecorator creates a chain of the named decorators
+func initDecorator(names []string) (decorate.Chain, error) {
+	chain := decorate.Chain{}
+	for _, name := range names {
+		d, ok := findDecorator(name)
+		if !ok {
+			return nil, errors.Errorf("unknown decorator %q", name)
+		}
+		chain = append(chain, d)
 	}
+	return chain, nil
+}
 
-	tsc, err := newTimeseriesClient(ctx)
-	if err != nil {
-		log.Fatal("failed to connect to sonar: %+v", err)
+// findDecorator returns the available decorator with the given name
+func findDecorator(name string) (decorate.Decorator, bool) {
+	for _, d := range availableDecorators {
+		if d.Name() == name {
+			return d, true
+		}
 	}
-	return writer.NewSonar(tsc), tsc
+	return nil, false
 }
 
-func initDecorator() decorate.Chain {
-	return decorate.Chain{
-		compat.Names{},
-		compat.Disk{},
-		compat.CPU{},
-		decorate.LowercaseNames{},
+// decoratorNames returns the names of all available decorators
+func decoratorNames() []string {
+	names := make([]string, len(availableDecorators))
+	for i, d := range availableDecorators {
+		names[i] = d.Name()
 	}
+	return names
 }
 
 // WrappedTSClient wraps the tsClient and adds a Name method to it
@@ -147,16 +422,31 @@ func newTimeseriesClient(ctx context.Context) (*WrappedTSClient, error) {
 }
 
 // initCollectors initializes the prometheus collectors. By default this
-// includes node_exporter and buildInfo for each remote target
-func initCollectors() []prometheus.Collector {
+// includes node_exporter, buildInfo and the pipeline metrics. The discovery
+// metrics are included when file_sd is configured
+func initCollectors() ([]prometheus.Collector, error) {
 	// buildInfo provides build information for tracking metrics internally
-	cols := []prometheus.Collector{buildInfo}
+	cols := []prometheus.Collector{buildInfo, selfMetrics}
+	if config.fileSDDir != "" {
+		cols = append(cols, discoveryMetrics)
+	}
+
+	if err := applyCollectorFlags(); err != nil {
+		return nil, errors.Wrap(err, "failed to configure node_exporter collectors")
+	}
 
 	// create the default metrics agent to collect metrics about
 	// this device
-	node, err := collector.NewNodeCollector()
+	opts := []collector.NodeOptFn{
+		collector.WithTimeout(config.collectorTimeout),
+		collector.WithMaxConcurrency(config.collectorConcurrency),
+	}
+	for name, d := range config.collectorTimeouts {
+		opts = append(opts, collector.WithCollectorTimeout(name, d))
+	}
+	node, err := collector.NewNodeCollector(opts...)
 	if err != nil {
-		log.Fatal("failed to create metrics agent: %+v", err)
+		return nil, errors.Wrap(err, "failed to create metrics agent")
 	}
 	log.Info("%d node_exporter collectors were registered", len(node.Collectors()))
 
@@ -165,27 +455,171 @@ func initCollectors() []prometheus.Collector {
 	}
 	cols = append(cols, node)
 
-	return cols
+	procs, err := newProcessCollector()
+	if err != nil {
+		return nil, err
+	}
+	if procs != nil {
+		log.Info("reporting %d process groups and the top %d processes", len(config.processGroups), config.processTop)
+		cols = append(cols, procs)
+	}
+
+	cgroups, err := newCgroupCollector()
+	if err != nil {
+		return nil, err
+	}
+	if cgroups != nil {
+		log.Info("reporting cgroup usage")
+		cols = append(cols, cgroups)
+	}
+
+	return cols, nil
 }
 
-// disableCollectors disables collectors by names by adding a list of
-// --no-collector.<name> flags to additionalParams
-func disableCollectors(names ...string) {
-	f := []string{}
+// initScrapers creates a scraper for each remote target
+func initScrapers() ([]prometheus.Collector, error) {
+	// the scrapers of this pipeline, including the discovered ones, share
+	// one pool
+	scrapePool = collector.NewScrapePool(config.scrapeConcurrency)
+
+	names := make([]string, 0, len(config.targets))
+	for name := range config.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cols := []prometheus.Collector{}
 	for _, name := range names {
-		if _, ok := disabledCollectors[name]; ok {
-			// already disabled
-			continue
+		t := config.targets[name]
+		s, err := collector.NewScraper(name, t.URL, t.Timeout, scraperOpts(t, scrapePool)...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create scraper for target %q", name)
 		}
+		log.Info("scraping target %q at %s with timeout %s", name, t.URL, t.Timeout)
+		cols = append(cols, s)
+	}
+	return cols, nil
+}
 
+// newProcessCollector creates the process collector. It returns nil when no
+// process groups are configured
+func newProcessCollector() (*collector.ProcessCollector, error) {
+	if len(config.processGroups) == 0 && config.processTop == 0 {
+		return nil, nil
+	}
+
+	opts := []collector.ProcessOptFn{collector.WithTopProcesses(config.processTop)}
+	for _, g := range config.processGroups {
+		opts = append(opts, collector.WithProcessGroups(collector.ProcessGroup{
+			Name:    g.Name,
+			Comm:    g.Comm,
+			Cmdline: g.Cmdline,
+		}))
+	}
+	c, err := collector.NewProcessCollector(opts...)
+	return c, errors.Wrap(err, "invalid process groups")
+}
+
+// newCgroupCollector creates the cgroup collector. It returns nil unless it is
+// enabled
+func newCgroupCollector() (*collector.CgroupCollector, error) {
+	if !config.cgroups {
+		return nil, nil
+	}
+	c, err := collector.NewCgroupCollector(
+		collector.WithCgroupInclude(config.cgroupsInclude...),
+		collector.WithCgroupExclude(config.cgroupsExclude...),
+	)
+	return c, errors.Wrap(err, "invalid cgroups config")
+}
+
+// newTextfileCollector creates the textfile collector. It returns nil unless
+// a directory is configured
+func newTextfileCollector() (*collector.TextfileCollector, error) {
+	if config.textfileDir == "" {
+		return nil, nil
+	}
+	c, err := collector.NewTextfileCollector(config.textfileDir,
+		collector.WithTextfileMaxFileSize(int64(config.textfileMaxFileSize)),
+		collector.WithTextfileMaxSeries(config.textfileMaxSeries),
+		collector.WithTextfileStaleness(config.textfileStaleness),
+		collector.WithTextfileFamilyNames(familyNames),
+	)
+	return c, errors.Wrap(err, "invalid textfile config")
+}
+
+// scraperOpts returns the scraper options of a target
+func scraperOpts(t targetConfig, pool *collector.ScrapePool) []collector.ScraperOptFn {
+	opts := []collector.ScraperOptFn{
+		collector.WithExemplars(t.Exemplars),
+		collector.WithCreatedSeries(t.CreatedSeries),
+		collector.WithJob(t.Job),
+		collector.WithInstance(t.Instance),
+		collector.WithLabels(t.Labels),
+		collector.WithHonorLabels(t.HonorLabels),
+		collector.WithBodySizeLimit(int64(t.BodySizeLimit)),
+		collector.WithSampleLimit(t.SampleLimit),
+		collector.WithScrapePool(pool),
+		collector.WithScrapeFamilyNames(familyNames),
+		collector.WithBearerToken(t.BearerToken),
+		collector.WithBearerTokenFile(t.BearerTokenFile),
+		collector.WithTLSConfig(clients.TLSConfig{
+			CAFile:             t.TLS.CAFile,
+			CertFile:           t.TLS.CertFile,
+			KeyFile:            t.TLS.KeyFile,
+			ServerName:         t.TLS.ServerName,
+			InsecureSkipVerify: t.TLS.InsecureSkipVerify,
+		}),
+	}
+	if t.BasicAuth != nil {
+		opts = append(opts, collector.WithBasicAuth(t.BasicAuth.Username, t.BasicAuth.Password))
+	}
+	if t.TLS.InsecureSkipVerify {
+		log.Info("target %q does not verify the certificate of the server", t.Name)
+	}
+	return opts
+}
+
+// disableCollectors disables collectors by names by default. The config file
+// can still enable them
+func disableCollectors(names ...string) {
+	for _, name := range names {
 		disabledCollectors[name] = nil
-		f = append(f, disableCollectorFlag(name))
 	}
+}
+
+// applyCollectorFlags sets the node_exporter collector flags from the platform
+// defaults and the loaded configuration. Flags passed on the command line are
+// left untouched
+func applyCollectorFlags() error {
+	state := map[string]bool{}
+	for name := range disabledCollectors {
+		state[name] = false
+	}
+	for name, enabled := range config.collectors {
+		state[name] = enabled
+	}
+
+	for name, enabled := range state {
+		if err := setFlag(collectorFlag(name), strconv.FormatBool(enabled)); err != nil {
+			return err
+		}
+	}
+
+	return applyFilesystemFlags()
+}
 
-	additionalParams = append(additionalParams, f...)
+// collectorFlag creates the name of the flag which enables the given collector
+func collectorFlag(name string) string {
+	return collectorFlagPrefix + name
 }
 
-// disableCollectorFlag creates the correct cli flag for the given collector name
-func disableCollectorFlag(name string) string {
-	return fmt.Sprintf("--no-collector.%s", name)
+// isNodeCollector reports whether name is a collector registered by
+// node_exporter on this platform
+func isNodeCollector(name string) bool {
+	if name == "" || strings.Contains(name, ".") {
+		return false
+	}
+	f := kingpin.CommandLine.GetFlag(collectorFlag(name))
+	return f != nil && f.Model().IsBoolFlag()
 }
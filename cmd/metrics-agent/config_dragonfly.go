@@ -16,7 +16,6 @@
 package main
 
 func init() {
-	registerFilesystemFlags()
 	disableCollectors("boottime", "exec", "ntp", "runit", "supervisord",
 		"textfile", "time",
 	)
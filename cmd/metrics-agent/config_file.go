@@ -0,0 +1,482 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/pkg/errors"
+	"gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// explicitFlags is the set of flags passed on the command line. These are
+// never overridden by the config file
+var explicitFlags = map[string]bool{}
+
+// fileConfig is the YAML document read from --config.file
+type fileConfig struct {
+	Debug      *bool            `yaml:"debug"`
+	Syslog     *bool            `yaml:"syslog"`
+	Endpoints  endpointsConfig  `yaml:"endpoints"`
+	Writers    []writerConfig   `yaml:"writers"`
+	Collectors collectorsConfig `yaml:"collectors"`
+	Filesystem filesystemConfig `yaml:"filesystem"`
+	Decorators []string         `yaml:"decorators"`
+	Targets    []targetConfig   `yaml:"targets"`
+	Admin      adminConfig      `yaml:"admin"`
+	Schedule   scheduleConfig   `yaml:"schedule"`
+	FileSD     fileSDConfig     `yaml:"file_sd"`
+	Scrape     scrapeConfig     `yaml:"scrape"`
+	Processes  processesConfig  `yaml:"processes"`
+	Cgroups    cgroupsConfig    `yaml:"cgroups"`
+	StatsD     statsdConfig     `yaml:"statsd"`
+	Textfile   textfileConfig   `yaml:"textfile"`
+	Plugins    pluginsConfig    `yaml:"plugins"`
+}
+
+type endpointsConfig struct {
+	Auth     string `yaml:"auth"`
+	Metadata string `yaml:"metadata"`
+	Sonar    string `yaml:"sonar"`
+}
+
+type adminConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+	Metrics       *bool  `yaml:"metrics"`
+}
+
+type scheduleConfig struct {
+	Align  *bool          `yaml:"align"`
+	Jitter *time.Duration `yaml:"jitter"`
+}
+
+type fileSDConfig struct {
+	Directory string         `yaml:"directory"`
+	Interval  *time.Duration `yaml:"interval"`
+	Debounce  *time.Duration `yaml:"debounce"`
+}
+
+type scrapeConfig struct {
+	Concurrency   *int      `yaml:"concurrency"`
+	BodySizeLimit *byteSize `yaml:"body_size_limit"`
+	SampleLimit   *int      `yaml:"sample_limit"`
+}
+
+type processesConfig struct {
+	Groups []processGroupConfig `yaml:"groups"`
+	Top    *int                 `yaml:"top"`
+}
+
+// processGroupConfig selects processes by a regular expression matching
+// their name or their command line
+type processGroupConfig struct {
+	Name    string `yaml:"name"`
+	Comm    string `yaml:"comm"`
+	Cmdline string `yaml:"cmdline"`
+}
+
+// cgroupsConfig selects the reported cgroups by regular expressions matching
+// their path, e.g. /system.slice/nginx.service
+type cgroupsConfig struct {
+	Enabled *bool    `yaml:"enabled"`
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+type textfileConfig struct {
+	Directory   string         `yaml:"directory"`
+	MaxFileSize *byteSize      `yaml:"max_file_size"`
+	MaxSeries   *int           `yaml:"max_series"`
+	Staleness   *time.Duration `yaml:"staleness"`
+}
+
+type pluginsConfig struct {
+	MaxConcurrency *int           `yaml:"max_concurrency"`
+	Exec           []pluginConfig `yaml:"exec"`
+}
+
+// pluginConfig is a command run on its own interval whose output is parsed
+// as Prometheus text, JSON or Nagios plugin output
+type pluginConfig struct {
+	Name     string            `yaml:"name"`
+	Command  []string          `yaml:"command"`
+	Format   string            `yaml:"format"`
+	Interval time.Duration     `yaml:"interval"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	Env      map[string]string `yaml:"env"`
+}
+
+type statsdConfig struct {
+	UDPAddress string                `yaml:"udp_address"`
+	TCPAddress string                `yaml:"tcp_address"`
+	MaxSeries  *int                  `yaml:"max_series"`
+	Mappings   []statsdMappingConfig `yaml:"mappings"`
+	Buckets    []float64             `yaml:"buckets"`
+}
+
+// statsdMappingConfig maps StatsD names matching a glob to a metric name and
+// labels, e.g. api.*.requests to api_requests_total{endpoint="$1"}
+type statsdMappingConfig struct {
+	Match  string            `yaml:"match"`
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+type writerConfig struct {
+	Type       string        `yaml:"type"`
+	Path       string        `yaml:"path"`
+	Interval   time.Duration `yaml:"interval"`
+	Decorators []string      `yaml:"decorators"`
+}
+
+type collectorsConfig struct {
+	Enabled        []string                 `yaml:"enabled"`
+	Disabled       []string                 `yaml:"disabled"`
+	Timeout        *time.Duration           `yaml:"timeout"`
+	Timeouts       map[string]time.Duration `yaml:"timeouts"`
+	MaxConcurrency *int                     `yaml:"max_concurrency"`
+}
+
+type filesystemConfig struct {
+	IgnoredMountPoints []string `yaml:"ignored_mount_points"`
+	IgnoredFSTypes     []string `yaml:"ignored_fs_types"`
+}
+
+type targetConfig struct {
+	Name    string        `yaml:"name"`
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Exemplars and CreatedSeries keep the OpenMetrics exemplar values and
+	// _created series of the target instead of dropping them
+	Exemplars     bool `yaml:"exemplars"`
+	CreatedSeries bool `yaml:"created_series"`
+
+	// Job, Instance and Labels are attached to every series of the target.
+	// HonorLabels keeps the values of the target when they conflict
+	Job         string            `yaml:"job"`
+	Instance    string            `yaml:"instance"`
+	Labels      map[string]string `yaml:"labels"`
+	HonorLabels bool              `yaml:"honor_labels"`
+
+	// BodySizeLimit and SampleLimit fail scrapes exceeding them. They
+	// default to --scrape.body-size-limit and --scrape.sample-limit
+	BodySizeLimit byteSize `yaml:"body_size_limit"`
+	SampleLimit   int      `yaml:"sample_limit"`
+
+	BearerToken     string           `yaml:"bearer_token"`
+	BearerTokenFile string           `yaml:"bearer_token_file"`
+	BasicAuth       *basicAuthConfig `yaml:"basic_auth"`
+	TLS             tlsConfig        `yaml:"tls"`
+}
+
+type basicAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type tlsConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// byteSize is a number of bytes given either as an integer or with a unit,
+// e.g. 10MB. Units are powers of 1024
+type byteSize int64
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (b *byteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var n int64
+	if err := unmarshal(&n); err == nil {
+		*b = byteSize(n)
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := units.ParseBase2Bytes(s)
+	if err != nil {
+		return errors.Wrapf(err, "invalid size %q", s)
+	}
+	*b = byteSize(v)
+	return nil
+}
+
+// readConfigFile reads the YAML document at path. Unknown keys are rejected
+// so a typo does not silently fall back to a default
+func readConfigFile(path string) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+
+	fc := new(fileConfig)
+	if err := yaml.UnmarshalStrict(b, fc); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config file %q", path)
+	}
+	return fc, nil
+}
+
+// loadConfig reads the config file, if one was provided, and merges it with
+// the command line flags in args. Flags in args take precedence
+func loadConfig(args []string) error {
+	var err error
+	explicitFlags, err = parseExplicitFlags(args)
+	if err != nil {
+		return err
+	}
+
+	fc := new(fileConfig)
+	if config.file != "" {
+		if fc, err = readConfigFile(config.file); err != nil {
+			return err
+		}
+	}
+
+	return fc.apply()
+}
+
+// apply applies the file config to the agent config and to every flag that
+// was not passed explicitly
+func (c *fileConfig) apply() error {
+	bools := map[string]*bool{
+		"debug":           c.Debug,
+		"syslog":          c.Syslog,
+		"admin.metrics":   c.Admin.Metrics,
+		"schedule.align":  c.Schedule.Align,
+		"cgroups.enabled": c.Cgroups.Enabled,
+	}
+	for name, v := range bools {
+		if v == nil {
+			continue
+		}
+		if err := setFlag(name, strconv.FormatBool(*v)); err != nil {
+			return err
+		}
+	}
+
+	strs := map[string]string{
+		"auth-host":            c.Endpoints.Auth,
+		"metadata-host":        c.Endpoints.Metadata,
+		"sonar-host":           c.Endpoints.Sonar,
+		"admin.listen-address": c.Admin.ListenAddress,
+		"file-sd.directory":    c.FileSD.Directory,
+		"statsd.udp-address":   c.StatsD.UDPAddress,
+		"statsd.tcp-address":   c.StatsD.TCPAddress,
+		"textfile.directory":   c.Textfile.Directory,
+	}
+	for name, v := range strs {
+		if v == "" {
+			continue
+		}
+		if err := setFlag(name, v); err != nil {
+			return err
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"schedule.jitter":    c.Schedule.Jitter,
+		"collectors.timeout": c.Collectors.Timeout,
+		"file-sd.interval":   c.FileSD.Interval,
+		"file-sd.debounce":   c.FileSD.Debounce,
+		"textfile.staleness": c.Textfile.Staleness,
+	}
+	for name, v := range durations {
+		if v == nil {
+			continue
+		}
+		if err := setFlag(name, v.String()); err != nil {
+			return err
+		}
+	}
+
+	ints := map[string]*int{
+		"collectors.max-concurrency": c.Collectors.MaxConcurrency,
+		"processes.top":              c.Processes.Top,
+		"scrape.concurrency":         c.Scrape.Concurrency,
+		"scrape.sample-limit":        c.Scrape.SampleLimit,
+		"statsd.max-series":          c.StatsD.MaxSeries,
+		"textfile.max-series":        c.Textfile.MaxSeries,
+		"plugins.max-concurrency":    c.Plugins.MaxConcurrency,
+	}
+	for name, v := range ints {
+		if v == nil {
+			continue
+		}
+		if err := setFlag(name, strconv.Itoa(*v)); err != nil {
+			return err
+		}
+	}
+
+	sizes := map[string]*byteSize{
+		"scrape.body-size-limit": c.Scrape.BodySizeLimit,
+		"textfile.max-file-size": c.Textfile.MaxFileSize,
+	}
+	for name, v := range sizes {
+		if v == nil {
+			continue
+		}
+		if err := setFlag(name, units.Base2Bytes(*v).String()); err != nil {
+			return err
+		}
+	}
+
+	config.decorators = decoratorNames()
+	if c.Decorators != nil {
+		config.decorators = c.Decorators
+	}
+
+	config.writers = c.Writers
+	if len(config.writers) == 0 {
+		config.writers = []writerConfig{{Type: writerSonar}}
+	}
+	if config.stdoutOnly {
+		config.writers = []writerConfig{{Type: writerStdout}}
+	}
+
+	config.collectors = map[string]bool{}
+	for _, name := range c.Collectors.Disabled {
+		config.collectors[name] = false
+	}
+	for _, name := range c.Collectors.Enabled {
+		if _, ok := config.collectors[name]; ok {
+			return errors.Errorf("collector %q is both enabled and disabled", name)
+		}
+		config.collectors[name] = true
+	}
+
+	config.collectorTimeouts = c.Collectors.Timeouts
+	config.processGroups = c.Processes.Groups
+	config.cgroupsInclude = c.Cgroups.Include
+	config.cgroupsExclude = c.Cgroups.Exclude
+	config.statsdMappings = c.StatsD.Mappings
+	config.statsdBuckets = c.StatsD.Buckets
+	config.plugins = c.Plugins.Exec
+
+	config.ignoredMountPoints = ignoredMountPoints
+	if c.Filesystem.IgnoredMountPoints != nil {
+		config.ignoredMountPoints = c.Filesystem.IgnoredMountPoints
+	}
+	config.ignoredFSTypes = ignoredFSTypes
+	if c.Filesystem.IgnoredFSTypes != nil {
+		config.ignoredFSTypes = c.Filesystem.IgnoredFSTypes
+	}
+
+	return c.applyTargets()
+}
+
+// applyTargets merges the targets from the file with the ones passed with
+// --target. A flag replaces the target of the same name in the file
+func (c *fileConfig) applyTargets() error {
+	config.targets = map[string]targetConfig{}
+	for _, t := range c.Targets {
+		if t.Name == "" {
+			return errors.Errorf("target with url %q has no name", t.URL)
+		}
+		if _, ok := config.targets[t.Name]; ok {
+			return errors.Errorf("target %q is defined more than once", t.Name)
+		}
+		config.targets[t.Name] = withTargetDefaults(t)
+	}
+
+	for name, uri := range config.targetFlags {
+		config.targets[name] = withTargetDefaults(targetConfig{Name: name, URL: uri})
+	}
+
+	return nil
+}
+
+// targetDefaults are the timeout and limits of targets which do not set
+// their own
+type targetDefaults struct {
+	timeout       time.Duration
+	bodySizeLimit byteSize
+	sampleLimit   int
+}
+
+// currentTargetDefaults returns the target defaults of the loaded
+// configuration
+func currentTargetDefaults() targetDefaults {
+	return targetDefaults{
+		timeout:       config.targetTimeout,
+		bodySizeLimit: byteSize(config.scrapeBodySizeLimit),
+		sampleLimit:   config.scrapeSampleLimit,
+	}
+}
+
+// apply fills in the timeout and limits of t which are not set
+func (d targetDefaults) apply(t targetConfig) targetConfig {
+	if t.Timeout == 0 {
+		t.Timeout = d.timeout
+	}
+	if t.BodySizeLimit == 0 {
+		t.BodySizeLimit = d.bodySizeLimit
+	}
+	if t.SampleLimit == 0 {
+		t.SampleLimit = d.sampleLimit
+	}
+	return t
+}
+
+// withTargetDefaults fills in the timeout and limits of t which are not set
+// from the loaded configuration
+func withTargetDefaults(t targetConfig) targetConfig {
+	return currentTargetDefaults().apply(t)
+}
+
+// parseExplicitFlags returns the names of all flags present in args
+func parseExplicitFlags(args []string) (map[string]bool, error) {
+	ctx, err := kingpin.CommandLine.ParseContext(args)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse command line")
+	}
+
+	flags := map[string]bool{}
+	for _, el := range ctx.Elements {
+		if f, ok := el.Clause.(*kingpin.FlagClause); ok {
+			flags[f.Model().Name] = true
+		}
+	}
+	return flags, nil
+}
+
+// hasFlag reports whether a flag with the given name is registered
+func hasFlag(name string) bool {
+	return kingpin.CommandLine.GetFlag(name) != nil
+}
+
+// setFlag sets the value of the named flag unless it was passed explicitly on
+// the command line
+func setFlag(name, value string) error {
+	if explicitFlags[name] {
+		return nil
+	}
+
+	f := kingpin.CommandLine.GetFlag(name)
+	if f == nil {
+		return errors.Errorf("unknown flag --%s", name)
+	}
+	return errors.Wrapf(f.Model().Value.Set(value), "invalid value %q for --%s", value, name)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "metrics-agent")
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestReadConfigFileParsesDocument(t *testing.T) {
+	path := writeConfigFile(t, `
+debug: true
+endpoints:
+  sonar: https://sonar.example.com
+writers:
+  - type: sonar
+  - type: file
+    path: /var/log/metrics.log
+    interval: 30s
+    decorators: [LowercaseNames]
+collectors:
+  enabled: [systemd]
+  disabled: [wifi]
+filesystem:
+  ignored_fs_types: [tmpfs]
+decorators: [compat.Names]
+targets:
+  - name: app
+    url: http://localhost:8080
+    timeout: 2s
+    exemplars: true
+`)
+
+	defer os.Remove(path)
+
+	fc, err := readConfigFile(path)
+	require.NoError(t, err)
+	require.NotNil(t, fc.Debug)
+	assert.True(t, *fc.Debug)
+	assert.Equal(t, "https://sonar.example.com", fc.Endpoints.Sonar)
+	assert.Equal(t, []writerConfig{
+		{Type: writerSonar},
+		{Type: writerFile, Path: "/var/log/metrics.log", Interval: 30 * time.Second, Decorators: []string{"LowercaseNames"}},
+	}, fc.Writers)
+	assert.Equal(t, []string{"systemd"}, fc.Collectors.Enabled)
+	assert.Equal(t, []string{"wifi"}, fc.Collectors.Disabled)
+	assert.Equal(t, []string{"tmpfs"}, fc.Filesystem.IgnoredFSTypes)
+	assert.Nil(t, fc.Filesystem.IgnoredMountPoints)
+	assert.Equal(t, []string{"compat.Names"}, fc.Decorators)
+	assert.Equal(t, []targetConfig{{Name: "app", URL: "http://localhost:8080", Timeout: 2 * time.Second, Exemplars: true}}, fc.Targets)
+}
+
+func TestReadConfigFileRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "endpoints:\n  sonr: https://sonar.example.com\n")
+	defer os.Remove(path)
+
+	_, err := readConfigFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "sonr")
+}
+
+func TestFileConfigAppliesFlags(t *testing.T) {
+	explicitFlags = map[string]bool{}
+	defer func() { config.sonarEndpoint = defaultSonarURL }()
+
+	fc := &fileConfig{Endpoints: endpointsConfig{Sonar: "https://sonar.example.com"}}
+	require.NoError(t, fc.apply())
+	assert.Equal(t, "https://sonar.example.com", config.sonarEndpoint)
+}
+
+func TestFileConfigDoesNotOverrideExplicitFlags(t *testing.T) {
+	explicitFlags = map[string]bool{"sonar-host": true}
+	defer func() { explicitFlags = map[string]bool{} }()
+	config.sonarEndpoint = "https://flag.example.com"
+	defer func() { config.sonarEndpoint = defaultSonarURL }()
+
+	fc := &fileConfig{Endpoints: endpointsConfig{Sonar: "https://sonar.example.com"}}
+	require.NoError(t, fc.apply())
+	assert.Equal(t, "https://flag.example.com", config.sonarEndpoint)
+}
+
+func TestFileConfigRejectsInvalidEndpoints(t *testing.T) {
+	explicitFlags = map[string]bool{}
+
+	fc := &fileConfig{Endpoints: endpointsConfig{Auth: "://nope"}}
+	assert.Error(t, fc.apply())
+}
+
+func TestFileConfigDefaultsToSonarWriter(t *testing.T) {
+	require.NoError(t, new(fileConfig).apply())
+	assert.Equal(t, []writerConfig{{Type: writerSonar}}, config.writers)
+}
+
+func TestFileConfigStdoutOnlyReplacesWriters(t *testing.T) {
+	config.stdoutOnly = true
+	defer func() { config.stdoutOnly = false }()
+
+	fc := &fileConfig{Writers: []writerConfig{{Type: writerSonar}, {Type: writerFile, Path: "/tmp/metrics"}}}
+	require.NoError(t, fc.apply())
+	assert.Equal(t, []writerConfig{{Type: writerStdout}}, config.writers)
+}
+
+func TestFileConfigRejectsDuplicateTargets(t *testing.T) {
+	fc := &fileConfig{Targets: []targetConfig{
+		{Name: "app", URL: "http://localhost:8080"},
+		{Name: "app", URL: "http://localhost:8081"},
+	}}
+	assert.Error(t, fc.apply())
+}
+
+func TestFileConfigTargetFlagsOverrideFile(t *testing.T) {
+	config.targetTimeout = time.Second
+	config.targetFlags = map[string]string{"app": "http://localhost:9090"}
+	defer func() { config.targetFlags = map[string]string{} }()
+
+	fc := &fileConfig{Targets: []targetConfig{
+		{Name: "app", URL: "http://localhost:8080", Timeout: 2 * time.Second},
+		{Name: "other", URL: "http://localhost:8081"},
+	}}
+	require.NoError(t, fc.apply())
+	assert.Equal(t, map[string]targetConfig{
+		"app":   {Name: "app", URL: "http://localhost:9090", Timeout: time.Second},
+		"other": {Name: "other", URL: "http://localhost:8081", Timeout: time.Second},
+	}, config.targets)
+}
+
+func TestFileConfigDefaultsDecorators(t *testing.T) {
+	require.NoError(t, new(fileConfig).apply())
+	assert.Equal(t, decoratorNames(), config.decorators)
+}
+
+func TestParseExplicitFlagsFindsNegatedFlags(t *testing.T) {
+	flags, err := parseExplicitFlags([]string{"--debug", "--no-collector.textfile"})
+	require.NoError(t, err)
+	assert.True(t, flags["debug"])
+	assert.True(t, flags[collectorFlag("textfile")])
+	assert.False(t, flags["syslog"])
+}
+
+func TestFileConfigAppliesScrapeLimits(t *testing.T) {
+	explicitFlags = map[string]bool{}
+	defer func() {
+		config.scrapeBodySizeLimit = 0
+		config.scrapeSampleLimit = 0
+		config.scrapeConcurrency = defaultScrapeConcurrency
+	}()
+
+	path := writeConfigFile(t, `
+scrape:
+  concurrency: 2
+  body_size_limit: 10MB
+  sample_limit: 5000
+targets:
+  - name: app
+    url: http://localhost:8080
+  - name: big
+    url: http://localhost:8081
+    body_size_limit: 65536
+    sample_limit: 100000
+`)
+	defer os.Remove(path)
+
+	fc, err := readConfigFile(path)
+	require.NoError(t, err)
+	require.NoError(t, fc.apply())
+
+	assert.Equal(t, 2, config.scrapeConcurrency)
+	assert.Equal(t, byteSize(10<<20), config.targets["app"].BodySizeLimit)
+	assert.Equal(t, 5000, config.targets["app"].SampleLimit)
+	assert.Equal(t, byteSize(64<<10), config.targets["big"].BodySizeLimit)
+	assert.Equal(t, 100000, config.targets["big"].SampleLimit)
+
+	path = writeConfigFile(t, "scrape:\n  body_size_limit: lots\n")
+	defer os.Remove(path)
+	_, err = readConfigFile(path)
+	assert.Error(t, err)
+}
+
+func TestFileConfigSetsTextfile(t *testing.T) {
+	explicitFlags = map[string]bool{}
+	defer func() {
+		config.textfileDir = ""
+		config.textfileMaxFileSize = 0
+		config.textfileMaxSeries = 0
+		config.textfileStaleness = 0
+	}()
+
+	path := writeConfigFile(t, `
+textfile:
+  directory: /var/lib/metrics-agent/textfile
+  max_file_size: 64KB
+  max_series: 100
+  staleness: 2h
+`)
+	defer os.Remove(path)
+
+	fc, err := readConfigFile(path)
+	require.NoError(t, err)
+	require.NoError(t, fc.apply())
+	assert.Equal(t, "/var/lib/metrics-agent/textfile", config.textfileDir)
+	assert.Equal(t, units.Base2Bytes(64<<10), config.textfileMaxFileSize)
+	assert.Equal(t, 100, config.textfileMaxSeries)
+	assert.Equal(t, 2*time.Hour, config.textfileStaleness)
+
+	c, err := newTextfileCollector()
+	require.NoError(t, err)
+	assert.NotNil(t, c)
+
+	config.textfileMaxSeries = 0
+	_, err = newTextfileCollector()
+	assert.Error(t, err)
+}
@@ -15,40 +15,48 @@
 
 package main
 
-import (
-	"strings"
-	"sync"
-)
+import "strings"
 
 const (
-	ignoredMountPointFlag = "--collector.filesystem.ignored-mount-points"
-	ignoredFSTypesFlag    = "--collector.filesystem.ignored-fs-types"
+	ignoredMountPointsFlag = "collector.filesystem.ignored-mount-points"
+	ignoredFSTypesFlag     = "collector.filesystem.ignored-fs-types"
 )
 
 var (
-	ignoredMountPoints = strings.Join([]string{
+	// ignoredMountPoints is the default list of mount point patterns the
+	// filesystem collector ignores
+	ignoredMountPoints = []string{
 		"fusectl", "lxcfs", "mqueue", "none", "rootfs", "sunrpc",
 		"systemd", "udev",
-	}, `|`)
+	}
 
-	ignoredFSTypes = strings.Join([]string{
+	// ignoredFSTypes is the default list of filesystem type patterns the
+	// filesystem collector ignores
+	ignoredFSTypes = []string{
 		"aufs", "autofs", "binfmt_misc", "cifs", "cgroup", "debugfs",
 		"devpts", "devtmpfs", "ecryptfs", "efivarfs", "fuse",
 		"hugetlbfs", "mqueue", "nfs", "overlayfs", "proc", "pstore",
 		"rpc_pipefs", "securityfs", "smb", "sysfs", "tmpfs", "tracefs",
 		"squashfs",
-	}, `|`)
-
-	onceRegisterFilesystemFlags = new(sync.Once)
+	}
 )
 
-// registerFilesystemFlags registers filesystem cli flags.
-// This should be called from within OS-specific builds since the underlying
-// collectors will not be registered otherwise.
-// This func can be called multiple times.
-func registerFilesystemFlags() {
-	onceRegisterFilesystemFlags.Do(func() {
-		additionalParams = append(additionalParams, ignoredFSTypesFlag, ignoredFSTypes)
-		additionalParams = append(additionalParams, ignoredMountPointFlag, ignoredMountPoints)
-	})
+// applyFilesystemFlags sets the filesystem collector ignore lists from the
+// loaded configuration. The filesystem collector is not built on every
+// platform so its flags are skipped when node_exporter did not register them
+func applyFilesystemFlags() error {
+	flags := map[string][]string{
+		ignoredMountPointsFlag: config.ignoredMountPoints,
+		ignoredFSTypesFlag:     config.ignoredFSTypes,
+	}
+
+	for name, patterns := range flags {
+		if !hasFlag(name) {
+			continue
+		}
+		if err := setFlag(name, strings.Join(patterns, "|")); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,23 +1,33 @@
 package main
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestRegisterFilesystemFlagsRegistersFSTypesFlag(t *testing.T) {
-	// this is initialized with the _linux.go file if run on linux, but
-	// this test should run on all operating systems so we initialize it
-	registerFilesystemFlags()
-	assert.NotEmpty(t, additionalParams)
-	assert.Contains(t, additionalParams, ignoredFSTypes)
+func TestApplyFilesystemFlagsSetsFSTypesFlag(t *testing.T) {
+	// the filesystem collector is not available on every operating system
+	if !hasFlag(ignoredFSTypesFlag) {
+		t.Skip("filesystem collector is not registered")
+	}
+	explicitFlags = map[string]bool{}
+	config.ignoredFSTypes = ignoredFSTypes
+
+	require.NoError(t, applyFilesystemFlags())
+	assert.Equal(t, strings.Join(ignoredFSTypes, "|"), flagValue(t, ignoredFSTypesFlag))
 }
 
-func TestRegisterFilesystemFlagsRegistersMountPointFlag(t *testing.T) {
-	// this is initialized with the _linux.go file if run on linux, but
-	// this test should run on all operating systems so we initialize it
-	registerFilesystemFlags()
-	assert.NotEmpty(t, additionalParams)
-	assert.Contains(t, additionalParams, ignoredMountPoints)
+func TestApplyFilesystemFlagsSetsMountPointFlag(t *testing.T) {
+	// the filesystem collector is not available on every operating system
+	if !hasFlag(ignoredMountPointsFlag) {
+		t.Skip("filesystem collector is not registered")
+	}
+	explicitFlags = map[string]bool{}
+	config.ignoredMountPoints = ignoredMountPoints
+
+	require.NoError(t, applyFilesystemFlags())
+	assert.Equal(t, strings.Join(ignoredMountPoints, "|"), flagValue(t, ignoredMountPointsFlag))
 }
@@ -16,7 +16,6 @@
 package main
 
 func init() {
-	registerFilesystemFlags()
 	disableCollectors("arp", "bcache", "bonding", "buddyinfo", "conntrack",
 		"drbd", "edac", "entropy", "filefd", "hwmon", "infiniband",
 		"interrupts", "ipvs", "ksmd", "logind", "mdadm", "meminfo_numa",
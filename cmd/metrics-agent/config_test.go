@@ -2,36 +2,101 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-func TestDisableCollectorsAddsCorrectFlags(t *testing.T) {
-	// some params are added by init funcs in os files so reset it to test
-	additionalParams = []string{}
-	disabledCollectors = map[string]interface{}{}
+func flagValue(t *testing.T, name string) string {
+	f := kingpin.CommandLine.GetFlag(name)
+	require.NotNil(t, f, "flag %q is not registered", name)
+	return f.Model().Value.String()
+}
 
-	items := []string{"hello", "world"}
-	flags := make([]string, len(items))
-	for i, item := range items {
-		flags[i] = disableCollectorFlag(item)
-	}
+func TestDisableCollectorsAddsCollectors(t *testing.T) {
+	// some collectors are added by init funcs in os files so reset it to test
+	disabledCollectors = map[string]interface{}{}
 
-	disableCollectors(items...)
-	assert.EqualValues(t, flags, additionalParams)
+	disableCollectors("hello", "world")
+	assert.EqualValues(t, map[string]interface{}{"hello": nil, "world": nil}, disabledCollectors)
 }
 
 func TestDisableCollectorsIsIdempotent(t *testing.T) {
-	// some params are added by init funcs in os files so reset it to test
-	additionalParams = []string{}
+	// some collectors are added by init funcs in os files so reset it to test
+	disabledCollectors = map[string]interface{}{}
+
+	disableCollectors("hello", "world", "world")
+	assert.EqualValues(t, map[string]interface{}{"hello": nil, "world": nil}, disabledCollectors)
+}
+
+func TestApplyCollectorFlagsDisablesDefaultCollectors(t *testing.T) {
+	disabledCollectors = map[string]interface{}{}
+	explicitFlags = map[string]bool{}
+	config.collectors = map[string]bool{}
+
+	disableCollectors("textfile")
+	require.NoError(t, applyCollectorFlags())
+	assert.Equal(t, "false", flagValue(t, collectorFlag("textfile")))
+}
+
+func TestApplyCollectorFlagsConfigOverridesDefaults(t *testing.T) {
+	disabledCollectors = map[string]interface{}{}
+	explicitFlags = map[string]bool{}
+	config.collectors = map[string]bool{"textfile": true}
+
+	disableCollectors("textfile")
+	require.NoError(t, applyCollectorFlags())
+	assert.Equal(t, "true", flagValue(t, collectorFlag("textfile")))
+}
+
+func TestApplyCollectorFlagsSkipsExplicitFlags(t *testing.T) {
 	disabledCollectors = map[string]interface{}{}
+	explicitFlags = map[string]bool{collectorFlag("textfile"): true}
+	config.collectors = map[string]bool{}
+	defer func() { explicitFlags = map[string]bool{} }()
+
+	require.NoError(t, kingpin.CommandLine.GetFlag(collectorFlag("textfile")).Model().Value.Set("true"))
+	disableCollectors("textfile")
+	require.NoError(t, applyCollectorFlags())
+	assert.Equal(t, "true", flagValue(t, collectorFlag("textfile")))
+}
+
+func TestCheckConfigRejectsUnknownCollectors(t *testing.T) {
+	config.collectors = map[string]bool{"nope": true}
+	defer func() { config.collectors = nil }()
+
+	assert.Contains(t, checkConfig().Error(), "nope")
+}
 
-	items := []string{"hello", "world", "world"}
-	flags := []string{
-		disableCollectorFlag("hello"),
-		disableCollectorFlag("world"),
+func TestCheckConfigRejectsUnknownDecorators(t *testing.T) {
+	config.decorators = []string{"nope"}
+	defer func() { config.decorators = nil }()
+
+	assert.Error(t, checkConfig())
+}
+
+func TestCheckConfigRejectsInvalidTargetNames(t *testing.T) {
+	defer func() { config.targets = nil }()
+
+	for _, name := range []string{"my-app", "my:app", "1app"} {
+		config.targets = map[string]targetConfig{
+			name: {Name: name, URL: "http://localhost:8080", Timeout: time.Second},
+		}
+		assert.Error(t, checkConfig(), name)
 	}
 
-	disableCollectors(items...)
-	assert.EqualValues(t, flags, additionalParams)
+	config.targets = map[string]targetConfig{
+		"my_app2": {Name: "my_app2", URL: "http://localhost:8080", Timeout: time.Second},
+	}
+	assert.NoError(t, checkConfig())
+}
+
+func TestInitDecoratorUsesConfiguredOrder(t *testing.T) {
+	chain, err := initDecorator([]string{"LowercaseNames", "compat.CPU"})
+	require.NoError(t, err)
+	require.Len(t, chain, 2)
+	assert.Equal(t, "LowercaseNames", chain[0].Name())
+	assert.Equal(t, "compat.CPU", chain[1].Name())
 }
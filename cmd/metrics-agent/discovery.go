@@ -0,0 +1,322 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/collector"
+	"github.com/digitalocean/metrics-agent/pkg/discovery"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	defaultFileSDInterval = 5 * time.Second
+	defaultFileSDDebounce = 2 * time.Second
+
+	// labels of a target group which control how its targets are scraped,
+	// named as in Prometheus
+	schemeLabel      = model.SchemeLabel
+	metricsPathLabel = model.MetricsPathLabel
+	paramLabelPrefix = model.ParamLabelPrefix
+	timeoutLabel     = "__scrape_timeout__"
+
+	stageFile   = "file"
+	stageTarget = "target"
+)
+
+// discoveryMetrics describes file based target discovery. Like selfMetrics it
+// is shared by every pipeline so counters survive reloads
+var discoveryMetrics = newTargetDiscoveryMetrics()
+
+type targetDiscoveryMetrics struct {
+	errors      *prometheus.CounterVec
+	targets     prometheus.Gauge
+	lastRefresh prometheus.Gauge
+}
+
+func newTargetDiscoveryMetrics() *targetDiscoveryMetrics {
+	return &targetDiscoveryMetrics{
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "discovery_errors_total",
+			Help:      "Number of target files which could not be read and discovered targets which could not be scraped, by stage.",
+		}, []string{"stage"}),
+		targets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "discovery_targets",
+			Help:      "Number of discovered targets currently scraped.",
+		}),
+		lastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "discovery_last_refresh_timestamp_seconds",
+			Help:      "Time the discovered targets were last updated.",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *targetDiscoveryMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.errors.Describe(ch)
+	m.targets.Describe(ch)
+	m.lastRefresh.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (m *targetDiscoveryMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.errors.Collect(ch)
+	m.targets.Collect(ch)
+	m.lastRefresh.Collect(ch)
+}
+
+// targetDiscovery keeps the discovered targets of a pipeline up to date
+type targetDiscovery struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startDiscovery registers the targets found in the discovery directory with
+// reg and keeps them up to date until the discovery is stopped. It returns
+// nil when discovery is not configured
+func startDiscovery(ctx context.Context, reg prometheus.Registerer) *targetDiscovery {
+	if config.fileSDDir == "" {
+		return nil
+	}
+
+	w := discovery.NewFileWatcher(config.fileSDDir, config.fileSDInterval, config.fileSDDebounce)
+	m := newTargetManager(reg)
+	m.update(w.Refresh())
+
+	ctx, cancel := context.WithCancel(ctx)
+	d := &targetDiscovery{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		w.Run(ctx, m.update)
+	}()
+	return d
+}
+
+// discoverOnce registers the targets currently found in the discovery
+// directory with reg
+func discoverOnce(reg prometheus.Registerer) {
+	if config.fileSDDir == "" {
+		return
+	}
+	w := discovery.NewFileWatcher(config.fileSDDir, config.fileSDInterval, config.fileSDDebounce)
+	newTargetManager(reg).update(w.Refresh())
+}
+
+// stop stops watching for changes and waits until the last update finished
+func (d *targetDiscovery) stop() {
+	if d == nil {
+		return
+	}
+	d.cancel()
+	<-d.done
+}
+
+// targetManager adds, replaces and removes the scrapers of discovered
+// targets in a registry. It keeps the pool and target defaults it was created
+// with since reloads replace the global ones while it is running
+type targetManager struct {
+	reg      prometheus.Registerer
+	pool     *collector.ScrapePool
+	defaults targetDefaults
+	metrics  *targetDiscoveryMetrics
+	now      func() time.Time
+
+	scrapers map[string]managedScraper
+}
+
+type managedScraper struct {
+	cfg targetConfig
+	s   *collector.Scraper
+}
+
+// newTargetManager creates a manager for reg. Its scrapers share the pool of
+// the pipeline created last
+func newTargetManager(reg prometheus.Registerer) *targetManager {
+	return &targetManager{
+		reg:      reg,
+		pool:     scrapePool,
+		defaults: currentTargetDefaults(),
+		metrics:  discoveryMetrics,
+		now:      time.Now,
+		scrapers: map[string]managedScraper{},
+	}
+}
+
+// update is called with the current target groups and the errors of the
+// files which could not be read
+func (m *targetManager) update(groups []discovery.TargetGroup, errs []error) {
+	for _, err := range errs {
+		log.Error("target discovery failed: %+v", err)
+	}
+	m.metrics.errors.WithLabelValues(stageFile).Add(float64(len(errs)))
+
+	targets, terrs := discoveredTargets(groups, m.defaults)
+	terrs = append(terrs, m.sync(targets)...)
+	for _, err := range terrs {
+		log.Error("discovered target is not scraped: %+v", err)
+	}
+	m.metrics.errors.WithLabelValues(stageTarget).Add(float64(len(terrs)))
+
+	m.metrics.targets.Set(float64(len(m.scrapers)))
+	m.metrics.lastRefresh.Set(float64(m.now().UnixNano()) / 1e9)
+}
+
+// sync registers a scraper for every new target, replaces the ones whose
+// configuration changed and unregisters the ones which are gone
+func (m *targetManager) sync(targets map[string]targetConfig) []error {
+	for name, cur := range m.scrapers {
+		if t, ok := targets[name]; ok && reflect.DeepEqual(t, cur.cfg) {
+			continue
+		}
+		m.reg.Unregister(cur.s)
+		delete(m.scrapers, name)
+		log.Info("stopped scraping discovered target %q", name)
+	}
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if _, ok := m.scrapers[name]; ok {
+			continue
+		}
+		t := targets[name]
+		s, err := collector.NewScraper(name, t.URL, t.Timeout, scraperOpts(t, m.pool)...)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to create scraper for target %q", name))
+			continue
+		}
+		if err := m.reg.Register(s); err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to register scraper for target %q", name))
+			continue
+		}
+		m.scrapers[name] = managedScraper{cfg: t, s: s}
+		log.Info("scraping discovered target %q at %s with timeout %s", name, t.URL, t.Timeout)
+	}
+	return errs
+}
+
+// discoveredTargets turns target groups into target configurations named
+// after their job and instance. The job defaults to the name of the file the
+// group was read from and unset limits to defaults
+func discoveredTargets(groups []discovery.TargetGroup, defaults targetDefaults) (map[string]targetConfig, []error) {
+	var errs []error
+	res := map[string]targetConfig{}
+	for _, g := range groups {
+		for _, addr := range g.Targets {
+			t, err := groupTarget(g, addr, defaults)
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "invalid target %q in %s", addr, g.Source))
+				continue
+			}
+			if _, ok := res[t.Name]; ok {
+				errs = append(errs, errors.Errorf("target %q in %s is discovered more than once", addr, g.Source))
+				continue
+			}
+			res[t.Name] = t
+		}
+	}
+	return res, errs
+}
+
+func groupTarget(g discovery.TargetGroup, addr string, defaults targetDefaults) (targetConfig, error) {
+	t := defaults.apply(targetConfig{
+		Job:      g.Labels[model.JobLabel],
+		Instance: g.Labels[model.InstanceLabel],
+		URL:      addr,
+	})
+	if t.Job == "" {
+		base := filepath.Base(g.Source)
+		t.Job = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if t.Instance == "" {
+		t.Instance = addr
+	}
+
+	if !strings.Contains(addr, "://") {
+		u := &url.URL{Scheme: "http", Host: addr, Path: "/metrics"}
+		params := url.Values{}
+		for name, value := range g.Labels {
+			switch {
+			case name == schemeLabel:
+				u.Scheme = value
+			case name == metricsPathLabel:
+				u.Path = value
+			case strings.HasPrefix(name, paramLabelPrefix):
+				params.Set(strings.TrimPrefix(name, paramLabelPrefix), value)
+			}
+		}
+		u.RawQuery = params.Encode()
+		t.URL = u.String()
+	}
+
+	if v, ok := g.Labels[timeoutLabel]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return targetConfig{}, errors.Errorf("invalid scrape timeout %q", v)
+		}
+		t.Timeout = d
+	}
+
+	for name, value := range g.Labels {
+		if strings.HasPrefix(name, model.ReservedLabelPrefix) ||
+			name == model.JobLabel || name == model.InstanceLabel {
+			continue
+		}
+		if t.Labels == nil {
+			t.Labels = map[string]string{}
+		}
+		t.Labels[name] = value
+	}
+
+	t.Name = targetName(t.Job + "_" + t.Instance)
+	return t, nil
+}
+
+// targetName turns s into a valid target name by replacing every character
+// which is not a letter, digit or underscore
+func targetName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
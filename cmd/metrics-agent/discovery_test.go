@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/pkg/discovery"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoveredTargets(t *testing.T) {
+	targets, errs := discoveredTargets([]discovery.TargetGroup{
+		{
+			Source:  "/etc/targets/api.json",
+			Targets: []string{"10.0.0.1:8080", "unix:///run/app.sock:/stats"},
+			Labels: map[string]string{
+				"env":                "prod",
+				"__scheme__":         "https",
+				"__metrics_path__":   "/stats/prometheus",
+				"__param_format":     "text",
+				"__scrape_timeout__": "2s",
+			},
+		},
+		{
+			Source:  "/etc/targets/misc.yml",
+			Targets: []string{"localhost:9000", "localhost:9000", "localhost:9001"},
+			Labels:  map[string]string{"job": "worker", "__scrape_timeout__": "soon"},
+		},
+	}, targetDefaults{timeout: defaultTargetTimeout, sampleLimit: 100})
+	assert.Len(t, errs, 3)
+	require.Len(t, targets, 2)
+
+	api := targets["api_10_0_0_1_8080"]
+	assert.Equal(t, "https://10.0.0.1:8080/stats/prometheus?format=text", api.URL)
+	assert.Equal(t, "api", api.Job)
+	assert.Equal(t, "10.0.0.1:8080", api.Instance)
+	assert.Equal(t, map[string]string{"env": "prod"}, api.Labels)
+	assert.Equal(t, 2*time.Second, api.Timeout)
+	assert.Equal(t, 100, api.SampleLimit)
+
+	sock := targets["api_unix____run_app_sock__stats"]
+	assert.Equal(t, "unix:///run/app.sock:/stats", sock.URL)
+}
+
+// countingRegistry records the collectors registered with it
+type countingRegistry struct {
+	*prometheus.Registry
+	registered int
+}
+
+func (r *countingRegistry) Register(c prometheus.Collector) error {
+	r.registered++
+	return r.Registry.Register(c)
+}
+
+func TestTargetManagerSync(t *testing.T) {
+	config.targetTimeout = defaultTargetTimeout
+	defer func() { config.targetTimeout = 0 }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app_requests_total 3\n"))
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	g := &layeredGatherer{core: prometheus.NewRegistry()}
+	reg := &countingRegistry{Registry: g.layer()}
+	m := newTargetManager(reg)
+	m.metrics = newTargetDiscoveryMetrics()
+
+	// a reload replacing the configuration does not affect the manager
+	config.targetTimeout = time.Minute
+
+	instances := func() []string {
+		mfs, err := g.Gather()
+		require.NoError(t, err)
+		res := []string{}
+		for _, mf := range mfs {
+			if mf.GetName() != "app_requests_total" {
+				continue
+			}
+			for _, met := range mf.Metric {
+				res = append(res, labelValue(met, "instance")+"/"+labelValue(met, "team"))
+			}
+		}
+		return res
+	}
+	group := func(labels map[string]string, targets ...string) []discovery.TargetGroup {
+		return []discovery.TargetGroup{{Source: "app.json", Targets: targets, Labels: labels}}
+	}
+
+	m.update(group(nil, addr), nil)
+	assert.Equal(t, []string{addr + "/"}, instances())
+	assert.Equal(t, 1.0, gaugeValue(t, m.metrics.targets))
+	for _, s := range m.scrapers {
+		assert.Equal(t, defaultTargetTimeout, s.cfg.Timeout)
+	}
+
+	// unchanged targets keep their scraper
+	m.update(group(nil, addr), nil)
+	assert.Equal(t, 1, reg.registered)
+
+	// changed labels replace it
+	m.update(group(map[string]string{"team": "payments", "instance": "app-1"}, addr), nil)
+	assert.Equal(t, []string{"app-1/payments"}, instances())
+	assert.Equal(t, 2, reg.registered)
+
+	m.update(nil, []error{assert.AnError})
+	assert.Empty(t, instances())
+	assert.Equal(t, 0.0, gaugeValue(t, m.metrics.targets))
+	assert.Equal(t, 1.0, counterValue(t, m.metrics.errors.WithLabelValues(stageFile)))
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	var m dto.Metric
+	require.NoError(t, g.Write(&m))
+	return m.GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var m dto.Metric
+	require.NoError(t, c.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestFileConfigSetsFileSD(t *testing.T) {
+	explicitFlags = map[string]bool{}
+	defer func() {
+		config.fileSDDir = ""
+		config.fileSDInterval = defaultFileSDInterval
+		config.fileSDDebounce = defaultFileSDDebounce
+	}()
+
+	debounce := 500 * time.Millisecond
+	fc := &fileConfig{FileSD: fileSDConfig{Directory: "/etc/metrics-agent/targets.d", Debounce: &debounce}}
+	require.NoError(t, fc.apply())
+	assert.Equal(t, "/etc/metrics-agent/targets.d", config.fileSDDir)
+	assert.Equal(t, debounce, config.fileSDDebounce)
+}
@@ -17,11 +17,15 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/collector"
 	"github.com/digitalocean/metrics-agent/pkg/decorate"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -31,11 +35,29 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	os.Args = append(os.Args, additionalParams...)
-
 	// parse all command line flags
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	cmd := kingpin.Parse()
+
+	// the config file fills in everything not set on the command line
+	if err := loadConfig(os.Args[1:]); err != nil {
+		log.Fatal("configuration failure: %+v", err)
+	}
+
+	switch cmd {
+	case collectCmd.FullCommand():
+		log.InitStderr()
+		if err := collect(os.Stdout); err != nil {
+			log.Fatal("collect failed: %+v", err)
+		}
+		return
+	case collectorsCmd.FullCommand():
+		log.InitStderr()
+		if err := listCollectors(os.Stdout); err != nil {
+			log.Fatal("failed to list collectors: %+v", err)
+		}
+		return
+	}
 
 	if config.syslog {
 		if err := log.InitSyslog(); err != nil {
@@ -47,15 +69,41 @@ func main() {
 		log.Fatal("configuration failure: %+v", err)
 	}
 
-	cols := initCollectors()
-	reg := prometheus.NewRegistry()
-	reg.MustRegister(cols...)
+	var admin *http.Server
+	if config.adminListen != "" {
+		var err error
+		if admin, err = startAdmin(config.adminListen, config.adminMetrics); err != nil {
+			log.Fatal("failed to initialize: %+v", err)
+		}
+	}
 
-	w, th := initWriter(ctx)
-	d := initDecorator()
-	run(ctx, w, th, d, reg)
+	var err error
+	if statsdListener, err = startStatsD(); err != nil {
+		log.Fatal("failed to initialize: %+v", err)
+	}
+
+	p, err := newPipeline(ctx, pipeline{}, false)
+	if err != nil {
+		log.Fatal("failed to initialize: %+v", err)
+	}
+
+	cancelOnShutdown(cancel)
+	reloads := watchReloads(ctx, p)
+
+	done := make(chan pipeline, 1)
+	go func() {
+		done <- run(ctx, p, reloads)
+	}()
 
 	<-ctx.Done()
+	code := shutdown(done, config.shutdownTimeout)
+	if admin != nil {
+		admin.Close()
+	}
+	if statsdListener != nil {
+		statsdListener.Close()
+	}
+	os.Exit(code)
 }
 
 type metricWriter interface {
@@ -72,36 +120,312 @@ type gatherer interface {
 	Gather() ([]*dto.MetricFamily, error)
 }
 
-func run(ctx context.Context, w metricWriter, th throttler, dec decorate.Decorator, g gatherer) {
+// pipeline is everything needed to gather metrics and write them to every
+// sink
+type pipeline struct {
+	g     gatherer
+	sinks []sink
+	sched scheduler
+
+	// dec decorates the metrics served on /metrics
+	dec decorate.Decorator
+
+	// collectors are the names of the enabled node_exporter collectors
+	collectors []string
+
+	// discovery keeps the discovered targets registered with g, it is nil
+	// when file_sd is not configured
+	discovery *targetDiscovery
+
+	// plugins runs the exec plugins registered with g, it is nil when none
+	// are configured
+	plugins *pluginRunner
+}
+
+// newPipeline creates a pipeline from the current configuration. Writers of
+// prev are reused where possible, see initSinks
+func newPipeline(ctx context.Context, prev pipeline, reuseSonar bool) (pipeline, error) {
+	reg, names, err := newGatherer()
+	if err != nil {
+		return pipeline{}, err
+	}
+
+	dec, err := initDecorator(config.decorators)
+	if err != nil {
+		return pipeline{}, err
+	}
+
+	sinks, err := initSinks(ctx, prev.sinks, reuseSonar)
+	if err != nil {
+		return pipeline{}, err
+	}
+
+	plugins, err := startPlugins(ctx, reg.layer())
+	if err != nil {
+		return pipeline{}, err
+	}
+
+	return pipeline{
+		g:          reg,
+		sinks:      sinks,
+		sched:      newScheduler(),
+		dec:        dec,
+		collectors: names,
+		discovery:  startDiscovery(ctx, reg.targets),
+		plugins:    plugins,
+	}, nil
+}
+
+// newGatherer registers all configured collectors with a new gatherer. The
+// scrapers, the StatsD listener and the textfile collector get a layer of
+// their own, the exec plugins are added to one by startPlugins. The names of
+// the enabled node_exporter collectors are returned as well
+func newGatherer() (*layeredGatherer, []string, error) {
+	cols, err := initCollectors()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := []string{}
+	g := &layeredGatherer{core: prometheus.NewRegistry()}
+	for _, c := range cols {
+		if err := g.core.Register(c); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to register collector")
+		}
+		if node, ok := c.(*collector.NodeCollector); ok {
+			for name := range node.Collectors() {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	scrapers, err := initScrapers()
+	if err != nil {
+		return nil, nil, err
+	}
+	g.targets = g.layer()
+	for _, s := range scrapers {
+		if err := g.targets.Register(s); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to register collector")
+		}
+	}
+
+	if statsdListener != nil {
+		if err := g.layer().Register(statsdListener); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to register collector")
+		}
+	}
+
+	textfiles, err := newTextfileCollector()
+	if err != nil {
+		return nil, nil, err
+	}
+	if textfiles != nil {
+		log.Info("reporting textfiles in %s", config.textfileDir)
+		if err := g.layer().Register(textfiles); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to register collector")
+		}
+	}
+
+	return g, names, nil
+}
+
+// familyNames holds the families gathered so far in the current gather. Like
+// selfMetrics it is shared by every pipeline since the StatsD listener
+// outlives them
+var familyNames = collector.NewFamilyNames()
+
+// layeredGatherer gathers the collectors of the agent first and then each
+// layer of collectors reporting families named by users, e.g. StatsD,
+// textfiles or plugins. A layer sees the names gathered before it in
+// familyNames and skips them, so a name used twice drops that family instead
+// of failing the whole gather
+type layeredGatherer struct {
+	core   *prometheus.Registry
+	layers []*prometheus.Registry
+
+	// targets is the layer of the scrapers, including the discovered ones
+	targets *prometheus.Registry
+}
+
+// layer adds a registry which is gathered after the ones added before
+func (g *layeredGatherer) layer() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	g.layers = append(g.layers, reg)
+	return reg
+}
+
+// Gather implements prometheus.Gatherer
+func (g *layeredGatherer) Gather() ([]*dto.MetricFamily, error) {
+	familyNames.Reset()
+
+	var errs prometheus.MultiError
+	mfs := []*dto.MetricFamily{}
+	for _, reg := range append([]*prometheus.Registry{g.core}, g.layers...) {
+		gathered, err := reg.Gather()
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		added := make([]*dto.MetricFamily, 0, len(gathered))
+		for _, mf := range gathered {
+			if familyNames.Contains(mf.GetName()) {
+				log.Error("dropping metric %q, another collector reports it", mf.GetName())
+				continue
+			}
+			added = append(added, mf)
+		}
+		familyNames.Add(added)
+		mfs = append(mfs, added...)
+	}
+
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, errs.MaybeUnwrap()
+}
+
+// sinkState tracks when a sink should be written to next
+type sinkState struct {
+	// start is the time the last run was planned for
+	start time.Time
+	next  time.Time
+	busy  bool
+}
+
+// run gathers metrics whenever a sink is due and writes them to all due sinks
+// concurrently, so a slow or failing sink does not hold back the others. Each
+// sink is then scheduled according to its own throttler. Pipelines received
+// from reloads replace the current one between cycles and stop its target
+// discovery and plugins. The pipeline in use is returned once ctx is done and
+// all writes have finished
+func run(ctx context.Context, p pipeline, reloads <-chan pipeline) pipeline {
+	states := make([]sinkState, len(p.sinks))
+	done := make(chan int)
+	inflight := 0
+
+	schedule := func(i int) {
+		name := p.sinks[i].cfg.String()
+		selfMetrics.setWaitDuration(name, p.sinks[i].th.WaitDuration())
+		states[i].next = p.sched.next(states[i].start, time.Now(), p.sinks[i].th)
+		status.scheduled(name, states[i].next)
+	}
+
 	exec := func() {
+		now := time.Now()
+		due := []int{}
+		for i, st := range states {
+			if !st.busy && !now.Before(st.next) {
+				due = append(due, i)
+			}
+		}
+		if len(due) == 0 {
+			return
+		}
+
+		// the next run is planned from this one, not from when it finished
+		for _, i := range due {
+			states[i].start = states[i].next
+		}
+
 		start := time.Now()
-		mfs, err := g.Gather()
+		mfs, err := p.g.Gather()
+		d := time.Since(start)
+		selfMetrics.observeGather(d, err)
+		status.gathered(err)
 		if err != nil {
 			log.Error("failed to gather metrics: %v", err)
+			for _, i := range due {
+				schedule(i)
+			}
 			return
 		}
-		log.Info("stats collected in %s", time.Since(start))
+		log.Info("stats collected in %s", d)
+		pullView.gathered(mfs)
 
-		start = time.Now()
-		dec.Decorate(mfs)
-		log.Info("stats decorated in %s", time.Since(start))
+		for n, i := range due {
+			// the last sink can have the original, the others get a copy
+			fams := mfs
+			if n < len(due)-1 {
+				fams = copyFamilies(mfs)
+			}
 
-		err = w.Write(mfs)
-		if err != nil {
-			log.Error("failed to send metrics: %v", err)
-			return
+			states[i].busy = true
+			inflight++
+			go func(i int, s sink, mfs []*dto.MetricFamily) {
+				s.write(ctx, mfs)
+				done <- i
+			}(i, p.sinks[i], fams)
+		}
+	}
+
+	finish := func(i int) {
+		states[i].busy = false
+		schedule(i)
+		inflight--
+	}
+
+	wait := func() {
+		for inflight > 0 {
+			finish(<-done)
 		}
-		log.Info("stats written in %s", time.Since(start))
 	}
 
+	selfMetrics.track(p.sinks)
+	status.setPipeline(p)
+	pullView.set(p)
+	for i := range p.sinks {
+		schedule(i)
+	}
 	exec()
 
 	for {
 		select {
-		case <-time.After(th.WaitDuration()):
+		case <-time.After(nextRun(states)):
 			exec()
+		case i := <-done:
+			finish(i)
+		case next := <-reloads:
+			wait()
+			closeSinks(p.sinks, next.sinks)
+			p.discovery.stop()
+			p.plugins.stop()
+			p = next
+			states = make([]sinkState, len(p.sinks))
+			selfMetrics.track(p.sinks)
+			status.setPipeline(p)
+			pullView.set(p)
+			now := time.Now()
+			for i := range p.sinks {
+				states[i].start = now
+				schedule(i)
+			}
+			log.Info("configuration reloaded")
 		case <-ctx.Done():
-			return
+			wait()
+			return p
+		}
+	}
+}
+
+// nextRun returns the time until the next idle sink is due. Busy sinks are
+// picked up again once their write finishes
+func nextRun(states []sinkState) time.Duration {
+	wait := time.Duration(-1)
+	for _, st := range states {
+		if st.busy {
+			continue
+		}
+		d := time.Until(st.next)
+		if d < 0 {
+			d = 0
 		}
+		if wait < 0 || d < wait {
+			wait = d
+		}
+	}
+
+	if wait < 0 {
+		return time.Hour
 	}
+	return wait
 }
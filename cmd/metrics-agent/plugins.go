@@ -0,0 +1,103 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/collector"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultPluginConcurrency = 2
+
+// pluginRunner runs the exec plugins of a pipeline on their interval
+type pluginRunner struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startPlugins registers the exec plugins with reg and runs them until the
+// runner is stopped. It returns nil when no plugins are configured
+func startPlugins(ctx context.Context, reg prometheus.Registerer) (*pluginRunner, error) {
+	c, err := newExecCollector()
+	if err != nil || c == nil {
+		return nil, err
+	}
+	if err := reg.Register(c); err != nil {
+		return nil, errors.Wrap(err, "failed to register plugins")
+	}
+	log.Info("running %d plugins", len(config.plugins))
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &pluginRunner{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		c.Run(ctx)
+	}()
+	return r, nil
+}
+
+// runPluginsOnce registers the exec plugins with reg and waits for each of
+// them to run once
+func runPluginsOnce(reg prometheus.Registerer) error {
+	c, err := newExecCollector()
+	if err != nil || c == nil {
+		return err
+	}
+	if err := reg.Register(c); err != nil {
+		return errors.Wrap(err, "failed to register plugins")
+	}
+	c.RunOnce()
+	return nil
+}
+
+// stop kills the running plugins and waits for them to exit
+func (r *pluginRunner) stop() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
+
+// newExecCollector creates the collector of the configured plugins. It
+// returns nil when there are none
+func newExecCollector() (*collector.ExecCollector, error) {
+	if len(config.plugins) == 0 {
+		return nil, nil
+	}
+
+	plugins := make([]collector.Plugin, len(config.plugins))
+	for i, p := range config.plugins {
+		plugins[i] = collector.Plugin{
+			Name:     p.Name,
+			Command:  p.Command,
+			Format:   p.Format,
+			Interval: p.Interval,
+			Timeout:  p.Timeout,
+			Env:      p.Env,
+		}
+	}
+	c, err := collector.NewExecCollector(
+		collector.WithPlugins(plugins...),
+		collector.WithPluginConcurrency(config.pluginConcurrency),
+		collector.WithPluginFamilyNames(familyNames),
+	)
+	return c, errors.Wrap(err, "invalid plugins")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileConfigSetsPlugins(t *testing.T) {
+	explicitFlags = map[string]bool{}
+	defer func() {
+		config.plugins = nil
+		config.pluginConcurrency = 0
+	}()
+
+	path := writeConfigFile(t, `
+plugins:
+  max_concurrency: 4
+  exec:
+  - name: queue
+    command: ["/bin/sh", "-c", "echo queue_depth 3"]
+    format: prometheus
+    interval: 30s
+    timeout: 5s
+    env:
+      QUEUE: mail
+`)
+	defer os.Remove(path)
+
+	fc, err := readConfigFile(path)
+	require.NoError(t, err)
+	require.NoError(t, fc.apply())
+	assert.Equal(t, 4, config.pluginConcurrency)
+	assert.Equal(t, []pluginConfig{{
+		Name:     "queue",
+		Command:  []string{"/bin/sh", "-c", "echo queue_depth 3"},
+		Format:   "prometheus",
+		Interval: 30 * time.Second,
+		Timeout:  5 * time.Second,
+		Env:      map[string]string{"QUEUE": "mail"},
+	}}, config.plugins)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, runPluginsOnce(reg))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	names := []string{}
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	assert.Contains(t, names, "queue_depth")
+
+	config.plugins[0].Format = "xml"
+	_, err = newExecCollector()
+	assert.Error(t, err)
+}
+
+func TestStartPluginsWithoutPlugins(t *testing.T) {
+	r, err := startPlugins(context.Background(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	r.stop()
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/pkg/errors"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// watchReloads creates a new pipeline every time the agent receives SIGHUP
+// and sends it to the returned channel. The current pipeline is kept if the
+// new configuration is invalid
+func watchReloads(ctx context.Context, cur pipeline) <-chan pipeline {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	reloads := make(chan pipeline)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-sigs:
+			case <-ctx.Done():
+				return
+			}
+
+			log.Info("received SIGHUP, reloading configuration")
+			p, err := reload(ctx, cur)
+			if err != nil {
+				log.Error("failed to reload configuration, keeping the current one: %+v", err)
+				continue
+			}
+
+			select {
+			case reloads <- p:
+				cur = p
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return reloads
+}
+
+// reload reads the configuration again and creates a new pipeline from it.
+// Writers of the current pipeline are kept when their configuration did not
+// change so the sonar client does not lose its bootstrap state. The previous
+// configuration is restored on failure
+func reload(ctx context.Context, cur pipeline) (pipeline, error) {
+	prev := config
+	p, err := reloadPipeline(ctx, cur)
+	if err != nil {
+		config = prev
+		return pipeline{}, err
+	}
+
+	if config.adminListen != prev.adminListen || config.adminMetrics != prev.adminMetrics {
+		log.Error("admin server settings changed, they only take effect after a restart")
+	}
+	if statsdChanged(prev, config) {
+		log.Error("statsd settings changed, they only take effect after a restart")
+	}
+
+	changes := configChanges(prev, config)
+	if len(changes) == 0 {
+		log.Info("configuration did not change")
+	}
+	for _, change := range changes {
+		log.Info("configuration changed: %s", change)
+	}
+	return p, nil
+}
+
+func reloadPipeline(ctx context.Context, cur pipeline) (pipeline, error) {
+	prev := config
+	if err := reparseConfig(os.Args[1:]); err != nil {
+		return pipeline{}, err
+	}
+
+	if err := checkConfig(); err != nil {
+		return pipeline{}, err
+	}
+
+	return newPipeline(ctx, cur, !sonarChanged(prev, config))
+}
+
+// reparseConfig parses args and reads the config file again. Parsing resets
+// every flag with a default to its command line or default value so settings
+// removed from the config file do not linger. Repeatable flags only add to
+// their value and are emptied first
+func reparseConfig(args []string) error {
+	config.targetFlags = map[string]string{}
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		return errors.Wrap(err, "failed to parse command line")
+	}
+	return loadConfig(args)
+}
+
+// sonarChanged reports whether the sonar client needs to be recreated
+func sonarChanged(prev, cur agentConfig) bool {
+	return prev.debug != cur.debug ||
+		prev.sonarEndpoint != cur.sonarEndpoint ||
+		urlString(prev.authURL) != urlString(cur.authURL) ||
+		urlString(prev.metadataURL) != urlString(cur.metadataURL)
+}
+
+// configChanges describes every setting which differs between prev and cur
+func configChanges(prev, cur agentConfig) []string {
+	changes := []string{}
+	diff := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", name, a, b))
+		}
+	}
+
+	diff("stdout-only", prev.stdoutOnly, cur.stdoutOnly)
+	diff("debug", prev.debug, cur.debug)
+	diff("auth-host", urlString(prev.authURL), urlString(cur.authURL))
+	diff("metadata-host", urlString(prev.metadataURL), urlString(cur.metadataURL))
+	diff("sonar-host", prev.sonarEndpoint, cur.sonarEndpoint)
+	diff("decorators", prev.decorators, cur.decorators)
+	diff("writers", prev.writers, cur.writers)
+	diff("collectors", prev.collectors, cur.collectors)
+	diff("ignored mount points", prev.ignoredMountPoints, cur.ignoredMountPoints)
+	diff("ignored fs types", prev.ignoredFSTypes, cur.ignoredFSTypes)
+	diff("targets", prev.targets, cur.targets)
+	diff("process groups", prev.processGroups, cur.processGroups)
+	diff("top processes", prev.processTop, cur.processTop)
+	diff("cgroups", prev.cgroups, cur.cgroups)
+	diff("cgroups include", prev.cgroupsInclude, cur.cgroupsInclude)
+	diff("cgroups exclude", prev.cgroupsExclude, cur.cgroupsExclude)
+	diff("textfile directory", prev.textfileDir, cur.textfileDir)
+	diff("textfile max file size", prev.textfileMaxFileSize, cur.textfileMaxFileSize)
+	diff("textfile max series", prev.textfileMaxSeries, cur.textfileMaxSeries)
+	diff("textfile staleness", prev.textfileStaleness, cur.textfileStaleness)
+	diff("plugins", prev.plugins, cur.plugins)
+	diff("plugins max concurrency", prev.pluginConcurrency, cur.pluginConcurrency)
+	diff("scrape concurrency", prev.scrapeConcurrency, cur.scrapeConcurrency)
+	diff("file_sd directory", prev.fileSDDir, cur.fileSDDir)
+	diff("file_sd interval", prev.fileSDInterval, cur.fileSDInterval)
+	diff("file_sd debounce", prev.fileSDDebounce, cur.fileSDDebounce)
+	diff("schedule align", prev.scheduleAlign, cur.scheduleAlign)
+	diff("schedule jitter", prev.scheduleJitter, cur.scheduleJitter)
+	diff("admin listen address", prev.adminListen, cur.adminListen)
+	diff("admin metrics", prev.adminMetrics, cur.adminMetrics)
+	diff("statsd udp address", prev.statsdUDP, cur.statsdUDP)
+	diff("statsd tcp address", prev.statsdTCP, cur.statsdTCP)
+	diff("statsd max series", prev.statsdMaxSeries, cur.statsdMaxSeries)
+	diff("statsd mappings", prev.statsdMappings, cur.statsdMappings)
+	diff("statsd buckets", prev.statsdBuckets, cur.statsdBuckets)
+
+	return changes
+}
+
+func urlString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeWriter struct {
+	m      sync.Mutex
+	writes int
+}
+
+func (w *fakeWriter) Write(mets []*dto.MetricFamily) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.writes++
+	return nil
+}
+
+func (w *fakeWriter) count() int {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.writes
+}
+
+func (w *fakeWriter) Name() string { return "fake" }
+
+type fakeGatherer struct{}
+
+func (fakeGatherer) Gather() ([]*dto.MetricFamily, error) { return nil, nil }
+
+func TestRunSwapsReloadedPipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, second := new(fakeWriter), new(fakeWriter)
+	th := &constThrottler{wait: 5 * time.Millisecond}
+	reloads := make(chan pipeline)
+
+	done := make(chan struct{})
+	go func() {
+		run(ctx, pipeline{g: fakeGatherer{}, sinks: []sink{{w: first, th: th, dec: decorateNothing{}}}}, reloads)
+		close(done)
+	}()
+
+	for first.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// writes which were in flight during the reload may still land on first
+	reloads <- pipeline{g: fakeGatherer{}, sinks: []sink{{w: second, th: th, dec: decorateNothing{}}}}
+	time.Sleep(20 * time.Millisecond)
+	before := first.count()
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.True(t, before > 0)
+	assert.Equal(t, before, first.count())
+	assert.True(t, second.count() > 0)
+}
+
+func TestConfigChangesListsChangedSettings(t *testing.T) {
+	prev := agentConfig{decorators: []string{"compat.Names"}, sonarEndpoint: "a"}
+	cur := agentConfig{decorators: []string{"compat.Names"}, sonarEndpoint: "b"}
+
+	assert.Equal(t, []string{"sonar-host a -> b"}, configChanges(prev, cur))
+}
+
+func TestConfigChangesIsEmptyWhenUnchanged(t *testing.T) {
+	u, _ := url.Parse("https://sonar.digitalocean.com")
+	targets := func() map[string]targetConfig {
+		return map[string]targetConfig{"app": {Name: "app", URL: "http://localhost"}}
+	}
+	prev := agentConfig{authURL: u, targets: targets()}
+	cur := agentConfig{authURL: u, targets: targets()}
+
+	assert.Empty(t, configChanges(prev, cur))
+}
+
+func TestSonarChangedIgnoresOtherSettings(t *testing.T) {
+	prev := agentConfig{decorators: []string{"compat.Names"}}
+	cur := agentConfig{decorators: []string{"LowercaseNames"}}
+	assert.False(t, sonarChanged(prev, cur))
+
+	cur.sonarEndpoint = "https://sonar.example.com"
+	assert.True(t, sonarChanged(prev, cur))
+}
+
+type decorateNothing struct{}
+
+func (decorateNothing) Decorate([]*dto.MetricFamily) {}
+func (decorateNothing) Name() string                 { return "nothing" }
+
+func TestReparseConfigResetsRemovedSettings(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	path := writeConfigFile(t, `
+textfile:
+  directory: /var/lib/metrics-agent/textfile
+statsd:
+  udp_address: localhost:8125
+admin:
+  listen_address: localhost:9101
+`)
+	defer os.Remove(path)
+
+	args := []string{"--config.file", path, "--target", "app=http://localhost:8080"}
+	require.NoError(t, reparseConfig(args))
+	assert.Equal(t, "/var/lib/metrics-agent/textfile", config.textfileDir)
+	assert.Equal(t, "localhost:8125", config.statsdUDP)
+	assert.Equal(t, "localhost:9101", config.adminListen)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("debug: true\n"), 0644))
+	require.NoError(t, reparseConfig(args[:2]))
+	assert.Empty(t, config.textfileDir)
+	assert.Empty(t, config.statsdUDP)
+	assert.Empty(t, config.adminListen)
+	assert.Empty(t, config.targetFlags)
+	assert.NotContains(t, config.targets, "app")
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/clients/tsclient"
+)
+
+const (
+	defaultScheduleJitter = time.Minute
+	hostIDTimeout         = 2 * time.Second
+)
+
+// gate is implemented by throttlers which refuse writes until their wait
+// duration passed, like the sonar client. WaitInterval is the time they ask
+// for between writes
+type gate interface {
+	WaitInterval() time.Duration
+}
+
+// scheduler decides when a sink runs next. Runs are spaced from the time the
+// previous run was planned for, so time spent gathering and writing does not
+// add up. When aligned, runs happen on multiples of the interval shifted by
+// offset
+type scheduler struct {
+	align  bool
+	offset time.Duration
+}
+
+// newScheduler creates a scheduler from the configuration. The offset is
+// derived from the host so every host keeps its own slot within the interval
+func newScheduler() scheduler {
+	s := scheduler{align: config.scheduleAlign}
+	if s.align && config.scheduleJitter > 0 {
+		s.offset = jitterOffset(hostID(), config.scheduleJitter)
+	}
+	return s
+}
+
+// pace returns the interval between writes of th and how long it refuses
+// writes from now on
+func pace(th throttler) (interval, remaining time.Duration) {
+	if g, ok := th.(gate); ok {
+		return g.WaitInterval(), th.WaitDuration()
+	}
+	return th.WaitDuration(), 0
+}
+
+// next returns when a sink using th should run after a run planned for
+// start. A zero start means the sink did not run yet
+func (s scheduler) next(start, now time.Time, th throttler) time.Time {
+	interval, remaining := pace(th)
+
+	earliest := now.Add(remaining)
+	if !start.IsZero() && start.Add(interval).After(earliest) {
+		earliest = start.Add(interval)
+	}
+
+	if !s.align || interval <= 0 {
+		if earliest.Before(now) {
+			return now
+		}
+		return earliest
+	}
+
+	// a gated sink may have to wait briefly before writing, which is
+	// preferable to skipping a whole interval
+	t := s.nearest(earliest, interval)
+	if t.Before(now) {
+		t = s.ceil(now, interval)
+	}
+	return t
+}
+
+// floor returns the last boundary at or before t
+func (s scheduler) floor(t time.Time, interval time.Duration) time.Time {
+	d := (time.Duration(t.UnixNano()) - s.offset%interval) % interval
+	if d < 0 {
+		d += interval
+	}
+	return t.Add(-d)
+}
+
+// ceil returns the first boundary at or after t
+func (s scheduler) ceil(t time.Time, interval time.Duration) time.Time {
+	f := s.floor(t, interval)
+	if f.Equal(t) {
+		return f
+	}
+	return f.Add(interval)
+}
+
+// nearest returns the boundary closest to t
+func (s scheduler) nearest(t time.Time, interval time.Duration) time.Time {
+	f := s.floor(t, interval)
+	if t.Sub(f) >= interval/2 {
+		return f.Add(interval)
+	}
+	return f
+}
+
+// jitterOffset maps id to a deterministic offset in [0, jitter)
+func jitterOffset(id string, jitter time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
+
+var (
+	hostIDOnce sync.Once
+	cachedID   string
+)
+
+// hostID returns the droplet ID, or the hostname when the metadata service is
+// not available. It is only looked up once
+func hostID() string {
+	hostIDOnce.Do(func() {
+		c := tsclient.New(
+			tsclient.WithMetadataEndpoint(config.metadataURL.String()),
+			tsclient.WithTimeout(hostIDTimeout),
+		)
+		if hc, ok := c.(*tsclient.HTTPClient); ok {
+			id, err := hc.GetDropletID()
+			if err == nil && id != "" {
+				cachedID = id
+				return
+			}
+			log.Error("failed to get droplet ID for scheduling jitter, using the hostname: %v", err)
+		}
+
+		name, err := os.Hostname()
+		if err != nil {
+			log.Error("failed to get hostname for scheduling jitter: %v", err)
+		}
+		cachedID = name
+	})
+	return cachedID
+}
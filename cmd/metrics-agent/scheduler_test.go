@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedThrottler refuses writes for remaining and asks for interval between
+// writes, like the sonar client
+type gatedThrottler struct {
+	interval  time.Duration
+	remaining time.Duration
+}
+
+func (t gatedThrottler) WaitDuration() time.Duration { return t.remaining }
+func (t gatedThrottler) WaitInterval() time.Duration { return t.interval }
+func (t gatedThrottler) Name() string                { return "gated" }
+
+func at(sec float64) time.Time {
+	return time.Unix(0, 0).Add(time.Duration(sec * float64(time.Second)))
+}
+
+func TestSchedulerDoesNotDrift(t *testing.T) {
+	s := scheduler{}
+	th := &constThrottler{wait: 10 * time.Second}
+
+	// gathering and writing took 3s
+	assert.Equal(t, at(110), s.next(at(100), at(103), th))
+}
+
+func TestSchedulerSkipsMissedRuns(t *testing.T) {
+	s := scheduler{}
+	th := &constThrottler{wait: 10 * time.Second}
+
+	assert.Equal(t, at(125), s.next(at(100), at(125), th))
+}
+
+func TestSchedulerRunsImmediatelyAtFirst(t *testing.T) {
+	s := scheduler{}
+	assert.Equal(t, at(100), s.next(time.Time{}, at(100), &constThrottler{wait: 10 * time.Second}))
+}
+
+func TestAlignedSchedulerUsesOffsetBoundaries(t *testing.T) {
+	s := scheduler{align: true, offset: 3 * time.Second}
+	th := &constThrottler{wait: 10 * time.Second}
+
+	assert.Equal(t, at(113), s.next(time.Time{}, at(104.2), th))
+	assert.Equal(t, at(123), s.next(at(113), at(115), th))
+
+	// a run which took longer than the interval continues on the next boundary
+	assert.Equal(t, at(133), s.next(at(113), at(124), th))
+}
+
+func TestAlignedSchedulerKeepsGatedSinksOnTheirBoundary(t *testing.T) {
+	s := scheduler{align: true, offset: 7 * time.Second}
+
+	// the last write was 200ms after the run at 67s and the gate needs a
+	// full interval since then
+	th := gatedThrottler{interval: time.Minute, remaining: time.Minute - 300*time.Millisecond}
+	assert.Equal(t, at(127), s.next(at(67), at(67.1), th))
+}
+
+func TestAlignedSchedulerLargeOffsets(t *testing.T) {
+	s := scheduler{align: true, offset: 25 * time.Second}
+	th := &constThrottler{wait: 10 * time.Second}
+
+	// the offset wraps around the interval
+	assert.Equal(t, at(105), s.next(time.Time{}, at(101), th))
+}
+
+func TestJitterOffsetIsDeterministic(t *testing.T) {
+	jitter := time.Minute
+	a := jitterOffset("123456", jitter)
+	assert.Equal(t, a, jitterOffset("123456", jitter))
+	assert.NotEqual(t, a, jitterOffset("654321", jitter))
+
+	for _, id := range []string{"", "1", "2", "droplet", "987654321"} {
+		o := jitterOffset(id, jitter)
+		assert.True(t, o >= 0 && o < jitter, id)
+	}
+}
+
+func TestFileConfigSetsSchedule(t *testing.T) {
+	path := writeConfigFile(t, "schedule:\n  align: false\n  jitter: 15s\n")
+	defer os.Remove(path)
+
+	fc, err := readConfigFile(path)
+	require.NoError(t, err)
+	require.NoError(t, fc.apply())
+	defer func() {
+		setFlag("schedule.align", "true")
+		setFlag("schedule.jitter", defaultScheduleJitter.String())
+	}()
+
+	assert.False(t, config.scheduleAlign)
+	assert.Equal(t, 15*time.Second, config.scheduleJitter)
+}
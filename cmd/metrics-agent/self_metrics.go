@@ -0,0 +1,216 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// selfNamespace has to be sonar or the metrics will get filtered
+	selfNamespace = "sonar"
+	selfSubsystem = "agent"
+
+	stageGathered  = "gathered"
+	stageDecorated = "decorated"
+	stageWritten   = "written"
+)
+
+// selfMetrics describes the agent's own pipeline. It is registered with
+// every pipeline so the values observed in one cycle ship with the next
+var selfMetrics = newPipelineMetrics()
+
+// pipelineMetrics records durations, failures and series counts of every
+// stage of the pipeline
+type pipelineMetrics struct {
+	gatherDuration   prometheus.Histogram
+	gatherFailures   prometheus.Counter
+	decorateDuration *prometheus.HistogramVec
+	writeDuration    *prometheus.HistogramVec
+	writeFailures    *prometheus.CounterVec
+	series           *prometheus.GaugeVec
+	waitDuration     *prometheus.GaugeVec
+
+	sinceLastWriteDesc *prometheus.Desc
+
+	mu        sync.Mutex
+	lastWrite map[string]time.Time
+	now       func() time.Time
+}
+
+func newPipelineMetrics() *pipelineMetrics {
+	return &pipelineMetrics{
+		gatherDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "gather_duration_seconds",
+			Help:      "Time spent gathering metrics from all collectors.",
+		}),
+		gatherFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "gather_failures_total",
+			Help:      "Number of gathers which failed.",
+		}),
+		decorateDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "decorate_duration_seconds",
+			Help:      "Time spent decorating metrics for a writer.",
+		}, []string{"writer"}),
+		writeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "write_duration_seconds",
+			Help:      "Time spent writing metrics to a writer.",
+		}, []string{"writer"}),
+		writeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "write_failures_total",
+			Help:      "Number of writes which failed.",
+		}, []string{"writer"}),
+		series: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "series",
+			Help:      "Number of series handled by a writer in the last cycle, by stage.",
+		}, []string{"writer", "stage"}),
+		waitDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: selfNamespace,
+			Subsystem: selfSubsystem,
+			Name:      "wait_duration_seconds",
+			Help:      "Time a writer waits between writes as requested by its throttler.",
+		}, []string{"writer"}),
+		sinceLastWriteDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(selfNamespace, selfSubsystem, "seconds_since_last_write"),
+			"Seconds since the last successful write, or since the writer was created if it never succeeded.",
+			[]string{"writer"}, nil,
+		),
+		lastWrite: map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+func (m *pipelineMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.gatherDuration,
+		m.gatherFailures,
+		m.decorateDuration,
+		m.writeDuration,
+		m.writeFailures,
+		m.series,
+		m.waitDuration,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *pipelineMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+	ch <- m.sinceLastWriteDesc
+}
+
+// Collect implements prometheus.Collector
+func (m *pipelineMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for name, t := range m.lastWrite {
+		ch <- prometheus.MustNewConstMetric(m.sinceLastWriteDesc, prometheus.GaugeValue,
+			now.Sub(t).Seconds(), name)
+	}
+}
+
+// track starts tracking the given sinks and forgets every writer which is no
+// longer part of the pipeline
+func (m *pipelineMetrics) track(sinks []sink) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keep := map[string]bool{}
+	for _, s := range sinks {
+		name := s.cfg.String()
+		keep[name] = true
+		if _, ok := m.lastWrite[name]; !ok {
+			m.lastWrite[name] = m.now()
+		}
+		m.waitDuration.WithLabelValues(name).Set(s.th.WaitDuration().Seconds())
+	}
+
+	for name := range m.lastWrite {
+		if keep[name] {
+			continue
+		}
+		delete(m.lastWrite, name)
+		m.decorateDuration.DeleteLabelValues(name)
+		m.writeDuration.DeleteLabelValues(name)
+		m.writeFailures.DeleteLabelValues(name)
+		m.waitDuration.DeleteLabelValues(name)
+		for _, stage := range []string{stageGathered, stageDecorated, stageWritten} {
+			m.series.DeleteLabelValues(name, stage)
+		}
+	}
+}
+
+func (m *pipelineMetrics) observeGather(d time.Duration, err error) {
+	m.gatherDuration.Observe(d.Seconds())
+	if err != nil {
+		m.gatherFailures.Inc()
+	}
+}
+
+func (m *pipelineMetrics) observeDecorate(writer string, d time.Duration, gathered, decorated int) {
+	m.decorateDuration.WithLabelValues(writer).Observe(d.Seconds())
+	m.series.WithLabelValues(writer, stageGathered).Set(float64(gathered))
+	m.series.WithLabelValues(writer, stageDecorated).Set(float64(decorated))
+}
+
+func (m *pipelineMetrics) observeWrite(writer string, d time.Duration, written int, err error) {
+	m.writeDuration.WithLabelValues(writer).Observe(d.Seconds())
+	if err != nil {
+		m.writeFailures.WithLabelValues(writer).Inc()
+		m.series.WithLabelValues(writer, stageWritten).Set(0)
+		return
+	}
+	m.series.WithLabelValues(writer, stageWritten).Set(float64(written))
+
+	m.mu.Lock()
+	m.lastWrite[writer] = m.now()
+	m.mu.Unlock()
+}
+
+func (m *pipelineMetrics) setWaitDuration(writer string, d time.Duration) {
+	m.waitDuration.WithLabelValues(writer).Set(d.Seconds())
+}
+
+// countSeries returns the number of series in mfs
+func countSeries(mfs []*dto.MetricFamily) int {
+	n := 0
+	for _, mf := range mfs {
+		n += len(mf.Metric)
+	}
+	return n
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gatherSelfMetrics(t *testing.T, m *pipelineMetrics) map[string]*dto.MetricFamily {
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(m))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	byName := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+func TestPipelineMetricsRecordsStages(t *testing.T) {
+	m := newPipelineMetrics()
+	m.track([]sink{{cfg: writerConfig{Type: writerStdout}, th: &constThrottler{wait: 10 * time.Second}}})
+
+	m.observeGather(time.Second, nil)
+	m.observeGather(time.Second, errors.New("nope"))
+	m.observeDecorate("stdout", time.Millisecond, 10, 8)
+	m.observeWrite("stdout", time.Millisecond, 8, nil)
+	m.observeWrite("stdout", time.Millisecond, 8, errors.New("nope"))
+
+	mfs := gatherSelfMetrics(t, m)
+	assert.Equal(t, uint64(2), mfs["sonar_agent_gather_duration_seconds"].Metric[0].Histogram.GetSampleCount())
+	assert.Equal(t, 1.0, mfs["sonar_agent_gather_failures_total"].Metric[0].Counter.GetValue())
+	assert.Equal(t, uint64(2), mfs["sonar_agent_write_duration_seconds"].Metric[0].Histogram.GetSampleCount())
+	assert.Equal(t, 1.0, mfs["sonar_agent_write_failures_total"].Metric[0].Counter.GetValue())
+	assert.Equal(t, 10.0, mfs["sonar_agent_wait_duration_seconds"].Metric[0].Gauge.GetValue())
+
+	series := map[string]float64{}
+	for _, metric := range mfs["sonar_agent_series"].Metric {
+		for _, l := range metric.Label {
+			if l.GetName() == "stage" {
+				series[l.GetValue()] = metric.Gauge.GetValue()
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{stageGathered: 10, stageDecorated: 8, stageWritten: 0}, series)
+}
+
+func TestPipelineMetricsSecondsSinceLastWrite(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := newPipelineMetrics()
+	m.now = func() time.Time { return now }
+	m.track([]sink{{cfg: writerConfig{Type: writerStdout}, th: &constThrottler{}}})
+
+	now = now.Add(30 * time.Second)
+	since := gatherSelfMetrics(t, m)["sonar_agent_seconds_since_last_write"]
+	assert.Equal(t, 30.0, since.Metric[0].Gauge.GetValue())
+
+	m.observeWrite("stdout", time.Millisecond, 1, nil)
+	now = now.Add(5 * time.Second)
+	since = gatherSelfMetrics(t, m)["sonar_agent_seconds_since_last_write"]
+	assert.Equal(t, 5.0, since.Metric[0].Gauge.GetValue())
+}
+
+func TestPipelineMetricsForgetsRemovedWriters(t *testing.T) {
+	m := newPipelineMetrics()
+	m.track([]sink{{cfg: writerConfig{Type: writerStdout}, th: &constThrottler{}}})
+	m.observeWrite("stdout", time.Millisecond, 1, nil)
+
+	m.track([]sink{{cfg: writerConfig{Type: writerFile, Path: "/tmp/metrics"}, th: &constThrottler{}}})
+
+	mfs := gatherSelfMetrics(t, m)
+	assert.NotContains(t, mfs, "sonar_agent_write_duration_seconds")
+	require.Len(t, mfs["sonar_agent_seconds_since_last_write"].Metric, 1)
+	assert.Equal(t, "file /tmp/metrics", mfs["sonar_agent_seconds_since_last_write"].Metric[0].Label[0].GetValue())
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+)
+
+// exit codes used when shutting down. 1 is reserved for fatal errors
+const (
+	exitOK          = 0
+	exitFlushFailed = 2
+	exitTimeout     = 3
+)
+
+// flusher is implemented by writers which can send buffered metrics on demand
+type flusher interface {
+	Flush() error
+}
+
+// cancelOnShutdown calls cancel when the agent receives SIGTERM or SIGINT.
+// A second signal stops the agent immediately
+func cancelOnShutdown(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		log.Info("received %s, shutting down", sig)
+		cancel()
+	}()
+}
+
+// shutdown waits for the in-flight cycle to finish and the pipeline it used
+// to be sent on done, then attempts a final flush of every sink. Everything
+// must complete within timeout. The returned exit code describes the outcome
+func shutdown(done <-chan pipeline, timeout time.Duration) int {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var p pipeline
+	select {
+	case p = <-done:
+	case <-deadline.C:
+		log.Error("timed out after %s waiting for the current collection to finish", timeout)
+		return exitTimeout
+	}
+
+	errc := make(chan error, len(p.sinks))
+	pending := 0
+	for _, s := range p.sinks {
+		f, ok := s.w.(flusher)
+		if !ok {
+			continue
+		}
+
+		pending++
+		go func(s sink, f flusher) {
+			err := f.Flush()
+			if err != nil {
+				log.Error("final flush to %s failed: %+v", s.cfg, err)
+			} else {
+				log.Info("final flush to %s succeeded", s.cfg)
+			}
+			errc <- err
+		}(s, f)
+	}
+
+	code := exitOK
+	for ; pending > 0; pending-- {
+		select {
+		case err := <-errc:
+			if err != nil {
+				code = exitFlushFailed
+			}
+		case <-deadline.C:
+			log.Error("timed out after %s waiting for the final flush", timeout)
+			return exitTimeout
+		}
+	}
+	return code
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeFlushWriter struct {
+	fakeWriter
+	err     error
+	delay   time.Duration
+	flushed bool
+}
+
+func (w *fakeFlushWriter) Flush() error {
+	time.Sleep(w.delay)
+	w.flushed = true
+	return w.err
+}
+
+func TestShutdownFlushesWriter(t *testing.T) {
+	w := new(fakeFlushWriter)
+	done := make(chan pipeline, 1)
+	done <- pipeline{sinks: []sink{{w: w}}}
+
+	assert.Equal(t, exitOK, shutdown(done, time.Second))
+	assert.True(t, w.flushed)
+}
+
+func TestShutdownSkipsWritersWithoutFlush(t *testing.T) {
+	done := make(chan pipeline, 1)
+	done <- pipeline{sinks: []sink{{w: new(fakeWriter)}}}
+
+	assert.Equal(t, exitOK, shutdown(done, time.Second))
+}
+
+func TestShutdownReportsFailedFlush(t *testing.T) {
+	done := make(chan pipeline, 1)
+	done <- pipeline{sinks: []sink{
+		{w: new(fakeFlushWriter)},
+		{w: &fakeFlushWriter{err: errors.New("nope")}},
+	}}
+
+	assert.Equal(t, exitFlushFailed, shutdown(done, time.Second))
+}
+
+func TestShutdownTimesOutWaitingForCycle(t *testing.T) {
+	done := make(chan pipeline)
+
+	assert.Equal(t, exitTimeout, shutdown(done, 10*time.Millisecond))
+}
+
+func TestShutdownTimesOutWaitingForFlush(t *testing.T) {
+	done := make(chan pipeline, 1)
+	done <- pipeline{sinks: []sink{{w: &fakeFlushWriter{delay: time.Second}}}}
+
+	assert.Equal(t, exitTimeout, shutdown(done, 10*time.Millisecond))
+}
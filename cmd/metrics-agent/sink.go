@@ -0,0 +1,239 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/decorate"
+	"github.com/digitalocean/metrics-agent/pkg/writer"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	writerSonar  = "sonar"
+	writerStdout = "stdout"
+	writerFile   = "file"
+
+	defaultWriterInterval = 10 * time.Second
+)
+
+// sink is a writer with its own throttler and decorators
+type sink struct {
+	cfg    writerConfig
+	w      metricWriter
+	th     throttler
+	dec    decorate.Decorator
+	closer io.Closer
+}
+
+// String describes the sink for logging
+func (c writerConfig) String() string {
+	if c.Type == writerFile {
+		return fmt.Sprintf("%s %s", c.Type, c.Path)
+	}
+	return c.Type
+}
+
+// write decorates mfs and writes them to the sink. Sinks with a gate wait
+// until it accepts writes again unless ctx is done
+func (s sink) write(ctx context.Context, mfs []*dto.MetricFamily) {
+	name := s.cfg.String()
+	gathered := countSeries(mfs)
+
+	start := time.Now()
+	s.dec.Decorate(mfs)
+	d := time.Since(start)
+	decorated := countSeries(mfs)
+	selfMetrics.observeDecorate(name, d, gathered, decorated)
+	log.Info("stats decorated for %s in %s", s.cfg, d)
+
+	if _, ok := s.th.(gate); ok {
+		select {
+		case <-time.After(s.th.WaitDuration()):
+		case <-ctx.Done():
+		}
+	}
+
+	start = time.Now()
+	err := s.w.Write(mfs)
+	d = time.Since(start)
+	selfMetrics.observeWrite(name, d, decorated, err)
+	c, _ := s.th.(clientStatuser)
+	status.wrote(name, err, c)
+	if err != nil {
+		log.Error("failed to send metrics to %s: %v", s.cfg, err)
+		return
+	}
+	log.Info("stats written to %s in %s", s.cfg, d)
+}
+
+// checkWriters validates the configured writers
+func checkWriters() error {
+	if len(config.writers) == 0 {
+		return errors.New("at least one writer is required")
+	}
+
+	sonars := 0
+	paths := map[string]bool{}
+	for _, wc := range config.writers {
+		switch wc.Type {
+		case writerSonar:
+			sonars++
+			if wc.Interval != 0 {
+				return errors.New("the sonar writer does not support an interval, sonar decides how often to write")
+			}
+		case writerStdout:
+		case writerFile:
+			if wc.Path == "" {
+				return errors.New("file writers require a path")
+			}
+			if paths[wc.Path] {
+				return errors.Errorf("file %q is used by more than one writer", wc.Path)
+			}
+			paths[wc.Path] = true
+		default:
+			return errors.Errorf("unknown writer type %q, must be one of: %s, %s, %s",
+				wc.Type, writerSonar, writerStdout, writerFile)
+		}
+
+		if wc.Type != writerFile && wc.Path != "" {
+			return errors.Errorf("%s writers do not support a path", wc.Type)
+		}
+		if wc.Interval < 0 {
+			return errors.Errorf("interval for %s writer must not be negative", wc)
+		}
+		for _, name := range wc.Decorators {
+			if _, ok := findDecorator(name); !ok {
+				return errors.Errorf("unknown decorator %q for %s writer", name, wc)
+			}
+		}
+	}
+
+	if sonars > 1 {
+		return errors.New("only one sonar writer is supported")
+	}
+	return nil
+}
+
+// initSinks creates a sink for every configured writer. Writers of prev are
+// reused for sinks writing to the same destination so they keep their state.
+// The sonar writer is only reused if reuseSonar is true
+func initSinks(ctx context.Context, prev []sink, reuseSonar bool) ([]sink, error) {
+	sinks := []sink{}
+	for _, wc := range config.writers {
+		s, err := newSink(ctx, wc, prev, reuseSonar)
+		if err != nil {
+			closeSinks(sinks, prev)
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+func newSink(ctx context.Context, wc writerConfig, prev []sink, reuseSonar bool) (sink, error) {
+	s := sink{cfg: wc}
+
+	names := wc.Decorators
+	if names == nil {
+		names = config.decorators
+	}
+	dec, err := initDecorator(names)
+	if err != nil {
+		return sink{}, err
+	}
+	s.dec = dec
+
+	interval := wc.Interval
+	if interval == 0 {
+		interval = defaultWriterInterval
+	}
+
+	for _, p := range prev {
+		if p.cfg.Type != wc.Type || p.cfg.Path != wc.Path {
+			continue
+		}
+		if wc.Type == writerSonar {
+			if !reuseSonar {
+				break
+			}
+			s.w, s.th = p.w, p.th
+			return s, nil
+		}
+		s.w, s.closer = p.w, p.closer
+		s.th = &constThrottler{wait: interval}
+		return s, nil
+	}
+
+	switch wc.Type {
+	case writerSonar:
+		tsc, err := newTimeseriesClient(ctx)
+		if err != nil {
+			return sink{}, errors.Wrap(err, "failed to connect to sonar")
+		}
+		s.w, s.th = writer.NewSonar(tsc), tsc
+	case writerStdout:
+		s.w, s.th = writer.NewFile(os.Stdout), &constThrottler{wait: interval}
+	case writerFile:
+		f, err := os.OpenFile(wc.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return sink{}, errors.Wrapf(err, "failed to open %s", wc.Path)
+		}
+		s.w, s.th, s.closer = writer.NewFile(f), &constThrottler{wait: interval}, f
+	default:
+		return sink{}, errors.Errorf("unknown writer type %q", wc.Type)
+	}
+	return s, nil
+}
+
+// closeSinks closes every sink which is not also part of keep
+func closeSinks(sinks, keep []sink) {
+	for _, s := range sinks {
+		if s.closer == nil || hasCloser(keep, s.closer) {
+			continue
+		}
+		if err := s.closer.Close(); err != nil {
+			log.Error("failed to close %s writer: %+v", s.cfg, err)
+		}
+	}
+}
+
+func hasCloser(sinks []sink, c io.Closer) bool {
+	for _, s := range sinks {
+		if s.closer == c {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFamilies creates a deep copy of mfs so decorators of one sink do not
+// affect another
+func copyFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	c := make([]*dto.MetricFamily, len(mfs))
+	for i, mf := range mfs {
+		c[i] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return c
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowWriter blocks every write until release is closed
+type slowWriter struct {
+	fakeWriter
+	release chan struct{}
+}
+
+func (w *slowWriter) Write(mets []*dto.MetricFamily) error {
+	<-w.release
+	return w.fakeWriter.Write(mets)
+}
+
+type fixedGatherer []*dto.MetricFamily
+
+func (g fixedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return copyFamilies(g), nil
+}
+
+func TestRunDoesNotBlockOnSlowSinks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fast := new(fakeWriter)
+	slow := &slowWriter{release: make(chan struct{})}
+	th := &constThrottler{wait: 5 * time.Millisecond}
+	p := pipeline{g: fakeGatherer{}, sinks: []sink{
+		{w: slow, th: th, dec: decorateNothing{}},
+		{w: fast, th: th, dec: decorateNothing{}},
+	}}
+
+	done := make(chan pipeline)
+	go func() { done <- run(ctx, p, nil) }()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, fast.count() > 1)
+	assert.Equal(t, 0, slow.count())
+
+	cancel()
+	close(slow.release)
+	<-done
+	assert.Equal(t, 1, slow.count())
+}
+
+type recordingWriter struct {
+	fakeWriter
+	names chan string
+}
+
+func (w *recordingWriter) Write(mets []*dto.MetricFamily) error {
+	w.names <- mets[0].GetName()
+	return nil
+}
+
+type renameDecorator string
+
+func (d renameDecorator) Decorate(mfs []*dto.MetricFamily) {
+	for _, mf := range mfs {
+		name := string(d)
+		mf.Name = &name
+	}
+}
+
+func (d renameDecorator) Name() string { return "rename" }
+
+func TestRunDecoratesEverySinkSeparately(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	name := "original"
+	first := &recordingWriter{names: make(chan string, 1)}
+	second := &recordingWriter{names: make(chan string, 1)}
+	th := &constThrottler{wait: time.Hour}
+	p := pipeline{g: fixedGatherer{{Name: &name}}, sinks: []sink{
+		{w: first, th: th, dec: renameDecorator("first")},
+		{w: second, th: th, dec: decorateNothing{}},
+	}}
+
+	go run(ctx, p, nil)
+
+	assert.Equal(t, "first", <-first.names)
+	assert.Equal(t, "original", <-second.names)
+}
+
+func TestCheckWritersRejectsInvalidWriters(t *testing.T) {
+	defer func() { config.writers = nil }()
+
+	cases := map[string][]writerConfig{
+		"no writers":        {},
+		"unknown type":      {{Type: "carrier-pigeon"}},
+		"two sonars":        {{Type: writerSonar}, {Type: writerSonar}},
+		"sonar interval":    {{Type: writerSonar, Interval: time.Second}},
+		"file without path": {{Type: writerFile}},
+		"stdout with path":  {{Type: writerStdout, Path: "/tmp/metrics"}},
+		"duplicate paths":   {{Type: writerFile, Path: "/tmp/metrics"}, {Type: writerFile, Path: "/tmp/metrics"}},
+		"unknown decorator": {{Type: writerStdout, Decorators: []string{"nope"}}},
+	}
+
+	for name, writers := range cases {
+		t.Run(name, func(t *testing.T) {
+			config.writers = writers
+			assert.Error(t, checkWriters())
+		})
+	}
+}
+
+func TestCheckWritersAcceptsFanOut(t *testing.T) {
+	config.writers = []writerConfig{
+		{Type: writerSonar},
+		{Type: writerStdout, Interval: time.Second, Decorators: []string{"LowercaseNames"}},
+		{Type: writerFile, Path: "/tmp/metrics"},
+	}
+	defer func() { config.writers = nil }()
+
+	require.NoError(t, checkWriters())
+}
+
+func TestInitSinksReusesWritersWithSameDestination(t *testing.T) {
+	prev := []sink{{cfg: writerConfig{Type: writerStdout}, w: new(fakeWriter)}}
+	config.writers = []writerConfig{{Type: writerStdout, Interval: time.Second}}
+	defer func() { config.writers = nil }()
+
+	sinks, err := initSinks(context.Background(), prev, false)
+	require.NoError(t, err)
+	require.Len(t, sinks, 1)
+	assert.Equal(t, prev[0].w, sinks[0].w)
+	assert.Equal(t, time.Second, sinks[0].th.WaitDuration())
+}
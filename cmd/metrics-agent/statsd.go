@@ -0,0 +1,101 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/digitalocean/metrics-agent/pkg/collector"
+	"github.com/pkg/errors"
+)
+
+// statsdListener receives StatsD lines for the whole life of the agent and is
+// registered with a layer of the gatherer of every pipeline. It is nil unless
+// a StatsD address is configured
+var statsdListener *collector.StatsD
+
+// startStatsD starts listening for StatsD lines on the configured addresses.
+// It returns nil when none is configured
+func startStatsD() (*collector.StatsD, error) {
+	if config.statsdUDP == "" && config.statsdTCP == "" {
+		return nil, nil
+	}
+
+	mapper, err := newStatsDMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []collector.StatsDOptFn{
+		collector.WithStatsDUDPAddress(config.statsdUDP),
+		collector.WithStatsDTCPAddress(config.statsdTCP),
+		collector.WithStatsDMapper(mapper),
+		collector.WithStatsDMaxSeries(config.statsdMaxSeries),
+		collector.WithStatsDFamilyNames(familyNames),
+	}
+	if len(config.statsdBuckets) > 0 {
+		opts = append(opts, collector.WithStatsDBuckets(config.statsdBuckets))
+	}
+	s, err := collector.NewStatsD(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr := s.UDPAddr(); addr != nil {
+		log.Info("receiving statsd on udp %s", addr)
+	}
+	if addr := s.TCPAddr(); addr != nil {
+		log.Info("receiving statsd on tcp %s", addr)
+	}
+	return s, nil
+}
+
+// newStatsDMapper compiles the configured StatsD mappings
+func newStatsDMapper() (*collector.StatsDMapper, error) {
+	mappings := make([]collector.StatsDMapping, len(config.statsdMappings))
+	for i, m := range config.statsdMappings {
+		mappings[i] = collector.StatsDMapping{Match: m.Match, Name: m.Name, Labels: m.Labels}
+	}
+	mapper, err := collector.NewStatsDMapper(mappings...)
+	return mapper, errors.Wrap(err, "invalid statsd mapping")
+}
+
+// checkStatsD validates the StatsD settings without listening
+func checkStatsD() error {
+	if _, err := newStatsDMapper(); err != nil {
+		return err
+	}
+	if (config.statsdUDP != "" || config.statsdTCP != "") && config.statsdMaxSeries <= 0 {
+		return errors.New("statsd max series must be positive")
+	}
+	for i := 1; i < len(config.statsdBuckets); i++ {
+		if config.statsdBuckets[i] <= config.statsdBuckets[i-1] {
+			return errors.New("statsd buckets must be in increasing order")
+		}
+	}
+	return nil
+}
+
+// statsdChanged reports whether the StatsD listener would have to be
+// recreated to apply cur
+func statsdChanged(prev, cur agentConfig) bool {
+	return prev.statsdUDP != cur.statsdUDP ||
+		prev.statsdTCP != cur.statsdTCP ||
+		prev.statsdMaxSeries != cur.statsdMaxSeries ||
+		!reflect.DeepEqual(prev.statsdMappings, cur.statsdMappings) ||
+		!reflect.DeepEqual(prev.statsdBuckets, cur.statsdBuckets)
+}
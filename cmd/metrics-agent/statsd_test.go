@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/digitalocean/metrics-agent/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileConfigSetsStatsD(t *testing.T) {
+	explicitFlags = map[string]bool{}
+	defer func() {
+		config.statsdUDP = ""
+		config.statsdMaxSeries = collector.DefaultStatsDMaxSeries
+		config.statsdMappings = nil
+		config.statsdBuckets = nil
+	}()
+
+	path := writeConfigFile(t, `
+statsd:
+  udp_address: 127.0.0.1:0
+  max_series: 500
+  buckets: [0.01, 0.1, 1]
+  mappings:
+    - match: api.*.requests
+      name: api_requests_total
+      labels:
+        endpoint: $1
+`)
+	defer os.Remove(path)
+
+	fc, err := readConfigFile(path)
+	require.NoError(t, err)
+	require.NoError(t, fc.apply())
+	assert.Equal(t, "127.0.0.1:0", config.statsdUDP)
+	assert.Equal(t, 500, config.statsdMaxSeries)
+	assert.Equal(t, []float64{0.01, 0.1, 1}, config.statsdBuckets)
+	require.NoError(t, checkStatsD())
+
+	s, err := startStatsD()
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	defer s.Close()
+	assert.NotNil(t, s.UDPAddr())
+	assert.Nil(t, s.TCPAddr())
+
+	config.statsdMappings[0].Match = "api.*requests"
+	assert.Error(t, checkStatsD())
+}
+
+func TestStatsDChanged(t *testing.T) {
+	prev := agentConfig{statsdUDP: ":8125", statsdBuckets: []float64{1}}
+	cur := agentConfig{statsdUDP: ":8125", statsdBuckets: []float64{1}, sonarEndpoint: "a"}
+	assert.False(t, statsdChanged(prev, cur))
+
+	cur.statsdMappings = []statsdMappingConfig{{Match: "a.*", Name: "a"}}
+	assert.True(t, statsdChanged(prev, cur))
+}
+
+func TestLayeredGathererDropsTakenNames(t *testing.T) {
+	g := &layeredGatherer{core: prometheus.NewRegistry()}
+	g.core.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "up", Help: "Agent is up."}))
+	g.layer().MustRegister(
+		prometheus.NewCounter(prometheus.CounterOpts{Name: "up", Help: "Received over StatsD."}),
+		prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs", Help: "Received over StatsD."}),
+	)
+
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+	require.Len(t, mfs, 2)
+	assert.Equal(t, "jobs", mfs[0].GetName())
+	assert.Equal(t, "up", mfs[1].GetName())
+	assert.Equal(t, dto.MetricType_GAUGE, mfs[1].GetType())
+	assert.True(t, familyNames.Contains("jobs"))
+}
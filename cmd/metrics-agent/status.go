@@ -0,0 +1,199 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/pkg/clients/tsclient"
+)
+
+// status is the state of the running pipeline as reported by the admin server
+var status = newAgentStatus()
+
+// clientStatuser is implemented by throttlers backed by a tsclient
+type clientStatuser interface {
+	Status() tsclient.Status
+}
+
+// agentStatus tracks the outcome of the last gather and writes. It is
+// updated by the pipeline and read by the admin server
+type agentStatus struct {
+	mu         sync.Mutex
+	running    bool
+	collectors []string
+	gather     stageStatus
+	writers    []string
+	writes     map[string]*writerStatus
+	sonar      bool
+	client     tsclient.Status
+}
+
+type stageStatus struct {
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+type writerStatus struct {
+	stageStatus
+	NextRun time.Time `json:"next_run"`
+}
+
+func newAgentStatus() *agentStatus {
+	return &agentStatus{writes: map[string]*writerStatus{}}
+}
+
+func (s *stageStatus) record(t time.Time, err error) {
+	if err != nil {
+		s.LastError = err.Error()
+		s.LastErrorTime = &t
+		return
+	}
+	s.LastSuccess = &t
+}
+
+// setPipeline starts reporting on p. It must not be called while writes of
+// p are in flight
+func (s *agentStatus) setPipeline(p pipeline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running = true
+	s.collectors = p.collectors
+	s.writers = nil
+	s.sonar = false
+	writes := map[string]*writerStatus{}
+	for _, sk := range p.sinks {
+		name := sk.cfg.String()
+		s.writers = append(s.writers, name)
+		writes[name] = &writerStatus{}
+		if prev, ok := s.writes[name]; ok {
+			writes[name] = prev
+		}
+
+		if c, ok := sk.th.(clientStatuser); ok {
+			s.sonar = true
+			s.client = c.Status()
+		}
+	}
+	s.writes = writes
+}
+
+func (s *agentStatus) gathered(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gather.record(time.Now(), err)
+}
+
+// wrote records the outcome of a write to the named sink. c is the client of
+// the sink, if any, and is queried from the writing goroutine because
+// tsclient is not safe for concurrent use
+func (s *agentStatus) wrote(name string, err error, c clientStatuser) {
+	var cs tsclient.Status
+	if c != nil {
+		cs = c.Status()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ws, ok := s.writes[name]; ok {
+		ws.record(time.Now(), err)
+	}
+	if c != nil {
+		s.client = cs
+	}
+}
+
+func (s *agentStatus) scheduled(name string, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ws, ok := s.writes[name]; ok {
+		ws.NextRun = next
+	}
+}
+
+// ready reports whether the pipeline is running and, when writing to sonar,
+// the client bootstrapped against the metadata service
+func (s *agentStatus) ready() (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case !s.running:
+		return false, "pipeline is not running"
+	case s.sonar && !s.client.Bootstrapped:
+		return false, "sonar client has not bootstrapped against the metadata service"
+	}
+	return true, ""
+}
+
+// statusReport is the JSON document served on /status
+type statusReport struct {
+	Ready      bool            `json:"ready"`
+	Collectors []string        `json:"collectors"`
+	Gather     stageStatus     `json:"gather"`
+	Writers    []writerReport  `json:"writers"`
+	TSClient   *tsclientReport `json:"tsclient,omitempty"`
+	NextRun    *time.Time      `json:"next_run,omitempty"`
+}
+
+type writerReport struct {
+	Name string `json:"name"`
+	writerStatus
+}
+
+type tsclientReport struct {
+	Bootstrapped        bool `json:"bootstrapped"`
+	ConsecutiveFailures int  `json:"consecutive_failures"`
+	CircuitBreakerOpen  bool `json:"circuit_breaker_open"`
+}
+
+func (s *agentStatus) report() statusReport {
+	ready, _ := s.ready()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := statusReport{
+		Ready:      ready,
+		Collectors: s.collectors,
+		Gather:     s.gather,
+		Writers:    []writerReport{},
+	}
+	if r.Collectors == nil {
+		r.Collectors = []string{}
+	}
+
+	for _, name := range s.writers {
+		ws := *s.writes[name]
+		r.Writers = append(r.Writers, writerReport{Name: name, writerStatus: ws})
+		if !ws.NextRun.IsZero() && (r.NextRun == nil || ws.NextRun.Before(*r.NextRun)) {
+			next := ws.NextRun
+			r.NextRun = &next
+		}
+	}
+
+	if s.sonar {
+		r.TSClient = &tsclientReport{
+			Bootstrapped:        s.client.Bootstrapped,
+			ConsecutiveFailures: s.client.ConsecutiveFailures,
+			CircuitBreakerOpen:  s.client.CircuitBreakerOpen,
+		}
+	}
+	return r
+}
@@ -37,6 +37,11 @@ func InitSyslog() (err error) {
 	return nil
 }
 
+// InitStderr sends info messages to stderr so stdout is free for output
+func InitStderr() {
+	infolog.SetOutput(os.Stderr)
+}
+
 // Info prints a message to syslog with level LOG_NOTICE
 func Info(msg string, params ...interface{}) {
 	if err := infolog.Output(2, fmt.Sprintf(msg, params...)); err != nil {
@@ -16,6 +16,8 @@
 package clients
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"time"
@@ -28,19 +30,43 @@ type HTTPClient interface {
 
 // NewHTTP creates a new HTTP client with the provided timeout
 func NewHTTP(timeout time.Duration) *http.Client {
+	return NewHTTPWithTLS(timeout, nil)
+}
+
+// idleConnTimeout is how long an idle connection is kept open for the next
+// request. Every client talks to a single host, so it keeps one at most
+const idleConnTimeout = 5 * time.Minute
+
+// NewHTTPWithTLS creates a new HTTP client with the provided timeout which
+// uses cfg for TLS connections. A nil cfg uses the defaults
+func NewHTTPWithTLS(timeout time.Duration, cfg *tls.Config) *http.Client {
 	return &http.Client{
 		Timeout: timeout,
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
 				Timeout: timeout,
 			}).DialContext,
+			TLSClientConfig:       cfg,
 			TLSHandshakeTimeout:   timeout,
 			ResponseHeaderTimeout: timeout,
-			DisableKeepAlives:     true,
+			MaxIdleConnsPerHost:   1,
+			IdleConnTimeout:       idleConnTimeout,
 		},
 	}
 }
 
+// NewUnixHTTP creates a new HTTP client with the provided timeout which sends
+// every request to the unix socket at path regardless of the host of the
+// request
+func NewUnixHTTP(path string, timeout time.Duration) *http.Client {
+	c := NewHTTP(timeout)
+	dialer := &net.Dialer{Timeout: timeout}
+	c.Transport.(*http.Transport).DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	return c
+}
+
 // FakeHTTPClient is used for testing
 type FakeHTTPClient struct {
 	DoFunc func(*http.Request) (*http.Response, error)
@@ -38,6 +38,10 @@ const (
 
 	defaultWaitInterval = time.Second * 60
 	maxWaitInterval     = time.Hour
+
+	// circuitBreakerThreshold is the number of consecutive failures after
+	// which flushes are backed off
+	circuitBreakerThreshold = 3
 )
 
 // Client is an interface for sending batches of metrics
@@ -45,8 +49,23 @@ type Client interface {
 	AddMetric(def *Definition, value float64, labels ...string) error
 	AddMetricWithTime(def *Definition, t time.Time, value float64, labels ...string) error
 	Flush() error
+	ForceFlush() error
 	WaitDuration() time.Duration
+	WaitInterval() time.Duration
 	ResetWaitTimer()
+	Status() Status
+}
+
+// Status describes the connection state of a client
+type Status struct {
+	// Bootstrapped is true once the client authenticated against the
+	// metadata service
+	Bootstrapped bool
+	// ConsecutiveFailures is the number of flushes which failed in a row
+	ConsecutiveFailures int
+	// CircuitBreakerOpen is true while flushes are deliberately failed
+	// because of too many consecutive failures
+	CircuitBreakerOpen bool
 }
 
 // HTTPClient is used to send metrics via http
@@ -295,6 +314,12 @@ func (c *HTTPClient) WaitDuration() time.Duration {
 	return 0
 }
 
+// WaitInterval returns the time the server asked the client to wait between
+// batches of metrics
+func (c *HTTPClient) WaitInterval() time.Duration {
+	return c.waitInterval
+}
+
 // AddMetric adds a metric to the batch
 func (c *HTTPClient) AddMetric(def *Definition, value float64, labels ...string) error {
 	return c.addMetricWithMSEpochTime(def, 0, value, labels...)
@@ -355,15 +380,35 @@ func (c *HTTPClient) ResetWaitTimer() {
 	c.lastFlushAttempt = time.Now()
 }
 
+// Status returns the current connection state. It is not safe to call
+// concurrently with Flush
+func (c *HTTPClient) Status() Status {
+	return Status{
+		Bootstrapped:        !c.bootstrapRequired,
+		ConsecutiveFailures: c.numConsecutiveFailures,
+		CircuitBreakerOpen:  c.numConsecutiveFailures > circuitBreakerThreshold,
+	}
+}
+
 // Flush sends the batch of metrics to wharf
 func (c *HTTPClient) Flush() error {
 	now := time.Now()
 	if now.Sub(c.lastFlushAttempt) < c.waitInterval {
 		return ErrFlushTooFrequent
 	}
+	return c.flush(now)
+}
+
+// ForceFlush sends the batch of metrics to wharf even if the wait interval has
+// not passed yet. This should only be used for a final flush before exiting
+func (c *HTTPClient) ForceFlush() error {
+	return c.flush(time.Now())
+}
+
+func (c *HTTPClient) flush(now time.Time) error {
 	c.lastFlushAttempt = now
 
-	if c.numConsecutiveFailures > 3 {
+	if c.numConsecutiveFailures > circuitBreakerThreshold {
 		timeSinceLastConnection := now.Sub(c.lastFlushConnection)
 		requiredWait := time.Minute * time.Duration(c.numConsecutiveFailures+rand.Intn(3))
 		if requiredWait > maxWaitInterval {
@@ -0,0 +1,90 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tokenFile reads a bearer token from a file. The file is read again whenever
+// it changes so rotated tokens are picked up without a restart
+type tokenFile struct {
+	path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// get returns the current token
+func (f *tokenFile) get() (string, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read bearer token file")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.token != "" && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.token, nil
+	}
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read bearer token file")
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.Errorf("bearer token file %q is empty", f.path)
+	}
+
+	f.token, f.modTime, f.size = token, fi.ModTime(), fi.Size()
+	return token, nil
+}
+
+// checkAuth makes sure at most one way of authenticating is configured
+func checkAuth(o ScraperOpts) error {
+	n := 0
+	for _, set := range []bool{o.BearerToken != "", o.BearerTokenFile != "", o.Username != ""} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of bearer token, bearer token file and basic auth may be set")
+	}
+	if o.Password != "" && o.Username == "" {
+		return errors.New("basic auth password requires a username")
+	}
+	return nil
+}
+
+// cloneHeader returns a deep copy of h
+func cloneHeader(h http.Header) http.Header {
+	res := make(http.Header, len(h))
+	for k, v := range h {
+		res[k] = append([]string(nil), v...)
+	}
+	return res
+}
@@ -0,0 +1,189 @@
+package collector
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/pkg/clients"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authServer serves a single gauge to requests passing check
+func authServer(check func(r *http.Request) bool) *httptest.Server {
+	return httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !check(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("up 1\n"))
+	}))
+}
+
+// scrapeSucceeded scrapes s once and reports whether it succeeded
+func scrapeSucceeded(t *testing.T, s *Scraper) bool {
+	mfs := gatherScraper(t, s)
+	return mfs["up"].Metric[0].GetGauge().GetValue() == 1
+}
+
+func TestScraperBearerTokenFileRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	current := "first"
+	srv := authServer(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer "+current
+	})
+	srv.Start()
+	defer srv.Close()
+
+	path := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("first\n"), 0600))
+
+	s, err := NewScraper("app", srv.URL, time.Second, WithBearerTokenFile(path))
+	require.NoError(t, err)
+	assert.True(t, scrapeSucceeded(t, s))
+
+	current = "second-token"
+	require.NoError(t, ioutil.WriteFile(path, []byte("second-token\n"), 0600))
+	assert.True(t, scrapeSucceeded(t, s))
+	assert.Empty(t, s.req.Header.Get("Authorization"), "token leaked into the shared request")
+
+	require.NoError(t, os.Remove(path))
+	assert.False(t, scrapeSucceeded(t, s))
+}
+
+func TestScraperStaticAuth(t *testing.T) {
+	srv := authServer(func(r *http.Request) bool {
+		user, pass, ok := r.BasicAuth()
+		return (ok && user == "prom" && pass == "secret") ||
+			r.Header.Get("Authorization") == "Bearer static"
+	})
+	srv.Start()
+	defer srv.Close()
+
+	s, err := NewScraper("app", srv.URL, time.Second, WithBasicAuth("prom", "secret"))
+	require.NoError(t, err)
+	assert.True(t, scrapeSucceeded(t, s))
+
+	s, err = NewScraper("app", srv.URL, time.Second, WithBearerToken("static"))
+	require.NoError(t, err)
+	assert.True(t, scrapeSucceeded(t, s))
+
+	s, err = NewScraper("app", srv.URL, time.Second)
+	require.NoError(t, err)
+	assert.False(t, scrapeSucceeded(t, s))
+}
+
+func TestScraperRejectsConflictingAuth(t *testing.T) {
+	_, err := NewScraper("app", "http://localhost", time.Second,
+		WithBearerToken("a"), WithBasicAuth("user", "pass"))
+	assert.Error(t, err)
+
+	_, err = NewScraper("app", "http://localhost", time.Second, WithBasicAuth("", "pass"))
+	assert.Error(t, err)
+}
+
+// writeCert creates a self-signed certificate for localhost and writes it and
+// its key to dir
+func writeCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestScraperMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeCert(t, dir, "metrics.internal")
+	clientCert, clientKey := writeCert(t, dir, "agent")
+
+	clientPool := x509.NewCertPool()
+	pemBytes, err := ioutil.ReadFile(clientCert)
+	require.NoError(t, err)
+	require.True(t, clientPool.AppendCertsFromPEM(pemBytes))
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+
+	srv := authServer(func(r *http.Request) bool { return true })
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	mtls := clients.TLSConfig{
+		CAFile:     serverCert,
+		CertFile:   clientCert,
+		KeyFile:    clientKey,
+		ServerName: "metrics.internal",
+	}
+	s, err := NewScraper("app", srv.URL, time.Second, WithTLSConfig(mtls))
+	require.NoError(t, err)
+	assert.True(t, scrapeSucceeded(t, s))
+
+	// the certificate is not valid for 127.0.0.1
+	noName := mtls
+	noName.ServerName = ""
+	s, err = NewScraper("app", srv.URL, time.Second, WithTLSConfig(noName))
+	require.NoError(t, err)
+	assert.False(t, scrapeSucceeded(t, s))
+
+	insecure := noName
+	insecure.CAFile = ""
+	insecure.InsecureSkipVerify = true
+	s, err = NewScraper("app", srv.URL, time.Second, WithTLSConfig(insecure))
+	require.NoError(t, err)
+	assert.True(t, scrapeSucceeded(t, s))
+
+	noCert := mtls
+	noCert.CertFile, noCert.KeyFile = "", ""
+	s, err = NewScraper("app", srv.URL, time.Second, WithTLSConfig(noCert))
+	require.NoError(t, err)
+	assert.False(t, scrapeSucceeded(t, s))
+
+	keyOnly := mtls
+	keyOnly.CertFile = ""
+	_, err = NewScraper("app", srv.URL, time.Second, WithTLSConfig(keyOnly))
+	assert.Error(t, err)
+}
@@ -0,0 +1,524 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	cgroupNamespace   = "cgroup"
+	defaultCgroupRoot = "/sys/fs/cgroup"
+
+	// cgroupV1Unlimited is the smallest memory limit cgroup v1 reports for
+	// cgroups without a limit, which is the largest page aligned int64
+	cgroupV1Unlimited = 1 << 62
+)
+
+var (
+	cgroupCPUUsageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "cpu", "usage_seconds_total"),
+		"CPU time consumed by the cgroup, by mode. The total is reported with mode total.",
+		[]string{"cgroup", "mode"}, nil,
+	)
+	cgroupCPUPeriodsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "cpu", "periods_total"),
+		"Number of enforcement periods of the CPU quota of the cgroup.",
+		[]string{"cgroup"}, nil,
+	)
+	cgroupCPUThrottledPeriodsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "cpu", "throttled_periods_total"),
+		"Number of periods in which the cgroup was throttled.",
+		[]string{"cgroup"}, nil,
+	)
+	cgroupCPUThrottledDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "cpu", "throttled_seconds_total"),
+		"Time the cgroup was throttled for.",
+		[]string{"cgroup"}, nil,
+	)
+	cgroupMemoryUsageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "memory", "usage_bytes"),
+		"Memory used by the cgroup.",
+		[]string{"cgroup"}, nil,
+	)
+	cgroupMemoryLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "memory", "limit_bytes"),
+		"Memory limit of the cgroup. Not reported for cgroups without a limit.",
+		[]string{"cgroup"}, nil,
+	)
+	cgroupOOMEventsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "memory", "oom_events_total"),
+		"Number of times the cgroup hit its memory limit and the OOM killer was invoked. Only reported by cgroup v2.",
+		[]string{"cgroup"}, nil,
+	)
+	cgroupOOMKillsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "memory", "oom_kills_total"),
+		"Number of processes of the cgroup killed by the OOM killer.",
+		[]string{"cgroup"}, nil,
+	)
+	cgroupIOReadBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "blkio", "read_bytes_total"),
+		"Bytes the cgroup read from a block device.",
+		[]string{"cgroup", "device"}, nil,
+	)
+	cgroupIOWriteBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "blkio", "write_bytes_total"),
+		"Bytes the cgroup wrote to a block device.",
+		[]string{"cgroup", "device"}, nil,
+	)
+	cgroupIOReadsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "blkio", "reads_total"),
+		"Read operations of the cgroup on a block device.",
+		[]string{"cgroup", "device"}, nil,
+	)
+	cgroupIOWritesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(cgroupNamespace, "blkio", "writes_total"),
+		"Write operations of the cgroup on a block device.",
+		[]string{"cgroup", "device"}, nil,
+	)
+)
+
+// CgroupOpts configure which cgroups are reported
+type CgroupOpts struct {
+	Root string
+
+	// Include and Exclude are regular expressions matched against the path
+	// of a cgroup relative to the root, e.g. /system.slice/nginx.service. A
+	// cgroup is reported if it matches any of Include, or Include is empty,
+	// and matches none of Exclude
+	Include []string
+	Exclude []string
+}
+
+// CgroupOptFn allows for overriding options
+type CgroupOptFn func(*CgroupOpts)
+
+// WithCgroupRoot reads cgroups from path instead of /sys/fs/cgroup
+func WithCgroupRoot(path string) CgroupOptFn {
+	return func(o *CgroupOpts) {
+		o.Root = path
+	}
+}
+
+// WithCgroupInclude only reports cgroups whose path matches one of patterns
+func WithCgroupInclude(patterns ...string) CgroupOptFn {
+	return func(o *CgroupOpts) {
+		o.Include = append(o.Include, patterns...)
+	}
+}
+
+// WithCgroupExclude skips cgroups whose path matches one of patterns
+func WithCgroupExclude(patterns ...string) CgroupOptFn {
+	return func(o *CgroupOpts) {
+		o.Exclude = append(o.Exclude, patterns...)
+	}
+}
+
+// NewCgroupCollector creates a collector reporting the resource usage of
+// every cgroup. Both the v1 hierarchies and the unified v2 hierarchy are
+// supported
+func NewCgroupCollector(opts ...CgroupOptFn) (*CgroupCollector, error) {
+	o := CgroupOpts{Root: defaultCgroupRoot}
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	c := &CgroupCollector{opts: o}
+	var err error
+	if c.include, err = compilePatterns(o.Include); err != nil {
+		return nil, errors.Wrap(err, "invalid cgroup include pattern")
+	}
+	if c.exclude, err = compilePatterns(o.Exclude); err != nil {
+		return nil, errors.Wrap(err, "invalid cgroup exclude pattern")
+	}
+	return c, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+// CgroupCollector reports CPU, memory and block IO usage per cgroup
+type CgroupCollector struct {
+	opts    CgroupOpts
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// Describe implements prometheus.Collector
+func (c *CgroupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cgroupCPUUsageDesc
+	ch <- cgroupCPUPeriodsDesc
+	ch <- cgroupCPUThrottledPeriodsDesc
+	ch <- cgroupCPUThrottledDesc
+	ch <- cgroupMemoryUsageDesc
+	ch <- cgroupMemoryLimitDesc
+	ch <- cgroupOOMEventsDesc
+	ch <- cgroupOOMKillsDesc
+	ch <- cgroupIOReadBytesDesc
+	ch <- cgroupIOWriteBytesDesc
+	ch <- cgroupIOReadsDesc
+	ch <- cgroupIOWritesDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *CgroupCollector) Collect(ch chan<- prometheus.Metric) {
+	var err error
+	if isUnified(c.opts.Root) {
+		err = c.collectV2(ch)
+	} else {
+		err = c.collectV1(ch)
+	}
+	if err != nil {
+		log.Error("failed to collect cgroup metrics: %v", err)
+	}
+}
+
+// isUnified reports whether root is the cgroup v2 hierarchy
+func isUnified(root string) bool {
+	_, err := os.Stat(filepath.Join(root, "cgroup.controllers"))
+	return err == nil
+}
+
+// matches reports whether the cgroup at path should be reported. The root
+// cgroup is never reported, its usage is the one of the whole host
+func (c *CgroupCollector) matches(path string) bool {
+	if path == "/" {
+		return false
+	}
+	for _, re := range c.exclude {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, re := range c.include {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroups returns the directories of the matching cgroups below root by
+// their path relative to root
+func (c *CgroupCollector) cgroups(root string) (map[string]string, error) {
+	// hierarchies are often symlinks, e.g. cpu -> cpu,cpuacct
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]string{}
+	err = filepath.Walk(root, func(dir string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed while walking
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		path := "/" + filepath.ToSlash(rel)
+		if rel == "." {
+			path = "/"
+		}
+		// users may name the cgroups delegated to them freely, the registry
+		// panics on label values which are not valid UTF-8
+		if !utf8.ValidString(path) {
+			return filepath.SkipDir
+		}
+		if c.matches(path) {
+			res[path] = dir
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (c *CgroupCollector) collectV2(ch chan<- prometheus.Metric) error {
+	groups, err := c.cgroups(c.opts.Root)
+	if err != nil {
+		return errors.Wrap(err, "failed to read cgroup hierarchy")
+	}
+
+	for path, dir := range groups {
+		if stat, err := readKeyValues(filepath.Join(dir, "cpu.stat")); err == nil {
+			ch <- prometheus.MustNewConstMetric(cgroupCPUUsageDesc, prometheus.CounterValue, float64(stat["usage_usec"])/1e6, path, "total")
+			ch <- prometheus.MustNewConstMetric(cgroupCPUUsageDesc, prometheus.CounterValue, float64(stat["user_usec"])/1e6, path, "user")
+			ch <- prometheus.MustNewConstMetric(cgroupCPUUsageDesc, prometheus.CounterValue, float64(stat["system_usec"])/1e6, path, "system")
+			if periods, ok := stat["nr_periods"]; ok {
+				ch <- prometheus.MustNewConstMetric(cgroupCPUPeriodsDesc, prometheus.CounterValue, float64(periods), path)
+				ch <- prometheus.MustNewConstMetric(cgroupCPUThrottledPeriodsDesc, prometheus.CounterValue, float64(stat["nr_throttled"]), path)
+				ch <- prometheus.MustNewConstMetric(cgroupCPUThrottledDesc, prometheus.CounterValue, float64(stat["throttled_usec"])/1e6, path)
+			}
+		}
+
+		if usage, ok := readValue(filepath.Join(dir, "memory.current")); ok {
+			ch <- prometheus.MustNewConstMetric(cgroupMemoryUsageDesc, prometheus.GaugeValue, usage, path)
+		}
+		if limit, ok := readValue(filepath.Join(dir, "memory.max")); ok {
+			ch <- prometheus.MustNewConstMetric(cgroupMemoryLimitDesc, prometheus.GaugeValue, limit, path)
+		}
+		if events, err := readKeyValues(filepath.Join(dir, "memory.events")); err == nil {
+			ch <- prometheus.MustNewConstMetric(cgroupOOMEventsDesc, prometheus.CounterValue, float64(events["oom"]), path)
+			ch <- prometheus.MustNewConstMetric(cgroupOOMKillsDesc, prometheus.CounterValue, float64(events["oom_kill"]), path)
+		}
+
+		if io, err := readIOStatV2(filepath.Join(dir, "io.stat")); err == nil {
+			emitIO(ch, path, io)
+		}
+	}
+	return nil
+}
+
+func (c *CgroupCollector) collectV1(ch chan<- prometheus.Metric) error {
+	found := false
+	hierarchy := func(name string) map[string]string {
+		groups, err := c.cgroups(filepath.Join(c.opts.Root, name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Error("failed to read cgroup hierarchy %q: %v", name, err)
+			}
+			return nil
+		}
+		found = true
+		return groups
+	}
+
+	for path, dir := range hierarchy("cpuacct") {
+		if usage, ok := readValue(filepath.Join(dir, "cpuacct.usage")); ok {
+			ch <- prometheus.MustNewConstMetric(cgroupCPUUsageDesc, prometheus.CounterValue, usage/1e9, path, "total")
+		}
+		// user and system are in USER_HZ
+		if stat, err := readKeyValues(filepath.Join(dir, "cpuacct.stat")); err == nil {
+			ch <- prometheus.MustNewConstMetric(cgroupCPUUsageDesc, prometheus.CounterValue, float64(stat["user"])/userHZ, path, "user")
+			ch <- prometheus.MustNewConstMetric(cgroupCPUUsageDesc, prometheus.CounterValue, float64(stat["system"])/userHZ, path, "system")
+		}
+	}
+
+	for path, dir := range hierarchy("cpu") {
+		stat, err := readKeyValues(filepath.Join(dir, "cpu.stat"))
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(cgroupCPUPeriodsDesc, prometheus.CounterValue, float64(stat["nr_periods"]), path)
+		ch <- prometheus.MustNewConstMetric(cgroupCPUThrottledPeriodsDesc, prometheus.CounterValue, float64(stat["nr_throttled"]), path)
+		ch <- prometheus.MustNewConstMetric(cgroupCPUThrottledDesc, prometheus.CounterValue, float64(stat["throttled_time"])/1e9, path)
+	}
+
+	for path, dir := range hierarchy("memory") {
+		if usage, ok := readValue(filepath.Join(dir, "memory.usage_in_bytes")); ok {
+			ch <- prometheus.MustNewConstMetric(cgroupMemoryUsageDesc, prometheus.GaugeValue, usage, path)
+		}
+		if limit, ok := readValue(filepath.Join(dir, "memory.limit_in_bytes")); ok && limit < cgroupV1Unlimited {
+			ch <- prometheus.MustNewConstMetric(cgroupMemoryLimitDesc, prometheus.GaugeValue, limit, path)
+		}
+		// oom_kill is only reported since Linux 4.13
+		if ctl, err := readKeyValues(filepath.Join(dir, "memory.oom_control")); err == nil {
+			if kills, ok := ctl["oom_kill"]; ok {
+				ch <- prometheus.MustNewConstMetric(cgroupOOMKillsDesc, prometheus.CounterValue, float64(kills), path)
+			}
+		}
+	}
+
+	for path, dir := range hierarchy("blkio") {
+		io, err := readBlkioV1(filepath.Join(dir, "blkio.throttle.io_service_bytes"), filepath.Join(dir, "blkio.throttle.io_serviced"))
+		if err == nil {
+			emitIO(ch, path, io)
+		}
+	}
+
+	if !found {
+		return errors.Errorf("no cgroup hierarchy found in %q", c.opts.Root)
+	}
+	return nil
+}
+
+// deviceIO is the block IO of a cgroup on one device
+type deviceIO struct {
+	readBytes, writeBytes float64
+	reads, writes         float64
+}
+
+func emitIO(ch chan<- prometheus.Metric, path string, io map[string]*deviceIO) {
+	for dev, d := range io {
+		ch <- prometheus.MustNewConstMetric(cgroupIOReadBytesDesc, prometheus.CounterValue, d.readBytes, path, dev)
+		ch <- prometheus.MustNewConstMetric(cgroupIOWriteBytesDesc, prometheus.CounterValue, d.writeBytes, path, dev)
+		ch <- prometheus.MustNewConstMetric(cgroupIOReadsDesc, prometheus.CounterValue, d.reads, path, dev)
+		ch <- prometheus.MustNewConstMetric(cgroupIOWritesDesc, prometheus.CounterValue, d.writes, path, dev)
+	}
+}
+
+// readIOStatV2 parses io.stat, which has a line per device like
+// "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0"
+func readIOStatV2(path string) (map[string]*deviceIO, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := map[string]*deviceIO{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		d := &deviceIO{}
+		for _, kv := range fields[1:] {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			v, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value in %q", path)
+			}
+			switch parts[0] {
+			case "rbytes":
+				d.readBytes = v
+			case "wbytes":
+				d.writeBytes = v
+			case "rios":
+				d.reads = v
+			case "wios":
+				d.writes = v
+			}
+		}
+		res[fields[0]] = d
+	}
+	return res, scanner.Err()
+}
+
+// readBlkioV1 parses the blkio files of cgroup v1, which have a line per
+// device and operation like "8:0 Read 4096" and end with a total
+func readBlkioV1(bytesPath, opsPath string) (map[string]*deviceIO, error) {
+	res := map[string]*deviceIO{}
+	read := func(path string, set func(d *deviceIO, op string, v float64)) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 3 {
+				continue
+			}
+			v, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return errors.Wrapf(err, "invalid value in %q", path)
+			}
+			d := res[fields[0]]
+			if d == nil {
+				d = &deviceIO{}
+				res[fields[0]] = d
+			}
+			set(d, fields[1], v)
+		}
+		return scanner.Err()
+	}
+
+	err := read(bytesPath, func(d *deviceIO, op string, v float64) {
+		switch op {
+		case "Read":
+			d.readBytes = v
+		case "Write":
+			d.writeBytes = v
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = read(opsPath, func(d *deviceIO, op string, v float64) {
+		switch op {
+		case "Read":
+			d.reads = v
+		case "Write":
+			d.writes = v
+		}
+	})
+	return res, err
+}
+
+// readValue reads a file holding a single number. It returns false if the
+// file does not exist or holds "max", meaning there is no limit
+func readValue(path string) (float64, bool) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// readKeyValues reads a file with a "key value" pair on every line
+func readKeyValues(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for %q in %q", fields[0], path)
+		}
+		res[fields[0]] = v
+	}
+	return res, scanner.Err()
+}
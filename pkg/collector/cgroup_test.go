@@ -0,0 +1,154 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatherCgroups returns the value of every series by family name and its
+// label values, e.g. cgroup_memory_usage_bytes{/docker/abc123}
+func gatherCgroups(t *testing.T, c *CgroupCollector) map[string]float64 {
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(c))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	res := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			key := mf.GetName() + "{"
+			for i, l := range m.GetLabel() {
+				if i > 0 {
+					key += ","
+				}
+				key += l.GetValue()
+			}
+			res[key+"}"] = metricValue(m)
+		}
+	}
+	return res
+}
+
+func cgroupPaths(values map[string]float64, family string) []string {
+	seen := map[string]bool{}
+	for key := range values {
+		if len(key) > len(family) && key[:len(family)+1] == family+"{" {
+			seen[key[len(family)+1:len(key)-1]] = true
+		}
+	}
+	res := []string{}
+	for path := range seen {
+		res = append(res, path)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestCgroupCollectorV2(t *testing.T) {
+	c, err := NewCgroupCollector(WithCgroupRoot(filepath.Join("testdata", "cgroup", "v2")))
+	require.NoError(t, err)
+	values := gatherCgroups(t, c)
+
+	assert.Equal(t, 2.5, values["cgroup_cpu_usage_seconds_total{/system.slice/nginx.service,total}"])
+	assert.Equal(t, 2.0, values["cgroup_cpu_usage_seconds_total{/system.slice/nginx.service,user}"])
+	assert.Equal(t, 0.5, values["cgroup_cpu_usage_seconds_total{/system.slice/nginx.service,system}"])
+	assert.Equal(t, 100.0, values["cgroup_cpu_periods_total{/system.slice/nginx.service}"])
+	assert.Equal(t, 10.0, values["cgroup_cpu_throttled_periods_total{/system.slice/nginx.service}"])
+	assert.Equal(t, 1.5, values["cgroup_cpu_throttled_seconds_total{/system.slice/nginx.service}"])
+
+	assert.Equal(t, 52428800.0, values["cgroup_memory_usage_bytes{/system.slice/nginx.service}"])
+	assert.Equal(t, 104857600.0, values["cgroup_memory_limit_bytes{/system.slice/nginx.service}"])
+	assert.Equal(t, 2.0, values["cgroup_memory_oom_events_total{/system.slice/nginx.service}"])
+	assert.Equal(t, 1.0, values["cgroup_memory_oom_kills_total{/system.slice/nginx.service}"])
+
+	assert.Equal(t, 4096.0, values["cgroup_blkio_read_bytes_total{/system.slice/nginx.service,8:0}"])
+	assert.Equal(t, 8192.0, values["cgroup_blkio_write_bytes_total{/system.slice/nginx.service,8:0}"])
+	assert.Equal(t, 2.0, values["cgroup_blkio_writes_total{/system.slice/nginx.service,8:0}"])
+	assert.Equal(t, 1024.0, values["cgroup_blkio_read_bytes_total{/system.slice/nginx.service,253:0}"])
+
+	// no quota and no limit
+	assert.NotContains(t, values, "cgroup_cpu_periods_total{/system.slice/sshd.service}")
+	assert.Equal(t, []string{"/system.slice/nginx.service"}, cgroupPaths(values, "cgroup_memory_limit_bytes"))
+
+	// the root cgroup is the whole host
+	assert.Equal(t, []string{
+		"/system.slice,system",
+		"/system.slice,total",
+		"/system.slice,user",
+		"/system.slice/nginx.service,system",
+		"/system.slice/nginx.service,total",
+		"/system.slice/nginx.service,user",
+		"/system.slice/sshd.service,system",
+		"/system.slice/sshd.service,total",
+		"/system.slice/sshd.service,user",
+		"/user.slice/user-1000.slice/session-1.scope,system",
+		"/user.slice/user-1000.slice/session-1.scope,total",
+		"/user.slice/user-1000.slice/session-1.scope,user",
+	}, cgroupPaths(values, "cgroup_cpu_usage_seconds_total"))
+}
+
+func TestCgroupCollectorV1(t *testing.T) {
+	c, err := NewCgroupCollector(WithCgroupRoot(filepath.Join("testdata", "cgroup", "v1")))
+	require.NoError(t, err)
+	values := gatherCgroups(t, c)
+
+	assert.Equal(t, 4.5, values["cgroup_cpu_usage_seconds_total{/docker/abc123,total}"])
+	assert.Equal(t, 3.0, values["cgroup_cpu_usage_seconds_total{/docker/abc123,user}"])
+	assert.Equal(t, 1.2, values["cgroup_cpu_usage_seconds_total{/docker/abc123,system}"])
+	assert.Equal(t, 50.0, values["cgroup_cpu_periods_total{/docker/abc123}"])
+	assert.Equal(t, 5.0, values["cgroup_cpu_throttled_periods_total{/docker/abc123}"])
+	assert.Equal(t, 0.25, values["cgroup_cpu_throttled_seconds_total{/docker/abc123}"])
+
+	assert.Equal(t, 268435456.0, values["cgroup_memory_usage_bytes{/docker/abc123}"])
+	assert.Equal(t, 536870912.0, values["cgroup_memory_limit_bytes{/docker/abc123}"])
+	assert.Equal(t, 4.0, values["cgroup_memory_oom_kills_total{/docker/abc123}"])
+	assert.Equal(t, 2097152.0, values["cgroup_memory_usage_bytes{/system.slice/cron.service}"])
+	assert.NotContains(t, values, "cgroup_memory_limit_bytes{/system.slice/cron.service}")
+	assert.NotContains(t, values, "cgroup_memory_oom_kills_total{/system.slice/cron.service}")
+
+	assert.Equal(t, 65536.0, values["cgroup_blkio_read_bytes_total{/docker/abc123,8:0}"])
+	assert.Equal(t, 131072.0, values["cgroup_blkio_write_bytes_total{/docker/abc123,8:0}"])
+	assert.Equal(t, 16.0, values["cgroup_blkio_reads_total{/docker/abc123,8:0}"])
+	assert.Equal(t, 32.0, values["cgroup_blkio_writes_total{/docker/abc123,8:0}"])
+}
+
+func TestCgroupCollectorSkipsInvalidPaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory io\n"), 0644))
+	for _, dir := range []string{"ok", "x\xff", filepath.Join("x\xff", "child")} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, dir, "cpu.stat"), []byte("usage_usec 1000000\n"), 0644))
+	}
+
+	c, err := NewCgroupCollector(WithCgroupRoot(root))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/ok,system", "/ok,total", "/ok,user"},
+		cgroupPaths(gatherCgroups(t, c), "cgroup_cpu_usage_seconds_total"))
+}
+
+func TestCgroupCollectorFiltersPaths(t *testing.T) {
+	c, err := NewCgroupCollector(
+		WithCgroupRoot(filepath.Join("testdata", "cgroup", "v2")),
+		WithCgroupInclude(`^/system\.slice/.+\.service$`, `\.scope$`),
+		WithCgroupExclude(`sshd`),
+	)
+	require.NoError(t, err)
+	values := gatherCgroups(t, c)
+
+	assert.Contains(t, values, "cgroup_cpu_usage_seconds_total{/user.slice/user-1000.slice/session-1.scope,total}")
+	assert.NotContains(t, values, "cgroup_cpu_usage_seconds_total{/system.slice,total}")
+	assert.Equal(t, []string{"/system.slice/nginx.service"}, cgroupPaths(values, "cgroup_memory_usage_bytes"))
+
+	_, err = NewCgroupCollector(WithCgroupInclude("("))
+	assert.Error(t, err)
+}
@@ -0,0 +1,600 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	execNamespace = "exec_plugin"
+
+	// formats of the output of a plugin
+	FormatPrometheus = "prometheus"
+	FormatJSON       = "json"
+	FormatNagios     = "nagios"
+
+	// DefaultPluginInterval and DefaultPluginTimeout are used for plugins
+	// which do not set their own
+	DefaultPluginInterval = time.Minute
+	DefaultPluginTimeout  = 10 * time.Second
+
+	// DefaultPluginMaxOutputSize is the size of the output above which a run
+	// fails
+	DefaultPluginMaxOutputSize = 1 << 20
+
+	// defaultPluginPath is the only environment variable plugins inherit
+	defaultPluginPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	// pluginStderrSize is how much of stderr is logged when a run fails
+	pluginStderrSize = 4096
+)
+
+var (
+	execDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(execNamespace, "", "duration_seconds"),
+		"Time the last run of the plugin took.",
+		[]string{"plugin"}, nil,
+	)
+	execExitCodeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(execNamespace, "", "exit_code"),
+		"Exit code of the last run of the plugin, -1 if it could not be started or was killed.",
+		[]string{"plugin"}, nil,
+	)
+	execSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(execNamespace, "", "success"),
+		"Whether the output of the last run of the plugin was reported.",
+		[]string{"plugin"}, nil,
+	)
+	execLastRunDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(execNamespace, "", "last_run_timestamp_seconds"),
+		"Time the last run of the plugin finished.",
+		[]string{"plugin"}, nil,
+	)
+	execNagiosStatusDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(execNamespace, "", "nagios_status"),
+		"Status of a Nagios plugin: 0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN.",
+		[]string{"plugin"}, nil,
+	)
+	execPerfdataDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(execNamespace, "", "perfdata"),
+		"Performance data reported by a Nagios plugin, in the unit it was reported in.",
+		[]string{"plugin", "metric", "unit"}, nil,
+	)
+
+	// nagiosPerfdataRe matches a single 'label'=value[UOM][;warn;crit;min;max]
+	nagiosPerfdataRe = regexp.MustCompile(`^('[^']+'|[^'=\s]+)=([-+0-9.eE]+|U)([a-zA-Z%]*)`)
+)
+
+// Plugin is a command whose output is reported as metrics
+type Plugin struct {
+	Name    string
+	Command []string
+
+	// Format is how the output is parsed, one of prometheus, json or nagios
+	Format string
+
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// Env is the environment of the command. Only PATH is set otherwise
+	Env map[string]string
+}
+
+// ExecOpts configure the plugins run by a collector
+type ExecOpts struct {
+	Plugins []Plugin
+
+	// MaxConcurrency is the number of plugins running at once, 0 means no
+	// limit
+	MaxConcurrency int
+	MaxOutputSize  int64
+
+	// Names are the families gathered before the exec collector. The output
+	// of plugins reporting one of them is dropped
+	Names *FamilyNames
+}
+
+// ExecOptFn allows for overriding options
+type ExecOptFn func(*ExecOpts)
+
+// WithPlugins adds plugins to run
+func WithPlugins(plugins ...Plugin) ExecOptFn {
+	return func(o *ExecOpts) {
+		o.Plugins = append(o.Plugins, plugins...)
+	}
+}
+
+// WithPluginConcurrency limits the number of plugins running at once
+func WithPluginConcurrency(n int) ExecOptFn {
+	return func(o *ExecOpts) {
+		o.MaxConcurrency = n
+	}
+}
+
+// WithPluginMaxOutputSize fails runs which print more than n bytes
+func WithPluginMaxOutputSize(n int64) ExecOptFn {
+	return func(o *ExecOpts) {
+		o.MaxOutputSize = n
+	}
+}
+
+// WithPluginFamilyNames drops the output of plugins reporting families which
+// other collectors already reported
+func WithPluginFamilyNames(n *FamilyNames) ExecOptFn {
+	return func(o *ExecOpts) {
+		o.Names = n
+	}
+}
+
+// NewExecCollector creates a collector for plugins. They do not run until
+// Run or RunOnce is called
+func NewExecCollector(opts ...ExecOptFn) (*ExecCollector, error) {
+	o := ExecOpts{MaxOutputSize: DefaultPluginMaxOutputSize}
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	if o.MaxConcurrency < 0 {
+		return nil, errors.New("plugin concurrency must not be negative")
+	}
+	if o.MaxOutputSize <= 0 {
+		return nil, errors.New("plugin output size limit must be positive")
+	}
+
+	seen := map[string]bool{}
+	for i, p := range o.Plugins {
+		if p.Name == "" {
+			return nil, errors.Errorf("plugin %d has no name", i)
+		}
+		if seen[p.Name] {
+			return nil, errors.Errorf("plugin %q is defined more than once", p.Name)
+		}
+		seen[p.Name] = true
+
+		if len(p.Command) == 0 || p.Command[0] == "" {
+			return nil, errors.Errorf("plugin %q has no command", p.Name)
+		}
+		switch p.Format {
+		case FormatPrometheus, FormatJSON, FormatNagios:
+		default:
+			return nil, errors.Errorf("plugin %q has unknown format %q, must be one of: %s, %s, %s",
+				p.Name, p.Format, FormatPrometheus, FormatJSON, FormatNagios)
+		}
+
+		if p.Interval == 0 {
+			p.Interval = DefaultPluginInterval
+		}
+		if p.Timeout == 0 {
+			p.Timeout = DefaultPluginTimeout
+		}
+		if p.Interval < 0 || p.Timeout < 0 || p.Timeout > p.Interval {
+			return nil, errors.Errorf("plugin %q must have a positive timeout no longer than its interval", p.Name)
+		}
+		o.Plugins[i] = p
+	}
+
+	c := &ExecCollector{opts: o, results: map[string]execResult{}}
+	if o.MaxConcurrency > 0 {
+		c.sem = make(chan struct{}, o.MaxConcurrency)
+	}
+	return c, nil
+}
+
+// ExecCollector runs plugins on their own interval and reports the output of
+// their last run. A plugin which fails or conflicts with another one is
+// reported by exec_plugin_success without affecting the others
+type ExecCollector struct {
+	opts ExecOpts
+	sem  chan struct{}
+
+	mu      sync.Mutex
+	results map[string]execResult
+}
+
+// execResult is the outcome of the last run of a plugin
+type execResult struct {
+	duration time.Duration
+	exitCode int
+	finished time.Time
+	ok       bool
+
+	// families is the output of prometheus and json plugins
+	families map[string]*dto.MetricFamily
+
+	// status and perfdata are the output of nagios plugins
+	status   int
+	perfdata []nagiosPerfdata
+}
+
+type nagiosPerfdata struct {
+	metric string
+	unit   string
+	value  float64
+}
+
+// Run runs every plugin right away and then on its interval until ctx is
+// done
+func (c *ExecCollector) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range c.opts.Plugins {
+		wg.Add(1)
+		go func(p Plugin) {
+			defer wg.Done()
+			t := time.NewTicker(p.Interval)
+			defer t.Stop()
+			for {
+				c.run(ctx, p)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+// RunOnce runs every plugin and waits for them to finish
+func (c *ExecCollector) RunOnce() {
+	var wg sync.WaitGroup
+	for _, p := range c.opts.Plugins {
+		wg.Add(1)
+		go func(p Plugin) {
+			defer wg.Done()
+			c.run(context.Background(), p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// run runs p once a slot is free and stores its result
+func (c *ExecCollector) run(ctx context.Context, p Plugin) {
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	res := c.exec(ctx, p)
+	c.mu.Lock()
+	c.results[p.Name] = res
+	c.mu.Unlock()
+}
+
+// exec runs the command of p in its own process group so everything it
+// starts is killed once the timeout expires or ctx is done
+func (c *ExecCollector) exec(ctx context.Context, p Plugin) execResult {
+	res := execResult{exitCode: -1}
+	start := time.Now()
+	defer func() {
+		res.finished = time.Now()
+		res.duration = res.finished.Sub(start)
+	}()
+
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Dir = "/"
+	cmd.Env = pluginEnv(p.Env)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout := &cappedBuffer{limit: c.opts.MaxOutputSize}
+	stderr := &cappedBuffer{limit: pluginStderrSize}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		log.Error("failed to start plugin %q: %v", p.Name, err)
+		return res
+	}
+
+	var killed error
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		timer := time.NewTimer(p.Timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			killed = errors.Errorf("timed out after %s", p.Timeout)
+		case <-ctx.Done():
+			killed = errors.New("stopped")
+		case <-done:
+			return
+		}
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}()
+	err := cmd.Wait()
+	close(done)
+	<-exited
+
+	switch {
+	case killed != nil:
+		log.Error("plugin %q was killed: %v", p.Name, killed)
+		return res
+	case err == nil:
+		res.exitCode = 0
+	default:
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			log.Error("plugin %q failed: %v", p.Name, err)
+			return res
+		}
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			res.exitCode = status.ExitStatus()
+		}
+	}
+
+	if stdout.exceeded {
+		log.Error("plugin %q printed more than %d bytes", p.Name, c.opts.MaxOutputSize)
+		return res
+	}
+
+	if err := parsePluginOutput(p, stdout.Bytes(), &res); err != nil {
+		log.Error("plugin %q exited with %d: %v: %s", p.Name, res.exitCode, err,
+			strings.TrimSpace(stderr.String()))
+		return res
+	}
+	res.ok = true
+	return res
+}
+
+// pluginEnv returns the environment of a plugin, PATH unless env sets it
+// and env
+func pluginEnv(env map[string]string) []string {
+	res := []string{}
+	if _, ok := env["PATH"]; !ok {
+		res = append(res, "PATH="+defaultPluginPath)
+	}
+	for k, v := range env {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// parsePluginOutput parses out according to the format of p into res
+func parsePluginOutput(p Plugin, out []byte, res *execResult) error {
+	if p.Format == FormatNagios {
+		if res.exitCode < 0 || res.exitCode > 3 {
+			return errors.Errorf("invalid nagios exit code")
+		}
+		res.status = res.exitCode
+		res.perfdata = parseNagiosOutput(string(out))
+		return nil
+	}
+
+	if res.exitCode != 0 {
+		return errors.New("non-zero exit code")
+	}
+
+	var err error
+	if p.Format == FormatJSON {
+		res.families, err = parseJSONOutput(out)
+	} else {
+		res.families, err = new(expfmt.TextParser).TextToMetricFamilies(bytes.NewReader(out))
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to parse output")
+	}
+
+	// the plugin label tells apart the series of plugins reporting the same
+	// metrics
+	mfs := make([]*dto.MetricFamily, 0, len(res.families))
+	for _, mf := range res.families {
+		mfs = append(mfs, mf)
+	}
+	applyTargetLabels(mfs, []*dto.LabelPair{
+		{Name: proto.String("plugin"), Value: proto.String(p.Name)},
+	}, false)
+	return nil
+}
+
+// parseJSONOutput turns every number and boolean of a JSON object into a
+// gauge. Nested objects are flattened by joining the keys with underscores,
+// e.g. {"queue": {"depth": 3}} becomes queue_depth 3
+func parseJSONOutput(out []byte) (map[string]*dto.MetricFamily, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return nil, err
+	}
+
+	mfs := map[string]*dto.MetricFamily{}
+	var flatten func(prefix string, v interface{})
+	flatten = func(prefix string, v interface{}) {
+		var value float64
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, nested := range v {
+				flatten(prefix+"_"+k, nested)
+			}
+			return
+		case float64:
+			value = v
+		case bool:
+			value = boolValue(v)
+		default:
+			return
+		}
+
+		name := sanitizeMetricName(strings.TrimPrefix(prefix, "_"))
+		mfs[name] = &dto.MetricFamily{
+			Name:   proto.String(name),
+			Help:   proto.String("Value reported by a JSON plugin."),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(value)}}},
+		}
+	}
+	flatten("", doc)
+
+	for name := range mfs {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return nil, errors.Errorf("invalid metric name %q", name)
+		}
+	}
+	return mfs, nil
+}
+
+// parseNagiosOutput returns the performance data of Nagios plugin output:
+// everything after the first | of the first line, and everything after the
+// first | of the long output below it. Values which cannot be parsed and
+// labels which are not valid UTF-8 are skipped
+func parseNagiosOutput(out string) []nagiosPerfdata {
+	lines := strings.SplitN(out, "\n", 2)
+	perf := []string{}
+	if i := strings.Index(lines[0], "|"); i >= 0 {
+		perf = append(perf, lines[0][i+1:])
+	}
+	if len(lines) > 1 {
+		if i := strings.Index(lines[1], "|"); i >= 0 {
+			perf = append(perf, lines[1][i+1:])
+		}
+	}
+
+	seen := map[string]int{}
+	res := []nagiosPerfdata{}
+	rest := strings.TrimSpace(strings.Join(perf, " "))
+	for rest != "" {
+		match := nagiosPerfdataRe.FindStringSubmatch(rest)
+		if match == nil {
+			// skip to the next item
+			if i := strings.IndexAny(rest, " \t\n"); i >= 0 {
+				rest = strings.TrimSpace(rest[i:])
+				continue
+			}
+			break
+		}
+		rest = rest[len(match[0]):]
+		// the thresholds and range are not reported
+		if i := strings.IndexAny(rest, " \t\n"); i >= 0 {
+			rest = strings.TrimSpace(rest[i:])
+		} else {
+			rest = ""
+		}
+
+		value, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			continue
+		}
+		d := nagiosPerfdata{metric: strings.Trim(match[1], "'"), unit: match[3], value: value}
+		if !utf8.ValidString(d.metric) || !utf8.ValidString(d.unit) {
+			continue
+		}
+		if i, ok := seen[d.metric]; ok {
+			res[i] = d
+			continue
+		}
+		seen[d.metric] = len(res)
+		res = append(res, d)
+	}
+	return res
+}
+
+// Describe implements prometheus.Collector. Only the metrics about the
+// plugins are described, their output is not known in advance
+func (c *ExecCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- execDurationDesc
+	ch <- execExitCodeDesc
+	ch <- execSuccessDesc
+	ch <- execLastRunDesc
+	ch <- execNagiosStatusDesc
+	ch <- execPerfdataDesc
+}
+
+// Collect implements prometheus.Collector. Plugins which have not finished a
+// run yet are left out
+func (c *ExecCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	results := make(map[string]execResult, len(c.results))
+	for name, res := range c.results {
+		results[name] = res
+	}
+	c.mu.Unlock()
+
+	m := newFamilyMerger(execNamespace+"_", c.opts.Names)
+	for _, p := range c.opts.Plugins {
+		res, ok := results[p.Name]
+		if !ok {
+			continue
+		}
+
+		success := res.ok
+		if success && res.families != nil {
+			if err := m.add(res.families); err != nil {
+				log.Error("output of plugin %q is not reported: %v", p.Name, err)
+				success = false
+			}
+		}
+		if success && p.Format == FormatNagios {
+			ch <- prometheus.MustNewConstMetric(execNagiosStatusDesc, prometheus.GaugeValue, float64(res.status), p.Name)
+			for _, d := range res.perfdata {
+				ch <- prometheus.MustNewConstMetric(execPerfdataDesc, prometheus.GaugeValue, d.value, p.Name, d.metric, d.unit)
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(execDurationDesc, prometheus.GaugeValue, res.duration.Seconds(), p.Name)
+		ch <- prometheus.MustNewConstMetric(execExitCodeDesc, prometheus.GaugeValue, float64(res.exitCode), p.Name)
+		ch <- prometheus.MustNewConstMetric(execSuccessDesc, prometheus.GaugeValue, boolValue(success), p.Name)
+		ch <- prometheus.MustNewConstMetric(execLastRunDesc, prometheus.GaugeValue,
+			float64(res.finished.UnixNano())/1e9, p.Name)
+	}
+
+	for _, mf := range m.families() {
+		convertMetricFamily(mf, ch)
+	}
+}
+
+// cappedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a chatty plugin is not blocked on a full pipe
+type cappedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	exceeded bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - int64(b.Len())
+	if int64(len(p)) > room {
+		b.exceeded = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shellPlugin(name, format, script string) Plugin {
+	return Plugin{Name: name, Format: format, Command: []string{"/bin/sh", "-c", script}}
+}
+
+func gatherPlugins(t *testing.T, c *ExecCollector) map[string]*dto.MetricFamily {
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(c))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	res := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		res[mf.GetName()] = mf
+	}
+	return res
+}
+
+// pluginValues returns the value of an exec_plugin_* family by plugin
+func pluginValues(mf *dto.MetricFamily) map[string]float64 {
+	res := map[string]float64{}
+	for _, m := range mf.Metric {
+		res[labelValue(m, "plugin")] = m.GetGauge().GetValue()
+	}
+	return res
+}
+
+func TestExecCollectorFormats(t *testing.T) {
+	c, err := NewExecCollector(WithPlugins(
+		shellPlugin("rabbitmq", FormatPrometheus, `printf '# TYPE queue_depth gauge\nqueue_depth{queue="mail"} 12\n'`),
+		shellPlugin("redis", FormatPrometheus, `echo 'queue_depth{queue="mail"} 3'`),
+		shellPlugin("mysql", FormatJSON, `echo '{"replication": {"lag_seconds": 4.5, "running": true}, "version": "8.0"}'`),
+		shellPlugin("disk", FormatNagios, `echo "DISK WARNING - free space: / 3326 MB | '/ free'=3326MB;2000;1000;0;10000 inodes=85%"; echo "long output | time=0.5s;;"; exit 1`),
+	))
+	require.NoError(t, err)
+	c.RunOnce()
+	mfs := gatherPlugins(t, c)
+
+	// redis conflicts with the gauge of rabbitmq
+	depth := mfs["queue_depth"]
+	require.Len(t, depth.Metric, 1)
+	assert.Equal(t, "rabbitmq", labelValue(depth.Metric[0], "plugin"))
+	assert.Equal(t, 12.0, depth.Metric[0].GetGauge().GetValue())
+
+	assert.Equal(t, 4.5, mfs["replication_lag_seconds"].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, 1.0, mfs["replication_running"].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, "mysql", labelValue(mfs["replication_running"].Metric[0], "plugin"))
+	assert.NotContains(t, mfs, "version")
+
+	assert.Equal(t, map[string]float64{"disk": 1}, pluginValues(mfs["exec_plugin_nagios_status"]))
+	perfdata := map[string]float64{}
+	for _, m := range mfs["exec_plugin_perfdata"].Metric {
+		perfdata[labelValue(m, "metric")+" "+labelValue(m, "unit")] = m.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"/ free MB": 3326, "inodes %": 85, "time s": 0.5}, perfdata)
+
+	assert.Equal(t, map[string]float64{"rabbitmq": 1, "redis": 0, "mysql": 1, "disk": 1},
+		pluginValues(mfs["exec_plugin_success"]))
+	assert.Equal(t, map[string]float64{"rabbitmq": 0, "redis": 0, "mysql": 0, "disk": 1},
+		pluginValues(mfs["exec_plugin_exit_code"]))
+	assert.Len(t, mfs["exec_plugin_duration_seconds"].Metric, 4)
+}
+
+func TestExecCollectorFailures(t *testing.T) {
+	failing := shellPlugin("failing", FormatPrometheus, `echo 'jobs 1'; exit 2`)
+	slow := shellPlugin("slow", FormatPrometheus, `sleep 10 & wait`)
+	slow.Timeout = 100 * time.Millisecond
+	c, err := NewExecCollector(WithPluginMaxOutputSize(64), WithPlugins(
+		failing, slow,
+		shellPlugin("chatty", FormatPrometheus, `i=0; while [ $i -lt 100 ]; do echo "line $i"; i=$((i+1)); done`),
+		shellPlugin("missing", FormatJSON, `/does/not/exist`),
+		Plugin{Name: "unstartable", Format: FormatJSON, Command: []string{"/does/not/exist"}},
+	))
+	require.NoError(t, err)
+
+	start := time.Now()
+	c.RunOnce()
+	assert.True(t, time.Since(start) < 5*time.Second)
+	mfs := gatherPlugins(t, c)
+
+	assert.NotContains(t, mfs, "jobs")
+	assert.Equal(t, map[string]float64{"failing": 0, "slow": 0, "chatty": 0, "missing": 0, "unstartable": 0},
+		pluginValues(mfs["exec_plugin_success"]))
+	assert.Equal(t, map[string]float64{"failing": 2, "slow": -1, "chatty": 0, "missing": 127, "unstartable": -1},
+		pluginValues(mfs["exec_plugin_exit_code"]))
+}
+
+func TestExecCollectorDropsInvalidOutput(t *testing.T) {
+	names := NewFamilyNames()
+	names.Add([]*dto.MetricFamily{{Name: proto.String("node_load1")}})
+	c, err := NewExecCollector(WithPluginFamilyNames(names), WithPlugins(
+		shellPlugin("taken", FormatPrometheus, `echo 'node_load1 1'`),
+		shellPlugin("binary", FormatPrometheus, `printf 'jobs{queue="\377"} 1\n'`),
+		shellPlugin("check", FormatNagios, `printf "OK | '\377'=1 ok=2\n"`),
+	))
+	require.NoError(t, err)
+	c.RunOnce()
+	mfs := gatherPlugins(t, c)
+
+	assert.NotContains(t, mfs, "node_load1")
+	assert.NotContains(t, mfs, "jobs")
+	require.Len(t, mfs["exec_plugin_perfdata"].Metric, 1)
+	assert.Equal(t, "ok", labelValue(mfs["exec_plugin_perfdata"].Metric[0], "metric"))
+	assert.Equal(t, map[string]float64{"taken": 0, "binary": 0, "check": 1},
+		pluginValues(mfs["exec_plugin_success"]))
+}
+
+func TestExecCollectorRestrictsEnvironment(t *testing.T) {
+	os.Setenv("METRICS_AGENT_SECRET", "hunter2")
+	defer os.Unsetenv("METRICS_AGENT_SECRET")
+
+	p := shellPlugin("env", FormatPrometheus,
+		`[ -z "$METRICS_AGENT_SECRET" ] || echo leaked 1; echo "queue_depth $DEPTH"; [ -n "$PATH" ] && echo path_set 1`)
+	p.Env = map[string]string{"DEPTH": "7"}
+	c, err := NewExecCollector(WithPlugins(p))
+	require.NoError(t, err)
+	c.RunOnce()
+	mfs := gatherPlugins(t, c)
+
+	assert.NotContains(t, mfs, "leaked")
+	assert.Contains(t, mfs, "path_set")
+	assert.Equal(t, 7.0, mfs["queue_depth"].Metric[0].GetUntyped().GetValue())
+}
+
+func TestExecCollectorLimitsConcurrency(t *testing.T) {
+	plugins := []Plugin{}
+	for _, name := range []string{"a", "b", "c"} {
+		plugins = append(plugins, shellPlugin(name, FormatPrometheus, `sleep 0.1`))
+	}
+	c, err := NewExecCollector(WithPluginConcurrency(1), WithPlugins(plugins...))
+	require.NoError(t, err)
+
+	start := time.Now()
+	c.RunOnce()
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+}
+
+func TestNewExecCollectorRejectsInvalidPlugins(t *testing.T) {
+	valid := shellPlugin("ok", FormatJSON, "true")
+	invalid := [][]ExecOptFn{
+		{WithPluginConcurrency(-1)},
+		{WithPluginMaxOutputSize(0)},
+		{WithPlugins(Plugin{Format: FormatJSON, Command: []string{"true"}})},
+		{WithPlugins(Plugin{Name: "empty", Format: FormatJSON})},
+		{WithPlugins(Plugin{Name: "xml", Format: "xml", Command: []string{"true"}})},
+		{WithPlugins(valid, valid)},
+		{WithPlugins(Plugin{Name: "slow", Format: FormatJSON, Command: []string{"true"},
+			Interval: time.Second, Timeout: time.Minute})},
+	}
+	for i, opts := range invalid {
+		_, err := NewExecCollector(opts...)
+		assert.Error(t, err, "case %d", i)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// FamilyNames is the set of metric families gathered so far. Collectors of
+// families supplied by users, e.g. StatsD, skip the names in it since a
+// registry fails the whole gather when two collectors report a family with a
+// different type or help
+type FamilyNames struct {
+	mu    sync.RWMutex
+	names map[string]bool
+
+	// claims are the type, help and label names of the families claimed by
+	// the collectors gathered at the moment
+	claims map[string]string
+}
+
+// NewFamilyNames creates an empty set
+func NewFamilyNames() *FamilyNames {
+	return &FamilyNames{names: map[string]bool{}, claims: map[string]string{}}
+}
+
+// Reset empties the set before a gather
+func (n *FamilyNames) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.names = map[string]bool{}
+	n.claims = map[string]string{}
+}
+
+// Add adds the names of mfs once the collectors reporting them were gathered
+func (n *FamilyNames) Add(mfs []*dto.MetricFamily) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, mf := range mfs {
+		n.names[mf.GetName()] = true
+	}
+	n.claims = map[string]string{}
+}
+
+// Claim reports whether mf may be reported by collectors which are gathered
+// together, e.g. the scrapers of several targets. Its name must not have been
+// gathered before and the first claim of a name decides the type, help and
+// label names of the family. A nil set accepts every family
+func (n *FamilyNames) Claim(mf *dto.MetricFamily) bool {
+	if n == nil {
+		return true
+	}
+
+	sig := familySignature(mf)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.names[mf.GetName()] {
+		return false
+	}
+	if prev, ok := n.claims[mf.GetName()]; ok {
+		return prev == sig
+	}
+	n.claims[mf.GetName()] = sig
+	return true
+}
+
+// familySignature identifies the type, help and label names of mf, which
+// have to be the same for every metric of a family
+func familySignature(mf *dto.MetricFamily) string {
+	names := map[string]bool{}
+	for _, m := range mf.Metric {
+		for _, l := range m.GetLabel() {
+			names[l.GetName()] = true
+		}
+	}
+	sig := []string{mf.GetType().String(), mf.GetHelp()}
+	for name := range names {
+		sig = append(sig, name)
+	}
+	sort.Strings(sig[2:])
+	return strings.Join(sig, "\xff")
+}
+
+// Contains reports whether name was gathered. A nil set is empty
+func (n *FamilyNames) Contains(name string) bool {
+	if n == nil {
+		return false
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.names[name]
+}
+
+// familyMerger combines the families of several sources so the registry
+// accepts them: a family has one type and help and every series is unique.
+// Names starting with reserved are rejected so sources cannot clash with the
+// metrics about them, as are names in taken which other collectors report
+type familyMerger struct {
+	reserved string
+	taken    *FamilyNames
+	byName   map[string]*dto.MetricFamily
+	series   map[string]bool
+}
+
+func newFamilyMerger(reserved string, taken *FamilyNames) *familyMerger {
+	return &familyMerger{
+		reserved: reserved,
+		taken:    taken,
+		byName:   map[string]*dto.MetricFamily{},
+		series:   map[string]bool{},
+	}
+}
+
+// add merges parsed into the families added before. Nothing is added if any
+// family conflicts with them
+func (m *familyMerger) add(parsed map[string]*dto.MetricFamily) error {
+	added := map[string]bool{}
+	for name, mf := range parsed {
+		if strings.HasPrefix(name, m.reserved) {
+			return errors.Errorf("metric %q uses the reserved prefix %s", name, m.reserved)
+		}
+		if m.taken.Contains(name) {
+			return errors.Errorf("metric %q is reported by another collector", name)
+		}
+		if prev, ok := m.byName[name]; ok && prev.GetType() != mf.GetType() {
+			return errors.Errorf("metric %q is a %s elsewhere", name, prev.GetType())
+		}
+
+		for _, metric := range mf.Metric {
+			if metric.TimestampMs != nil {
+				return errors.Errorf("metric %q has a timestamp, which is not supported", name)
+			}
+
+			for _, l := range metric.GetLabel() {
+				if !utf8.ValidString(l.GetValue()) {
+					return errors.Errorf("metric %q has a label value which is not valid UTF-8", name)
+				}
+			}
+
+			sig := signature(name, nonEmptyLabels(metric.GetLabel()))
+			if m.series[sig] || added[sig] {
+				return errors.Errorf("metric %q has a series which was already reported", name)
+			}
+			added[sig] = true
+		}
+	}
+
+	for sig := range added {
+		m.series[sig] = true
+	}
+	for name, mf := range parsed {
+		if prev, ok := m.byName[name]; ok {
+			// the help of the first file wins
+			prev.Metric = append(prev.Metric, mf.Metric...)
+			continue
+		}
+		// copied so merging does not change the families of the source
+		m.byName[name] = &dto.MetricFamily{
+			Name:   mf.Name,
+			Help:   mf.Help,
+			Type:   mf.Type,
+			Metric: append([]*dto.Metric(nil), mf.Metric...),
+		}
+	}
+	return nil
+}
+
+// families returns the merged families by name
+func (m *familyMerger) families() []*dto.MetricFamily {
+	names := make([]string, 0, len(m.byName))
+	for name := range m.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make([]*dto.MetricFamily, len(names))
+	for i, name := range names {
+		res[i] = m.byName[name]
+	}
+	return res
+}
+
+// nonEmptyLabels drops labels with an empty value, they are the same as
+// missing ones
+func nonEmptyLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	res := make([]*dto.LabelPair, 0, len(labels))
+	for _, l := range labels {
+		if l.GetValue() != "" {
+			res = append(res, l)
+		}
+	}
+	return res
+}
@@ -0,0 +1,42 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFamilyNamesClaim(t *testing.T) {
+	family := func(name, help string, labels ...string) *dto.MetricFamily {
+		m := &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(1)}}
+		for _, l := range labels {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(l), Value: proto.String("x")})
+		}
+		return &dto.MetricFamily{
+			Name:   proto.String(name),
+			Help:   proto.String(help),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{m},
+		}
+	}
+
+	n := NewFamilyNames()
+	n.Add([]*dto.MetricFamily{family("node_load1", "Load.")})
+	assert.False(t, n.Claim(family("node_load1", "Load.")))
+
+	assert.True(t, n.Claim(family("requests_total", "A.", "job", "code")))
+	assert.True(t, n.Claim(family("requests_total", "A.", "code", "job")))
+	assert.False(t, n.Claim(family("requests_total", "B.", "job", "code")))
+	assert.False(t, n.Claim(family("requests_total", "A.", "job")))
+
+	// the claims end with the collectors gathered together
+	n.Add(nil)
+	assert.True(t, n.Claim(family("requests_total", "B.", "job", "code")))
+	n.Reset()
+	assert.True(t, n.Claim(family("node_load1", "Load.")))
+
+	var none *FamilyNames
+	assert.True(t, none.Claim(family("requests_total", "A.")))
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+const exportedPrefix = "exported_"
+
+// checkLabels makes sure the static labels of a target are valid label names
+// which are not reserved. Job and instance have options of their own
+func checkLabels(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return errors.Errorf("invalid target label name %q", name)
+		}
+		if name == model.JobLabel || name == model.InstanceLabel {
+			return errors.Errorf("target label %q must be set with its own option", name)
+		}
+	}
+	return nil
+}
+
+// targetLabels returns the labels attached to every series of a target
+func targetLabels(o ScraperOpts) []*dto.LabelPair {
+	all := map[string]string{}
+	for name, value := range o.Labels {
+		all[name] = value
+	}
+	all[model.JobLabel] = o.Job
+	all[model.InstanceLabel] = o.Instance
+
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make([]*dto.LabelPair, len(names))
+	for i, name := range names {
+		res[i] = &dto.LabelPair{Name: proto.String(name), Value: proto.String(all[name])}
+	}
+	return res
+}
+
+// applyTargetLabels attaches the target labels to every series of mfs. When a
+// series already has one of them, its own value wins if honor is set.
+// Otherwise its label is renamed with an exported_ prefix, the same way
+// Prometheus does
+func applyTargetLabels(mfs []*dto.MetricFamily, target []*dto.LabelPair, honor bool) {
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			m.Label = mergeLabels(m.Label, target, honor)
+		}
+	}
+}
+
+func mergeLabels(scraped, target []*dto.LabelPair, honor bool) []*dto.LabelPair {
+	exists := make(map[string]*dto.LabelPair, len(scraped)+len(target))
+	for _, l := range scraped {
+		exists[l.GetName()] = l
+	}
+
+	res := append(make([]*dto.LabelPair, 0, len(scraped)+len(target)), scraped...)
+	for _, t := range target {
+		l, ok := exists[t.GetName()]
+		if !ok {
+			res = append(res, t)
+			continue
+		}
+		if honor {
+			continue
+		}
+
+		name := exportedPrefix + t.GetName()
+		for exists[name] != nil {
+			name = exportedPrefix + name
+		}
+		renamed := &dto.LabelPair{Name: proto.String(name), Value: proto.String(l.GetValue())}
+		exists[name] = renamed
+		for i := range res {
+			if res[i] == l {
+				res[i] = renamed
+			}
+		}
+		res = append(res, t)
+	}
+	return res
+}
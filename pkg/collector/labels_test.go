@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func labelMap(labels []*dto.LabelPair) map[string]string {
+	res := map[string]string{}
+	for _, l := range labels {
+		res[l.GetName()] = l.GetValue()
+	}
+	return res
+}
+
+func pairs(kv ...string) []*dto.LabelPair {
+	res := []*dto.LabelPair{}
+	for i := 0; i < len(kv); i += 2 {
+		res = append(res, &dto.LabelPair{Name: proto.String(kv[i]), Value: proto.String(kv[i+1])})
+	}
+	return res
+}
+
+func TestMergeLabelsRenamesConflicts(t *testing.T) {
+	scraped := pairs("job", "worker", "exported_job", "old", "path", "/")
+	target := pairs("instance", "app:8080", "job", "app")
+
+	assert.Equal(t, map[string]string{
+		"job":                   "app",
+		"exported_job":          "old",
+		"exported_exported_job": "worker",
+		"instance":              "app:8080",
+		"path":                  "/",
+	}, labelMap(mergeLabels(scraped, target, false)))
+
+	assert.Equal(t, map[string]string{
+		"job":          "worker",
+		"exported_job": "old",
+		"instance":     "app:8080",
+		"path":         "/",
+	}, labelMap(mergeLabels(scraped, target, true)))
+}
+
+func TestCheckLabels(t *testing.T) {
+	assert.NoError(t, checkLabels(map[string]string{"env": "prod", "team": "storage"}))
+	for _, name := range []string{"job", "instance", "__name__", "bad-name", ""} {
+		assert.Error(t, checkLabels(map[string]string{name: "x"}), name)
+	}
+}
+
+func TestScraperAttachesTargetLabels(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# TYPE http_requests_total counter\nhttp_requests_total{code=\"200\",env=\"dev\"} 5\n"))
+	}))
+	defer srv.Close()
+
+	s, err := NewScraper("api", srv.URL, time.Second, WithLabels(map[string]string{"env": "prod"}))
+	require.NoError(t, err)
+	mfs := gatherScraper(t, s)
+	require.Contains(t, mfs, "http_requests_total")
+	assert.Equal(t, map[string]string{
+		"code":         "200",
+		"env":          "prod",
+		"exported_env": "dev",
+		"job":          "api",
+		"instance":     srv.Listener.Addr().String(),
+	}, labelMap(mfs["http_requests_total"].Metric[0].Label))
+
+	s, err = NewScraper("api", srv.URL, time.Second, WithJob("frontend"), WithInstance("web-1"),
+		WithLabels(map[string]string{"env": "prod"}), WithHonorLabels(true))
+	require.NoError(t, err)
+	mfs = gatherScraper(t, s)
+	assert.Equal(t, map[string]string{
+		"code":     "200",
+		"env":      "dev",
+		"job":      "frontend",
+		"instance": "web-1",
+	}, labelMap(mfs["http_requests_total"].Metric[0].Label))
+
+	_, err = NewScraper("api", srv.URL, time.Second, WithLabels(map[string]string{"job": "x"}))
+	assert.Error(t, err)
+}
+
+func TestScrapersOfTheSameFamilyDoNotCollide(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# TYPE http_requests_total counter\nhttp_requests_total 5\n"))
+	}))
+	defer srv.Close()
+
+	a, err := NewScraper("a", srv.URL, time.Second)
+	require.NoError(t, err)
+	b, err := NewScraper("b", srv.URL, time.Second)
+	require.NoError(t, err)
+
+	mfs := gatherScrapers(t, a, b)
+	assert.Len(t, mfs["http_requests_total"].Metric, 2)
+}
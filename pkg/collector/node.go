@@ -16,39 +16,159 @@
 package collector
 
 import (
+	"sync"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/node_exporter/collector"
 )
 
+const (
+	defaultBackoffThreshold = 3
+	defaultBaseBackoff      = time.Minute
+	defaultMaxBackoff       = 30 * time.Minute
+)
+
+var (
+	nodeScrapeDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("node", "scrape", "collector_duration_seconds"),
+		"node_exporter: Duration of a collector scrape.",
+		[]string{"collector"},
+		nil,
+	)
+	nodeScrapeSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("node", "scrape", "collector_success"),
+		"node_exporter: Whether a collector succeeded.",
+		[]string{"collector"},
+		nil,
+	)
+	nodeScrapeTimeoutsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("node", "scrape", "collector_timeouts_total"),
+		"node_exporter: Number of times a collector did not finish within its timeout.",
+		[]string{"collector"},
+		nil,
+	)
+	nodeScrapeBackoffDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("node", "scrape", "collector_backoff"),
+		"node_exporter: Whether a collector is skipped because it timed out repeatedly.",
+		[]string{"collector"},
+		nil,
+	)
+)
+
+// NodeOpts configure how the node_exporter collectors are run
+type NodeOpts struct {
+	Timeout          time.Duration
+	Timeouts         map[string]time.Duration
+	MaxConcurrency   int
+	BackoffThreshold int
+	BaseBackoff      time.Duration
+	MaxBackoff       time.Duration
+}
+
+// NodeOptFn allows for overriding options
+type NodeOptFn func(*NodeOpts)
+
+// WithTimeout sets the time every collector has to finish. Zero disables the
+// timeout
+func WithTimeout(d time.Duration) NodeOptFn {
+	return func(o *NodeOpts) {
+		o.Timeout = d
+	}
+}
+
+// WithCollectorTimeout overrides the timeout of the named collector
+func WithCollectorTimeout(name string, d time.Duration) NodeOptFn {
+	return func(o *NodeOpts) {
+		o.Timeouts[name] = d
+	}
+}
+
+// WithMaxConcurrency limits how many collectors run at once. Zero means no
+// limit
+func WithMaxConcurrency(n int) NodeOptFn {
+	return func(o *NodeOpts) {
+		o.MaxConcurrency = n
+	}
+}
+
+// WithBackoff skips a collector after threshold consecutive timeouts. It is
+// skipped for base, doubling with every further timeout up to max
+func WithBackoff(threshold int, base, max time.Duration) NodeOptFn {
+	return func(o *NodeOpts) {
+		o.BackoffThreshold = threshold
+		o.BaseBackoff = base
+		o.MaxBackoff = max
+	}
+}
+
 // NewNodeCollector creates a new prometheus NodeCollector
-func NewNodeCollector() (*NodeCollector, error) {
+func NewNodeCollector(opts ...NodeOptFn) (*NodeCollector, error) {
 	c, err := collector.NewNodeCollector()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create NodeCollector")
 	}
 
-	return &NodeCollector{
-		collectFunc:  c.Collect,
-		describeFunc: c.Describe,
-		collectorsFunc: func() map[string]collector.Collector {
-			return c.Collectors
-		},
-	}, nil
+	return newNodeCollector(c.Collectors, opts...), nil
+}
+
+func newNodeCollector(collectors map[string]collector.Collector, opts ...NodeOptFn) *NodeCollector {
+	o := &NodeOpts{
+		Timeouts:         map[string]time.Duration{},
+		BackoffThreshold: defaultBackoffThreshold,
+		BaseBackoff:      defaultBaseBackoff,
+		MaxBackoff:       defaultMaxBackoff,
+	}
+	for _, fn := range opts {
+		fn(o)
+	}
+
+	n := &NodeCollector{
+		collectors: collectors,
+		opts:       *o,
+		states:     map[string]*collectorState{},
+		now:        time.Now,
+	}
+	if o.MaxConcurrency > 0 {
+		n.sem = make(chan struct{}, o.MaxConcurrency)
+	}
+	for name := range collectors {
+		n.states[name] = &collectorState{}
+	}
+	return n
 }
 
 // NodeCollector is a collector that collects data using
-// prometheus/node_exporter. Since prometheus returns an internal type we have
-// to wrap it with our own type
+// prometheus/node_exporter. Every node_exporter collector runs with its own
+// timeout so a slow one does not hold back the others
 type NodeCollector struct {
-	collectFunc    func(ch chan<- prometheus.Metric)
-	describeFunc   func(ch chan<- *prometheus.Desc)
-	collectorsFunc func() map[string]collector.Collector
+	collectors map[string]collector.Collector
+	opts       NodeOpts
+	sem        chan struct{}
+	states     map[string]*collectorState
+	now        func() time.Time
+}
+
+// collectorState tracks timeouts of a single collector
+type collectorState struct {
+	mu           sync.Mutex
+	running      bool
+	timeouts     int
+	consecutive  int
+	backoffUntil time.Time
+}
+
+// update is the result of a collector run
+type update struct {
+	metrics []prometheus.Metric
+	err     error
 }
 
 // Collectors returns the list of collectors registered
 func (n *NodeCollector) Collectors() map[string]collector.Collector {
-	return n.collectorsFunc()
+	return n.collectors
 }
 
 // Name returns the name of this collector
@@ -56,12 +176,185 @@ func (n *NodeCollector) Name() string {
 	return "metrics-agent"
 }
 
+// Describe describes the metrics collected using prometheus/node_exporter
+func (n *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeScrapeDurationDesc
+	ch <- nodeScrapeSuccessDesc
+	ch <- nodeScrapeTimeoutsDesc
+	ch <- nodeScrapeBackoffDesc
+}
+
 // Collect collects metrics using prometheus/node_exporter
 func (n *NodeCollector) Collect(ch chan<- prometheus.Metric) {
-	n.collectFunc(ch)
+	wg := sync.WaitGroup{}
+	wg.Add(len(n.collectors))
+	for name, c := range n.collectors {
+		go func(name string, c collector.Collector) {
+			defer wg.Done()
+			n.execute(name, c, ch)
+		}(name, c)
+	}
+	wg.Wait()
 }
 
-// Describe describes the metrics collected using prometheus/node_exporter
-func (n *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
-	n.describeFunc(ch)
+func (n *NodeCollector) timeout(name string) time.Duration {
+	if d, ok := n.opts.Timeouts[name]; ok {
+		return d
+	}
+	return n.opts.Timeout
+}
+
+// execute runs a single collector and reports its metrics to ch if it
+// finishes in time. A collector which is backed off or still running from a
+// previous cycle is skipped
+func (n *NodeCollector) execute(name string, c collector.Collector, ch chan<- prometheus.Metric) {
+	st := n.states[name]
+	begin := n.now()
+
+	st.mu.Lock()
+	backoff := begin.Before(st.backoffUntil)
+	running := st.running
+	if !backoff && !running {
+		st.running = true
+	}
+	st.mu.Unlock()
+
+	var success float64
+	defer func() {
+		duration := n.now().Sub(begin).Seconds()
+		st.mu.Lock()
+		timeouts := float64(st.timeouts)
+		st.mu.Unlock()
+
+		var backedOff float64
+		if backoff {
+			backedOff = 1
+		}
+		ch <- prometheus.MustNewConstMetric(nodeScrapeDurationDesc, prometheus.GaugeValue, duration, name)
+		ch <- prometheus.MustNewConstMetric(nodeScrapeSuccessDesc, prometheus.GaugeValue, success, name)
+		ch <- prometheus.MustNewConstMetric(nodeScrapeTimeoutsDesc, prometheus.CounterValue, timeouts, name)
+		ch <- prometheus.MustNewConstMetric(nodeScrapeBackoffDesc, prometheus.GaugeValue, backedOff, name)
+	}()
+
+	switch {
+	case backoff:
+		return
+	case running:
+		log.Error("%s collector is still running from a previous collection, skipping it", name)
+		n.timedOut(name, st)
+		return
+	}
+
+	if !n.acquire(name) {
+		st.mu.Lock()
+		st.running = false
+		st.mu.Unlock()
+		log.Error("%s collector found no free slot within %s, skipping it", name, n.timeout(name))
+		return
+	}
+
+	// the timeout starts once the collector runs, waiting for a slot does not
+	// count against it
+	begin = n.now()
+	var deadline <-chan time.Time
+	if d := n.timeout(name); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	res := make(chan update, 1)
+	go func() {
+		res <- n.run(c)
+		n.release()
+		st.mu.Lock()
+		st.running = false
+		st.mu.Unlock()
+	}()
+
+	select {
+	case u := <-res:
+		st.mu.Lock()
+		st.consecutive = 0
+		st.mu.Unlock()
+
+		if u.err != nil {
+			log.Error("%s collector failed after %s: %v", name, n.now().Sub(begin), u.err)
+			return
+		}
+		for _, m := range u.metrics {
+			ch <- m
+		}
+		success = 1
+	case <-deadline:
+		log.Error("%s collector timed out after %s, skipping it", name, n.timeout(name))
+		n.timedOut(name, st)
+	}
+}
+
+// acquire waits for a free slot. A collector waits at most its timeout so
+// hung collectors holding every slot do not block the collection
+func (n *NodeCollector) acquire(name string) bool {
+	if n.sem == nil {
+		return true
+	}
+
+	var wait <-chan time.Time
+	if d := n.timeout(name); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		wait = t.C
+	}
+
+	select {
+	case n.sem <- struct{}{}:
+		return true
+	case <-wait:
+		return false
+	}
+}
+
+// release frees the slot taken by acquire
+func (n *NodeCollector) release() {
+	if n.sem != nil {
+		<-n.sem
+	}
+}
+
+// run runs c and buffers its metrics so a collector which times out does not
+// report anything
+func (n *NodeCollector) run(c collector.Collector) update {
+	mch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		metrics := []prometheus.Metric{}
+		for m := range mch {
+			metrics = append(metrics, m)
+		}
+		done <- metrics
+	}()
+
+	err := c.Update(mch)
+	close(mch)
+	return update{metrics: <-done, err: err}
+}
+
+// timedOut records a timeout and backs the collector off if it timed out too
+// often in a row
+func (n *NodeCollector) timedOut(name string, st *collectorState) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.timeouts++
+	st.consecutive++
+	if n.opts.BackoffThreshold <= 0 || st.consecutive < n.opts.BackoffThreshold {
+		return
+	}
+
+	backoff := n.opts.BaseBackoff << uint(st.consecutive-n.opts.BackoffThreshold)
+	if backoff > n.opts.MaxBackoff || backoff <= 0 {
+		backoff = n.opts.MaxBackoff
+	}
+	st.backoffUntil = n.now().Add(backoff)
+	log.Error("%s collector timed out %d times in a row, skipping it for %s", name, st.consecutive, backoff)
 }
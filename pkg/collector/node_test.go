@@ -0,0 +1,214 @@
+package collector
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/node_exporter/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testDesc = prometheus.NewDesc("test_value", "test value", []string{"collector"}, nil)
+
+// fakeCollector reports a single metric and takes delay to finish, failing
+// with err if set
+type fakeCollector struct {
+	name    string
+	delay   time.Duration
+	err     error
+	running int32
+	maxRun  int32
+	calls   int32
+}
+
+func (f *fakeCollector) Update(ch chan<- prometheus.Metric) error {
+	atomic.AddInt32(&f.calls, 1)
+	n := atomic.AddInt32(&f.running, 1)
+	defer atomic.AddInt32(&f.running, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxRun)
+		if n <= max || atomic.CompareAndSwapInt32(&f.maxRun, max, n) {
+			break
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(testDesc, prometheus.GaugeValue, 1, f.name)
+	time.Sleep(f.delay)
+	return f.err
+}
+
+// collect runs n once and returns the value of each metric by name and
+// collector label
+func collect(t *testing.T, n *NodeCollector) map[string]map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		n.Collect(ch)
+		close(ch)
+	}()
+
+	res := map[string]map[string]float64{}
+	for m := range ch {
+		pb := &dto.Metric{}
+		require.NoError(t, m.Write(pb))
+
+		name := m.Desc().String()
+		switch m.Desc() {
+		case testDesc:
+			name = "test_value"
+		case nodeScrapeSuccessDesc:
+			name = "success"
+		case nodeScrapeTimeoutsDesc:
+			name = "timeouts"
+		case nodeScrapeBackoffDesc:
+			name = "backoff"
+		case nodeScrapeDurationDesc:
+			name = "duration"
+		}
+
+		var label string
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "collector" {
+				label = l.GetValue()
+			}
+		}
+		if res[name] == nil {
+			res[name] = map[string]float64{}
+		}
+		switch {
+		case pb.Gauge != nil:
+			res[name][label] = pb.GetGauge().GetValue()
+		case pb.Counter != nil:
+			res[name][label] = pb.GetCounter().GetValue()
+		}
+	}
+	return res
+}
+
+func TestNodeCollectorSkipsSlowCollectors(t *testing.T) {
+	n := newNodeCollector(map[string]collector.Collector{
+		"fast":   &fakeCollector{name: "fast"},
+		"slow":   &fakeCollector{name: "slow", delay: 200 * time.Millisecond},
+		"broken": &fakeCollector{name: "broken", err: errors.New("boom")},
+	}, WithTimeout(50*time.Millisecond))
+
+	start := time.Now()
+	res := collect(t, n)
+	assert.True(t, time.Since(start) < 150*time.Millisecond, "collection waited for the slow collector")
+
+	assert.Equal(t, map[string]float64{"fast": 1}, res["test_value"])
+	assert.Equal(t, map[string]float64{"fast": 1, "slow": 0, "broken": 0}, res["success"])
+	assert.Equal(t, map[string]float64{"fast": 0, "slow": 1, "broken": 0}, res["timeouts"])
+}
+
+func TestNodeCollectorPerCollectorTimeout(t *testing.T) {
+	n := newNodeCollector(map[string]collector.Collector{
+		"slow": &fakeCollector{name: "slow", delay: 50 * time.Millisecond},
+	}, WithTimeout(10*time.Millisecond), WithCollectorTimeout("slow", time.Second))
+
+	res := collect(t, n)
+	assert.Equal(t, map[string]float64{"slow": 1}, res["success"])
+	assert.Equal(t, map[string]float64{"slow": 1}, res["test_value"])
+}
+
+func TestNodeCollectorLimitsConcurrency(t *testing.T) {
+	f := &fakeCollector{name: "a", delay: 10 * time.Millisecond}
+	cols := map[string]collector.Collector{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		cols[name] = f
+	}
+	n := newNodeCollector(cols, WithMaxConcurrency(2))
+
+	res := collect(t, n)
+	assert.Len(t, res["success"], 4)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.maxRun))
+}
+
+func TestNodeCollectorTimeoutExcludesWaitingForASlot(t *testing.T) {
+	f := &fakeCollector{name: "a", delay: 40 * time.Millisecond}
+	n := newNodeCollector(map[string]collector.Collector{"a": f, "b": f},
+		WithMaxConcurrency(1), WithTimeout(60*time.Millisecond))
+
+	res := collect(t, n)
+	assert.Equal(t, map[string]float64{"a": 1, "b": 1}, res["success"])
+	assert.Equal(t, map[string]float64{"a": 0, "b": 0}, res["timeouts"])
+	assert.EqualValues(t, 1, atomic.LoadInt32(&f.maxRun))
+}
+
+func TestNodeCollectorSkipsCollectorsWithoutASlot(t *testing.T) {
+	hung := &fakeCollector{name: "hung", delay: 200 * time.Millisecond}
+	n := newNodeCollector(map[string]collector.Collector{"hung": hung},
+		WithMaxConcurrency(1), WithTimeout(20*time.Millisecond))
+	collect(t, n)
+
+	// hung still holds the only slot
+	n.collectors["fast"] = &fakeCollector{name: "fast"}
+	n.states["fast"] = &collectorState{}
+	res := collect(t, n)
+	assert.Equal(t, 0.0, res["success"]["fast"])
+	assert.Equal(t, 0.0, res["timeouts"]["fast"])
+	assert.Equal(t, 0.0, res["backoff"]["fast"])
+}
+
+func TestNodeCollectorBacksOffRepeatOffenders(t *testing.T) {
+	slow := &fakeCollector{name: "slow", delay: 30 * time.Millisecond}
+	n := newNodeCollector(map[string]collector.Collector{"slow": slow},
+		WithTimeout(5*time.Millisecond), WithBackoff(2, time.Minute, 10*time.Minute))
+
+	var mu sync.Mutex
+	now := time.Now()
+	n.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	for i := 0; i < 2; i++ {
+		res := collect(t, n)
+		assert.Equal(t, map[string]float64{"slow": 0}, res["backoff"])
+		// let the timed out run finish so the next one starts
+		time.Sleep(40 * time.Millisecond)
+	}
+
+	res := collect(t, n)
+	assert.Equal(t, map[string]float64{"slow": 1}, res["backoff"])
+	assert.Equal(t, map[string]float64{"slow": 2}, res["timeouts"])
+	assert.EqualValues(t, 2, atomic.LoadInt32(&slow.calls))
+
+	mu.Lock()
+	now = now.Add(2 * time.Minute)
+	mu.Unlock()
+
+	collect(t, n)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&slow.calls))
+}
+
+func TestNodeCollectorDoesNotRestartHungCollectors(t *testing.T) {
+	hung := &fakeCollector{name: "hung", delay: 100 * time.Millisecond}
+	n := newNodeCollector(map[string]collector.Collector{"hung": hung},
+		WithTimeout(5*time.Millisecond))
+
+	collect(t, n)
+	res := collect(t, n)
+	assert.Equal(t, map[string]float64{"hung": 2}, res["timeouts"])
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hung.calls))
+}
+
+func TestBackoffGrowsUpToMax(t *testing.T) {
+	n := newNodeCollector(map[string]collector.Collector{},
+		WithBackoff(1, time.Minute, 3*time.Minute))
+	now := time.Now()
+	n.now = func() time.Time { return now }
+
+	st := &collectorState{}
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for _, d := range expected {
+		n.timedOut("x", st)
+		assert.Equal(t, now.Add(d), st.backoffUntil)
+	}
+}
@@ -0,0 +1,537 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// fmtOpenMetrics is the format of OpenMetrics text responses. expfmt does
+	// not know about it
+	fmtOpenMetrics expfmt.Format = "application/openmetrics-text"
+
+	openMetricsEOF = "# EOF"
+)
+
+// suffixes are the sample name suffixes allowed for each OpenMetrics type
+var suffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"gauge":          {""},
+	"unknown":        {""},
+	"info":           {"_info"},
+	"stateset":       {""},
+	"histogram":      {"_bucket", "_count", "_sum", "_created"},
+	"gaugehistogram": {"_bucket", "_gcount", "_gsum"},
+	"summary":        {"", "_count", "_sum", "_created"},
+}
+
+// responseFormat returns the format of a response, including OpenMetrics
+func responseFormat(h http.Header) expfmt.Format {
+	mediatype, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil && mediatype == string(fmtOpenMetrics) {
+		return fmtOpenMetrics
+	}
+	return expfmt.ResponseFormat(h)
+}
+
+// omFamily is the metadata of the OpenMetrics family being parsed
+type omFamily struct {
+	name string
+	help string
+	typ  string
+}
+
+// omSample is a single parsed sample line
+type omSample struct {
+	name      string
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp *int64
+	exemplar  *omExemplar
+}
+
+// omExemplar is the exemplar attached to a sample
+type omExemplar struct {
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp *int64
+}
+
+// openMetricsParser converts OpenMetrics families to the families of the
+// Prometheus data model. Counters keep their _total name, info and stateset
+// families become gauges and gauge histograms become gauges for their buckets,
+// count and sum since they are not monotonic. Exemplars and _created series
+// are dropped unless configured otherwise
+type openMetricsParser struct {
+	opts ScraperOpts
+
+	cur      *omFamily
+	families map[string]*dto.MetricFamily
+	metrics  map[string]*dto.Metric
+	order    []string
+}
+
+// parseOpenMetrics parses an OpenMetrics text exposition from r
+func parseOpenMetrics(r io.Reader, opts ScraperOpts) ([]*dto.MetricFamily, error) {
+	p := &openMetricsParser{
+		opts:     opts,
+		families: map[string]*dto.MetricFamily{},
+		metrics:  map[string]*dto.Metric{},
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum, eof := 0, false
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if eof {
+			return nil, errors.Errorf("line %d: unexpected data after %s", lineNum, openMetricsEOF)
+		}
+
+		var err error
+		switch {
+		case line == openMetricsEOF:
+			eof = true
+		case strings.HasPrefix(line, "#"):
+			err = p.parseComment(line)
+		case strings.TrimSpace(line) == "":
+			err = errors.New("empty lines are not allowed")
+		default:
+			err = p.parseSample(line)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read OpenMetrics payload")
+	}
+	if !eof {
+		return nil, errors.Errorf("payload does not end with %s, it may be truncated", openMetricsEOF)
+	}
+
+	mfs := make([]*dto.MetricFamily, 0, len(p.order))
+	for _, name := range p.order {
+		mfs = append(mfs, p.families[name])
+	}
+	return mfs, nil
+}
+
+// parseComment handles # HELP, # TYPE and # UNIT lines. Units are not part of
+// the Prometheus data model and are ignored
+func (p *openMetricsParser) parseComment(line string) error {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" {
+		return nil
+	}
+
+	keyword, name := fields[1], fields[2]
+	var text string
+	if len(fields) == 4 {
+		text = fields[3]
+	}
+
+	switch keyword {
+	case "HELP", "TYPE", "UNIT":
+	default:
+		return nil
+	}
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return errors.Errorf("invalid metric name %q", name)
+	}
+	if p.cur == nil || p.cur.name != name {
+		p.cur = &omFamily{name: name, typ: "unknown"}
+	}
+
+	switch keyword {
+	case "HELP":
+		p.cur.help = unescape(text)
+	case "TYPE":
+		if _, ok := suffixes[text]; !ok {
+			return errors.Errorf("unknown type %q for %q", text, name)
+		}
+		p.cur.typ = text
+	}
+	return nil
+}
+
+// familyOf returns the family a sample belongs to and the suffix of the sample
+// name. Samples without metadata start a new family of unknown type
+func (p *openMetricsParser) familyOf(name string) (*omFamily, string) {
+	if p.cur != nil {
+		for _, suffix := range suffixes[p.cur.typ] {
+			if name == p.cur.name+suffix {
+				return p.cur, suffix
+			}
+		}
+	}
+	p.cur = &omFamily{name: name, typ: "unknown"}
+	return p.cur, ""
+}
+
+func (p *openMetricsParser) parseSample(line string) error {
+	s, err := parseSampleLine(line)
+	if err != nil {
+		return err
+	}
+
+	fam, suffix := p.familyOf(s.name)
+	if suffix == "_created" {
+		if !p.opts.KeepCreated {
+			return nil
+		}
+		return p.gauge(s.name, fam.help, s)
+	}
+
+	var m *dto.Metric
+	switch fam.typ {
+	case "counter":
+		if s.value < 0 {
+			return errors.Errorf("counter %q is negative", s.name)
+		}
+		if m, err = p.metric(s.name, fam.help, dto.MetricType_COUNTER, s.labels); err != nil {
+			return err
+		}
+		m.Counter = &dto.Counter{Value: proto.Float64(s.value)}
+		m.TimestampMs = s.timestamp
+	case "gauge", "info", "stateset", "gaugehistogram":
+		// there is no gauge histogram in the Prometheus data model and a
+		// histogram would claim its counts only go up
+		err = p.gauge(s.name, fam.help, s)
+	case "unknown":
+		if m, err = p.metric(s.name, fam.help, dto.MetricType_UNTYPED, s.labels); err != nil {
+			return err
+		}
+		m.Untyped = &dto.Untyped{Value: proto.Float64(s.value)}
+		m.TimestampMs = s.timestamp
+	case "histogram":
+		err = p.histogram(fam, suffix, s)
+	case "summary":
+		err = p.summary(fam, suffix, s)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.exemplar != nil && p.opts.KeepExemplars {
+		return p.exemplar(fam, s)
+	}
+	return nil
+}
+
+func (p *openMetricsParser) gauge(name, help string, s omSample) error {
+	m, err := p.metric(name, help, dto.MetricType_GAUGE, s.labels)
+	if err != nil {
+		return err
+	}
+	m.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+	m.TimestampMs = s.timestamp
+	return nil
+}
+
+func (p *openMetricsParser) histogram(fam *omFamily, suffix string, s omSample) error {
+	labels, le := without(s.labels, model.BucketLabel)
+	m, err := p.metric(fam.name, fam.help, dto.MetricType_HISTOGRAM, labels)
+	if err != nil {
+		return err
+	}
+	if m.Histogram == nil {
+		m.Histogram = &dto.Histogram{}
+	}
+
+	switch suffix {
+	case "_bucket":
+		if le == nil {
+			return errors.Errorf("bucket of %q has no %s label", fam.name, model.BucketLabel)
+		}
+		bound, err := parseFloat(le.GetValue())
+		if err != nil {
+			return errors.Wrapf(err, "invalid bucket bound of %q", fam.name)
+		}
+		m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(bound),
+			CumulativeCount: proto.Uint64(uint64(s.value)),
+		})
+	case "_count":
+		m.Histogram.SampleCount = proto.Uint64(uint64(s.value))
+	case "_sum":
+		m.Histogram.SampleSum = proto.Float64(s.value)
+	}
+	return nil
+}
+
+func (p *openMetricsParser) summary(fam *omFamily, suffix string, s omSample) error {
+	labels, quantile := without(s.labels, model.QuantileLabel)
+	m, err := p.metric(fam.name, fam.help, dto.MetricType_SUMMARY, labels)
+	if err != nil {
+		return err
+	}
+	if m.Summary == nil {
+		m.Summary = &dto.Summary{}
+	}
+
+	switch suffix {
+	case "":
+		if quantile == nil {
+			return errors.Errorf("quantile of %q has no %s label", fam.name, model.QuantileLabel)
+		}
+		q, err := parseFloat(quantile.GetValue())
+		if err != nil {
+			return errors.Wrapf(err, "invalid quantile of %q", fam.name)
+		}
+		m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{
+			Quantile: proto.Float64(q),
+			Value:    proto.Float64(s.value),
+		})
+	case "_count":
+		m.Summary.SampleCount = proto.Uint64(uint64(s.value))
+	case "_sum":
+		m.Summary.SampleSum = proto.Float64(s.value)
+	}
+	return nil
+}
+
+// exemplar keeps the value of the exemplar of s as a gauge named after the
+// sample with an _exemplar suffix. The labels of the exemplar, e.g. trace_id,
+// are dropped since every new value would create a new series
+func (p *openMetricsParser) exemplar(fam *omFamily, s omSample) error {
+	return p.gauge(s.name+"_exemplar", "Exemplars of "+fam.name, omSample{
+		labels:    s.labels,
+		value:     s.exemplar.value,
+		timestamp: s.exemplar.timestamp,
+	})
+}
+
+// metric returns the metric of the named family with the given labels,
+// creating both if needed
+func (p *openMetricsParser) metric(name, help string, t dto.MetricType, labels []*dto.LabelPair) (*dto.Metric, error) {
+	mf, ok := p.families[name]
+	if !ok {
+		mf = &dto.MetricFamily{Name: proto.String(name), Type: t.Enum()}
+		if help != "" {
+			mf.Help = proto.String(help)
+		}
+		p.families[name] = mf
+		p.order = append(p.order, name)
+	} else if mf.GetType() != t {
+		return nil, errors.Errorf("%q is both %s and %s", name, mf.GetType(), t)
+	}
+
+	key := signature(name, labels)
+	if m, ok := p.metrics[key]; ok {
+		return m, nil
+	}
+	m := &dto.Metric{Label: labels}
+	mf.Metric = append(mf.Metric, m)
+	p.metrics[key] = m
+	return m, nil
+}
+
+// signature identifies a series of a family
+func signature(name string, labels []*dto.LabelPair) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l.GetName() + "\xff" + l.GetValue()
+	}
+	sort.Strings(pairs)
+	return name + "\xfe" + strings.Join(pairs, "\xfe")
+}
+
+// without returns labels without the named label, and that label if present
+func without(labels []*dto.LabelPair, name string) ([]*dto.LabelPair, *dto.LabelPair) {
+	var found *dto.LabelPair
+	res := make([]*dto.LabelPair, 0, len(labels))
+	for _, l := range labels {
+		if l.GetName() == name {
+			found = l
+			continue
+		}
+		res = append(res, l)
+	}
+	return res, found
+}
+
+// parseSampleLine parses `name{labels} value [timestamp] [# {labels} value
+// [timestamp]]`
+func parseSampleLine(line string) (omSample, error) {
+	var s omSample
+
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return s, errors.Errorf("sample %q has no value", line)
+	}
+	s.name, line = line[:end], line[end:]
+	if !model.IsValidMetricName(model.LabelValue(s.name)) {
+		return s, errors.Errorf("invalid metric name %q", s.name)
+	}
+
+	var err error
+	if strings.HasPrefix(line, "{") {
+		if s.labels, line, err = parseLabels(line); err != nil {
+			return s, errors.Wrapf(err, "invalid labels of %q", s.name)
+		}
+	}
+	if !strings.HasPrefix(line, " ") {
+		return s, errors.Errorf("expected a space after %q", s.name)
+	}
+
+	parts := strings.SplitN(line[1:], " # ", 2)
+	if s.value, s.timestamp, err = parseValue(parts[0]); err != nil {
+		return s, errors.Wrapf(err, "invalid value of %q", s.name)
+	}
+	if len(parts) == 1 {
+		return s, nil
+	}
+
+	e := &omExemplar{}
+	rest := parts[1]
+	if e.labels, rest, err = parseLabels(rest); err != nil {
+		return s, errors.Wrapf(err, "invalid exemplar labels of %q", s.name)
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return s, errors.Errorf("exemplar of %q has no value", s.name)
+	}
+	if e.value, e.timestamp, err = parseValue(rest[1:]); err != nil {
+		return s, errors.Wrapf(err, "invalid exemplar of %q", s.name)
+	}
+	s.exemplar = e
+	return s, nil
+}
+
+// parseLabels parses a label set starting with { and returns the rest of the
+// line after the closing }
+func parseLabels(s string) ([]*dto.LabelPair, string, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, s, errors.New("expected {")
+	}
+	s = s[1:]
+
+	labels := []*dto.LabelPair{}
+	seen := map[string]bool{}
+	for {
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, "", errors.New("label without value")
+		}
+		name := s[:eq]
+		if !model.LabelName(name).IsValid() {
+			return nil, "", errors.Errorf("invalid label name %q", name)
+		}
+		if seen[name] {
+			return nil, "", errors.Errorf("duplicate label %q", name)
+		}
+		seen[name] = true
+
+		s = s[eq+1:]
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", errors.Errorf("value of label %q is not quoted", name)
+		}
+		value, rest, err := parseQuoted(s[1:])
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "invalid value of label %q", name)
+		}
+		if !utf8.ValidString(value) {
+			return nil, "", errors.Errorf("value of label %q is not valid UTF-8", name)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+
+		s = strings.TrimPrefix(rest, ",")
+		if s == rest && !strings.HasPrefix(s, "}") {
+			return nil, "", errors.New("expected , or }")
+		}
+	}
+}
+
+// parseQuoted reads an escaped label value up to the closing quote
+func parseQuoted(s string) (string, string, error) {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", errors.New("unterminated escape")
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case '\\', '"':
+				b.WriteByte(s[i])
+			default:
+				return "", "", errors.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", errors.New("unterminated quote")
+}
+
+// parseValue parses a value and an optional timestamp in seconds
+func parseValue(s string) (float64, *int64, error) {
+	fields := strings.Split(s, " ")
+	if len(fields) > 2 || fields[0] == "" {
+		return 0, nil, errors.Errorf("expected a value and an optional timestamp, got %q", s)
+	}
+
+	v, err := parseFloat(fields[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(fields) == 1 {
+		return v, nil, nil
+	}
+
+	ts, err := parseFloat(fields[1])
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return 0, nil, errors.Errorf("invalid timestamp %q", fields[1])
+	}
+	ms := int64(ts * 1000)
+	return v, &ms, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	return v, errors.Wrapf(err, "invalid number %q", s)
+}
+
+// unescape reverses the escaping of HELP text
+func unescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`).Replace(s)
+}
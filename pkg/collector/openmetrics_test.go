@@ -0,0 +1,203 @@
+package collector
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseFixture parses an OpenMetrics payload from testdata and returns the
+// families by name
+func parseFixture(t *testing.T, name string, opts ScraperOpts) map[string]*dto.MetricFamily {
+	f, err := os.Open(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	defer f.Close()
+
+	mfs, err := parseOpenMetrics(f, opts)
+	require.NoError(t, err)
+
+	res := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		res[mf.GetName()] = mf
+	}
+	return res
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestParseOpenMetricsPython(t *testing.T) {
+	mfs := parseFixture(t, "python.om.txt", ScraperOpts{})
+
+	counter := mfs["app_requests_total"]
+	require.NotNil(t, counter)
+	assert.Equal(t, dto.MetricType_COUNTER, counter.GetType())
+	assert.Equal(t, "Requests handled by the app", counter.GetHelp())
+	require.Len(t, counter.Metric, 2)
+	assert.Equal(t, 32.0, counter.Metric[0].GetCounter().GetValue())
+	assert.NotContains(t, mfs, "app_requests_created")
+	assert.NotContains(t, mfs, "app_request_latency_seconds_created")
+
+	hist := mfs["app_request_latency_seconds"]
+	require.NotNil(t, hist)
+	assert.Equal(t, dto.MetricType_HISTOGRAM, hist.GetType())
+	require.Len(t, hist.Metric, 1)
+	h := hist.Metric[0].GetHistogram()
+	assert.Equal(t, uint64(36), h.GetSampleCount())
+	assert.InDelta(t, 0.536, h.GetSampleSum(), 0.001)
+	assert.Len(t, h.GetBucket(), 5)
+	assert.Empty(t, hist.Metric[0].GetLabel())
+
+	summary := mfs["app_payload_bytes"]
+	require.NotNil(t, summary)
+	assert.Equal(t, dto.MetricType_SUMMARY, summary.GetType())
+	assert.Equal(t, uint64(36), summary.Metric[0].GetSummary().GetSampleCount())
+
+	info := mfs["app_build_info"]
+	require.NotNil(t, info)
+	assert.Equal(t, dto.MetricType_GAUGE, info.GetType())
+	assert.Equal(t, "2.3.1", labelValue(info.Metric[0], "version"))
+	assert.Equal(t, 1.0, info.Metric[0].GetGauge().GetValue())
+
+	state := mfs["app_state"]
+	require.NotNil(t, state)
+	assert.Equal(t, dto.MetricType_GAUGE, state.GetType())
+	require.Len(t, state.Metric, 3)
+	assert.Equal(t, "running", labelValue(state.Metric[1], "app_state"))
+	assert.Equal(t, 1.0, state.Metric[1].GetGauge().GetValue())
+
+	for _, name := range []string{"app_queue_depth_bucket", "app_queue_depth_gcount", "app_queue_depth_gsum"} {
+		require.Contains(t, mfs, name)
+		assert.Equal(t, dto.MetricType_GAUGE, mfs[name].GetType(), name)
+	}
+	assert.Equal(t, 37.5, mfs["app_queue_depth_gsum"].Metric[0].GetGauge().GetValue())
+}
+
+func TestParseOpenMetricsKeepsCreatedSeries(t *testing.T) {
+	mfs := parseFixture(t, "python.om.txt", ScraperOpts{KeepCreated: true})
+
+	created := mfs["app_requests_created"]
+	require.NotNil(t, created)
+	assert.Equal(t, dto.MetricType_GAUGE, created.GetType())
+	require.Len(t, created.Metric, 2)
+	assert.Equal(t, "/login", labelValue(created.Metric[1], "path"))
+	assert.Contains(t, mfs, "app_request_latency_seconds_created")
+	assert.Contains(t, mfs, "app_payload_bytes_created")
+}
+
+func TestParseOpenMetricsDropsExemplars(t *testing.T) {
+	mfs := parseFixture(t, "java-exemplars.om.txt", ScraperOpts{})
+
+	hist := mfs["http_server_requests_seconds"]
+	require.NotNil(t, hist)
+	require.Len(t, hist.Metric, 1)
+	assert.Equal(t, "/api/orders", labelValue(hist.Metric[0], "uri"))
+	assert.Len(t, hist.Metric[0].GetHistogram().GetBucket(), 4)
+	assert.Equal(t, 1027.0, mfs["orders_processed_total"].Metric[0].GetCounter().GetValue())
+	assert.Equal(t, 2.5165824e7, mfs["jvm_memory_used_bytes"].Metric[0].GetGauge().GetValue())
+
+	for name := range mfs {
+		assert.False(t, strings.HasSuffix(name, "_exemplar"), name)
+	}
+}
+
+func TestParseOpenMetricsKeepsExemplars(t *testing.T) {
+	mfs := parseFixture(t, "java-exemplars.om.txt", ScraperOpts{KeepExemplars: true})
+
+	ex := mfs["http_server_requests_seconds_bucket_exemplar"]
+	require.NotNil(t, ex)
+	assert.Equal(t, dto.MetricType_GAUGE, ex.GetType())
+	require.Len(t, ex.Metric, 2)
+	assert.Equal(t, "0.005", labelValue(ex.Metric[0], "le"))
+	assert.Equal(t, 0.0031, ex.Metric[0].GetGauge().GetValue())
+	assert.Equal(t, int64(1712638602417), ex.Metric[0].GetTimestampMs())
+
+	// the labels of the exemplar would create a series per trace
+	ex = mfs["orders_processed_total_exemplar"]
+	require.NotNil(t, ex)
+	for _, name := range []string{"http_server_requests_seconds_bucket_exemplar", "orders_processed_total_exemplar"} {
+		for _, m := range mfs[name].Metric {
+			for _, l := range m.Label {
+				assert.NotContains(t, []string{"trace_id", "span_id", "exemplar_status"}, l.GetName())
+			}
+		}
+	}
+	assert.Equal(t, "ok", labelValue(ex.Metric[0], "status"))
+	assert.Equal(t, 1.0, ex.Metric[0].GetGauge().GetValue())
+}
+
+func TestParseOpenMetricsGolang(t *testing.T) {
+	mfs := parseFixture(t, "golang.om.txt", ScraperOpts{})
+
+	gc := mfs["go_gc_duration_seconds"]
+	require.NotNil(t, gc)
+	assert.Equal(t, dto.MetricType_SUMMARY, gc.GetType())
+	assert.Len(t, gc.Metric[0].GetSummary().GetQuantile(), 5)
+	assert.Equal(t, uint64(153), gc.Metric[0].GetSummary().GetSampleCount())
+
+	assert.Len(t, mfs["promhttp_metric_handler_requests_total"].Metric, 3)
+	assert.Equal(t, 7.0, mfs["api_errors_total"].Metric[0].GetCounter().GetValue())
+	assert.Equal(t, int64(1712638644500), mfs["last_backup_timestamp_seconds"].Metric[0].GetTimestampMs())
+}
+
+func TestParseOpenMetricsRejectsInvalidPayloads(t *testing.T) {
+	payloads := map[string]string{
+		"missing EOF":       "# TYPE up gauge\nup 1\n",
+		"data after EOF":    "up 1\n# EOF\nup 2\n",
+		"unknown type":      "# TYPE up thing\nup 1\n# EOF\n",
+		"bad value":         "up one\n# EOF\n",
+		"unquoted label":    "up{job=api} 1\n# EOF\n",
+		"duplicate label":   "up{job=\"a\",job=\"b\"} 1\n# EOF\n",
+		"negative counter":  "# TYPE c counter\nc_total -1\n# EOF\n",
+		"bucket without le": "# TYPE h histogram\nh_bucket 1\n# EOF\n",
+		"empty line":        "up 1\n\n# EOF\n",
+		"invalid UTF-8":     "x{a=\"\xff\xfe\"} 1\n# EOF\n",
+	}
+	for name, payload := range payloads {
+		_, err := parseOpenMetrics(strings.NewReader(payload), ScraperOpts{})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParseOpenMetricsEscapes(t *testing.T) {
+	payload := "# HELP msg A \\\"quoted\\\" help\\nline\n# TYPE msg gauge\nmsg{text=\"a \\\"b\\\" \\\\ c # {d}\"} 1\n# EOF\n"
+	mfs, err := parseOpenMetrics(strings.NewReader(payload), ScraperOpts{})
+	require.NoError(t, err)
+	require.Len(t, mfs, 1)
+	assert.Equal(t, "A \"quoted\" help\nline", mfs[0].GetHelp())
+	assert.Equal(t, `a "b" \ c # {d}`, labelValue(mfs[0].Metric[0], "text"))
+}
+
+func TestScraperParsesOpenMetrics(t *testing.T) {
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "java-exemplars.om.txt"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		w.Write(payload)
+	}))
+	defer srv.Close()
+
+	s, err := NewScraper("java", srv.URL, time.Second, WithExemplars(true))
+	require.NoError(t, err)
+	mfs := gatherScraper(t, s)
+
+	assert.Equal(t, 1.0, mfs["up"].Metric[0].GetGauge().GetValue())
+	assert.Contains(t, mfs, "http_server_requests_seconds")
+	assert.Contains(t, mfs, "orders_processed_total_exemplar")
+}
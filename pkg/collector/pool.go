@@ -0,0 +1,79 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ScrapePool limits how many of the scrapers sharing it scrape at once. The
+// registry collects every scraper in its own goroutine, so without a pool
+// all targets are scraped in parallel
+type ScrapePool struct {
+	sem chan struct{}
+}
+
+// NewScrapePool creates a pool running at most n scrapes at once. Zero means
+// no limit
+func NewScrapePool(n int) *ScrapePool {
+	p := &ScrapePool{}
+	if n > 0 {
+		p.sem = make(chan struct{}, n)
+	}
+	return p
+}
+
+// acquire blocks until a scrape may start
+func (p *ScrapePool) acquire() {
+	if p != nil && p.sem != nil {
+		p.sem <- struct{}{}
+	}
+}
+
+// release frees the slot taken by acquire
+func (p *ScrapePool) release() {
+	if p != nil && p.sem != nil {
+		<-p.sem
+	}
+}
+
+// limitedReader reads at most one byte more than limit from r so the caller
+// can tell whether the body was larger than allowed
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func newLimitedReader(r io.Reader, limit int64) *limitedReader {
+	return &limitedReader{r: io.LimitReader(r, limit+1), limit: limit}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// check returns an error if more than limit bytes were read
+func (l *limitedReader) check() error {
+	if l.read > l.limit {
+		return errors.Errorf("body size limit of %d bytes exceeded", l.limit)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package collector
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// textServer serves body as text and counts the connections made to it
+func textServer(body string) (*httptest.Server, *int) {
+	var mu sync.Mutex
+	conns := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	return srv, &conns
+}
+
+func TestScraperBodySizeLimit(t *testing.T) {
+	body := strings.Repeat("# padding\n", 100) + "app_requests_total 1\n"
+	srv, _ := textServer(body)
+	defer srv.Close()
+
+	s, err := NewScraper("app", srv.URL, time.Second, WithBodySizeLimit(int64(len(body))))
+	require.NoError(t, err)
+	assert.True(t, scrapeSucceeded(t, s))
+
+	s, err = NewScraper("app", srv.URL, time.Second, WithBodySizeLimit(int64(len(body)-1)))
+	require.NoError(t, err)
+	mfs := gatherScraper(t, s)
+	assert.Equal(t, 0.0, mfs["up"].Metric[0].GetGauge().GetValue())
+	assert.NotContains(t, mfs, "app_requests_total")
+}
+
+func TestScraperSampleLimit(t *testing.T) {
+	var body bytes.Buffer
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&body, "app_requests_total{code=\"%d\"} 1\n", i)
+	}
+	srv, _ := textServer(body.String())
+	defer srv.Close()
+
+	s, err := NewScraper("app", srv.URL, time.Second, WithSampleLimit(10))
+	require.NoError(t, err)
+	mfs := gatherScraper(t, s)
+	assert.Len(t, mfs["app_requests_total"].Metric, 10)
+
+	s, err = NewScraper("app", srv.URL, time.Second, WithSampleLimit(9))
+	require.NoError(t, err)
+	mfs = gatherScraper(t, s)
+	assert.NotContains(t, mfs, "app_requests_total")
+	assert.Equal(t, 0.0, mfs["up"].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, 10.0, mfs["scrape_samples_scraped"].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, 0.0, mfs["scrape_samples_post_metric_relabeling"].Metric[0].GetGauge().GetValue())
+
+	_, err = NewScraper("app", srv.URL, time.Second, WithSampleLimit(-1))
+	assert.Error(t, err)
+}
+
+func TestScraperReusesConnections(t *testing.T) {
+	srv, conns := textServer("app_requests_total 1\n")
+	defer srv.Close()
+
+	s, err := NewScraper("app", srv.URL, time.Second)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.True(t, scrapeSucceeded(t, s))
+	}
+	assert.Equal(t, 1, *conns)
+}
+
+func TestScrapePoolLimitsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("app_requests_total 1\n"))
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	pool := NewScrapePool(2)
+	scrapers := []*Scraper{}
+	for i := 0; i < 6; i++ {
+		s, err := NewScraper(fmt.Sprintf("app%d", i), srv.URL+fmt.Sprintf("/metrics?i=%d", i), time.Second,
+			WithScrapePool(pool), WithInstance(fmt.Sprintf("app-%d", i)))
+		require.NoError(t, err)
+		scrapers = append(scrapers, s)
+	}
+
+	mfs := gatherScrapers(t, scrapers...)
+	assert.Len(t, mfs["up"].Metric, 6)
+	assert.Equal(t, 2, peak)
+}
@@ -0,0 +1,448 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+)
+
+const processNamespace = "process_group"
+
+var (
+	processCPUDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(processNamespace, "", "cpu_seconds_total"),
+		"CPU time spent by the processes of the group, by mode.",
+		[]string{"groupname", "mode"}, nil,
+	)
+	processRSSDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(processNamespace, "", "resident_memory_bytes"),
+		"Resident memory of the processes of the group.",
+		[]string{"groupname"}, nil,
+	)
+	processReadDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(processNamespace, "", "read_bytes_total"),
+		"Bytes the processes of the group read from storage.",
+		[]string{"groupname"}, nil,
+	)
+	processWriteDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(processNamespace, "", "write_bytes_total"),
+		"Bytes the processes of the group wrote to storage.",
+		[]string{"groupname"}, nil,
+	)
+	processFDsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(processNamespace, "", "open_fds"),
+		"Open file descriptors of the processes of the group.",
+		[]string{"groupname"}, nil,
+	)
+	processFDRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(processNamespace, "", "max_fd_usage_ratio"),
+		"Highest ratio of open file descriptors to the limit of any process of the group.",
+		[]string{"groupname"}, nil,
+	)
+	processThreadsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(processNamespace, "", "threads"),
+		"Threads of the processes of the group.",
+		[]string{"groupname"}, nil,
+	)
+	processCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(processNamespace, "", "processes"),
+		"Number of processes in the group.",
+		[]string{"groupname"}, nil,
+	)
+)
+
+// userHZ is the number of clock ticks per second in /proc/[pid]/stat, see
+// procfs
+const userHZ = 100
+
+// ProcessGroup selects processes whose name, as in /proc/[pid]/comm,
+// matches Comm or whose command line matches Cmdline
+type ProcessGroup struct {
+	Name    string
+	Comm    string
+	Cmdline string
+}
+
+// ProcessOpts configure which processes are reported
+type ProcessOpts struct {
+	ProcRoot string
+	Groups   []ProcessGroup
+
+	// TopN reports the processes matching none of the groups by name. Only
+	// the N names using the most CPU and the N using the most memory are
+	// reported to keep the number of series bounded
+	TopN int
+}
+
+// ProcessOptFn allows for overriding options
+type ProcessOptFn func(*ProcessOpts)
+
+// WithProcRoot reads processes from a procfs mounted at path instead of
+// /proc
+func WithProcRoot(path string) ProcessOptFn {
+	return func(o *ProcessOpts) {
+		o.ProcRoot = path
+	}
+}
+
+// WithProcessGroups reports the processes matching each of groups. A process
+// belongs to the first group it matches
+func WithProcessGroups(groups ...ProcessGroup) ProcessOptFn {
+	return func(o *ProcessOpts) {
+		o.Groups = append(o.Groups, groups...)
+	}
+}
+
+// WithTopProcesses reports the n process names using the most CPU and the n
+// using the most memory among the processes matching no group
+func WithTopProcesses(n int) ProcessOptFn {
+	return func(o *ProcessOpts) {
+		o.TopN = n
+	}
+}
+
+// NewProcessCollector creates a collector reporting the resource usage of
+// groups of processes
+func NewProcessCollector(opts ...ProcessOptFn) (*ProcessCollector, error) {
+	o := ProcessOpts{ProcRoot: procfs.DefaultMountPoint}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	if o.TopN < 0 {
+		return nil, errors.New("number of top processes must not be negative")
+	}
+	if len(o.Groups) == 0 && o.TopN == 0 {
+		return nil, errors.New("no process groups configured")
+	}
+
+	c := &ProcessCollector{
+		opts:        o,
+		prev:        map[procKey]procCounters{},
+		totals:      map[string]*procCounters{},
+		otherTotals: map[string]*procCounters{},
+	}
+	seen := map[string]bool{}
+	for _, g := range o.Groups {
+		if g.Name == "" {
+			return nil, errors.New("process group has no name")
+		}
+		if seen[g.Name] {
+			return nil, errors.Errorf("process group %q is defined more than once", g.Name)
+		}
+		seen[g.Name] = true
+
+		m, err := newProcessMatcher(g)
+		if err != nil {
+			return nil, err
+		}
+		c.matchers = append(c.matchers, m)
+		c.needCmdline = c.needCmdline || m.cmdline != nil
+	}
+	return c, nil
+}
+
+// ProcessCollector reports the CPU, memory, IO, file descriptors and threads
+// of groups of processes
+type ProcessCollector struct {
+	opts        ProcessOpts
+	matchers    []processMatcher
+	needCmdline bool
+
+	mu sync.Mutex
+
+	// prev holds the counters of every process at the previous collection.
+	// Only their increase is added to the totals of the groups so the totals
+	// do not drop when a process exits
+	prev map[procKey]procCounters
+
+	// totals and otherTotals are the counters of the configured groups and
+	// of the processes matching no group by name
+	totals      map[string]*procCounters
+	otherTotals map[string]*procCounters
+}
+
+type processMatcher struct {
+	name    string
+	comm    *regexp.Regexp
+	cmdline *regexp.Regexp
+}
+
+func newProcessMatcher(g ProcessGroup) (processMatcher, error) {
+	m := processMatcher{name: g.Name}
+	if g.Comm == "" && g.Cmdline == "" {
+		return m, errors.Errorf("process group %q has neither a comm nor a cmdline pattern", g.Name)
+	}
+
+	var err error
+	if g.Comm != "" {
+		if m.comm, err = regexp.Compile(g.Comm); err != nil {
+			return m, errors.Wrapf(err, "invalid comm pattern for process group %q", g.Name)
+		}
+	}
+	if g.Cmdline != "" {
+		if m.cmdline, err = regexp.Compile(g.Cmdline); err != nil {
+			return m, errors.Wrapf(err, "invalid cmdline pattern for process group %q", g.Name)
+		}
+	}
+	return m, nil
+}
+
+func (m processMatcher) matches(comm, cmdline string) bool {
+	return (m.comm != nil && m.comm.MatchString(comm)) ||
+		(m.cmdline != nil && m.cmdline.MatchString(cmdline))
+}
+
+// procKey identifies a process across collections even if its PID is reused
+type procKey struct {
+	pid   int
+	start uint64
+}
+
+// procCounters are the CPU seconds and IO bytes of a process or group
+type procCounters struct {
+	user, system float64
+	read, write  float64
+}
+
+// since returns the increase of c since prev
+func (c procCounters) since(prev procCounters) procCounters {
+	return procCounters{
+		user:   math.Max(c.user-prev.user, 0),
+		system: math.Max(c.system-prev.system, 0),
+		read:   math.Max(c.read-prev.read, 0),
+		write:  math.Max(c.write-prev.write, 0),
+	}
+}
+
+func (c *procCounters) add(d procCounters) {
+	c.user += d.user
+	c.system += d.system
+	c.read += d.read
+	c.write += d.write
+}
+
+// groupStats is the summed usage of the processes of a group
+type groupStats struct {
+	rss     float64
+	fds     float64
+	fdRatio float64
+	threads float64
+	procs   float64
+
+	// recent is the increase of the counters since the previous collection
+	// and total their sum since the group was first seen
+	recent procCounters
+	total  procCounters
+}
+
+// Describe implements prometheus.Collector
+func (c *ProcessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- processCPUDesc
+	ch <- processRSSDesc
+	ch <- processReadDesc
+	ch <- processWriteDesc
+	ch <- processFDsDesc
+	ch <- processFDRatioDesc
+	ch <- processThreadsDesc
+	ch <- processCountDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *ProcessCollector) Collect(ch chan<- prometheus.Metric) {
+	groups, err := c.read()
+	if err != nil {
+		log.Error("failed to collect process metrics: %v", err)
+		return
+	}
+
+	for name, g := range groups {
+		ch <- prometheus.MustNewConstMetric(processCPUDesc, prometheus.CounterValue, g.total.user, name, "user")
+		ch <- prometheus.MustNewConstMetric(processCPUDesc, prometheus.CounterValue, g.total.system, name, "system")
+		ch <- prometheus.MustNewConstMetric(processRSSDesc, prometheus.GaugeValue, g.rss, name)
+		ch <- prometheus.MustNewConstMetric(processReadDesc, prometheus.CounterValue, g.total.read, name)
+		ch <- prometheus.MustNewConstMetric(processWriteDesc, prometheus.CounterValue, g.total.write, name)
+		ch <- prometheus.MustNewConstMetric(processFDsDesc, prometheus.GaugeValue, g.fds, name)
+		ch <- prometheus.MustNewConstMetric(processFDRatioDesc, prometheus.GaugeValue, g.fdRatio, name)
+		ch <- prometheus.MustNewConstMetric(processThreadsDesc, prometheus.GaugeValue, g.threads, name)
+		ch <- prometheus.MustNewConstMetric(processCountDesc, prometheus.GaugeValue, g.procs, name)
+	}
+}
+
+// read returns the usage of every group to report
+func (c *ProcessCollector) read() (map[string]*groupStats, error) {
+	fs, err := procfs.NewFS(c.opts.ProcRoot)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open procfs")
+	}
+	procs, err := fs.AllProcs()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list processes")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	groups := map[string]*groupStats{}
+	for _, m := range c.matchers {
+		// configured groups are reported even without processes
+		groups[m.name] = &groupStats{}
+	}
+	others := map[string]*groupStats{}
+	counters := make(map[procKey]procCounters, len(c.prev))
+
+	for _, p := range procs {
+		stat, err := p.NewStat()
+		if err != nil {
+			// the process exited since it was listed
+			continue
+		}
+		key := procKey{pid: p.PID, start: stat.Starttime}
+		prev := c.prev[key]
+		cur := procCounters{
+			user:   float64(stat.UTime) / userHZ,
+			system: float64(stat.STime) / userHZ,
+			// kept when IO cannot be read so it is not counted twice later
+			read:  prev.read,
+			write: prev.write,
+		}
+		if pio, err := p.NewIO(); err == nil {
+			cur.read, cur.write = float64(pio.ReadBytes), float64(pio.WriteBytes)
+		}
+		counters[key] = cur
+
+		// a process whose command line cannot be read can still match by
+		// comm
+		var cmdline string
+		if c.needCmdline {
+			if args, err := p.CmdLine(); err == nil {
+				cmdline = strings.Join(args, " ")
+			}
+		}
+
+		g := c.group(groups, stat.Comm, cmdline)
+		if g == nil {
+			if c.opts.TopN == 0 {
+				continue
+			}
+			// any process can rename itself, the registry panics on label
+			// values which are not valid UTF-8
+			name := strings.ToValidUTF8(stat.Comm, "\uFFFD")
+			if g = others[name]; g == nil {
+				g = &groupStats{}
+				others[name] = g
+			}
+		}
+		addProcess(g, p, stat, cur.since(prev))
+	}
+	c.prev = counters
+	accumulate(c.totals, groups)
+	accumulate(c.otherTotals, others)
+
+	for name, g := range topGroups(others, c.opts.TopN) {
+		if _, ok := groups[name]; !ok {
+			groups[name] = g
+		}
+	}
+	return groups, nil
+}
+
+// group returns the stats of the first group matching the process
+func (c *ProcessCollector) group(groups map[string]*groupStats, comm, cmdline string) *groupStats {
+	for _, m := range c.matchers {
+		if m.matches(comm, cmdline) {
+			return groups[m.name]
+		}
+	}
+	return nil
+}
+
+// accumulate adds the recent usage of groups to their totals. Totals of
+// groups which are gone are dropped
+func accumulate(totals map[string]*procCounters, groups map[string]*groupStats) {
+	for name := range totals {
+		if _, ok := groups[name]; !ok {
+			delete(totals, name)
+		}
+	}
+	for name, g := range groups {
+		t, ok := totals[name]
+		if !ok {
+			t = &procCounters{}
+			totals[name] = t
+		}
+		t.add(g.recent)
+		g.total = *t
+	}
+}
+
+// addProcess adds the usage of p to g, recent being the increase of its
+// counters since the previous collection. IO and file descriptors are only
+// readable for processes of the same user unless running as root, they are
+// left out if they cannot be read
+func addProcess(g *groupStats, p procfs.Proc, stat procfs.ProcStat, recent procCounters) {
+	g.procs++
+	g.recent.add(recent)
+	g.rss += float64(stat.ResidentMemory())
+	g.threads += float64(stat.NumThreads)
+
+	fds, err := p.FileDescriptorsLen()
+	if err != nil {
+		return
+	}
+	g.fds += float64(fds)
+	if limits, err := p.NewLimits(); err == nil && limits.OpenFiles > 0 {
+		if ratio := float64(fds) / float64(limits.OpenFiles); ratio > g.fdRatio {
+			g.fdRatio = ratio
+		}
+	}
+}
+
+// topGroups returns the n groups with the most recent CPU usage and the n
+// with the most resident memory
+func topGroups(groups map[string]*groupStats, n int) map[string]*groupStats {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+
+	res := map[string]*groupStats{}
+	pick := func(less func(a, b *groupStats) bool) {
+		sort.Slice(names, func(i, j int) bool {
+			a, b := groups[names[i]], groups[names[j]]
+			if less(a, b) || less(b, a) {
+				return less(b, a)
+			}
+			return names[i] < names[j]
+		})
+		for i := 0; i < n && i < len(names); i++ {
+			res[names[i]] = groups[names[i]]
+		}
+	}
+	pick(func(a, b *groupStats) bool {
+		return a.recent.user+a.recent.system < b.recent.user+b.recent.system
+	})
+	pick(func(a, b *groupStats) bool { return a.rss < b.rss })
+	return res
+}
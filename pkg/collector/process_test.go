@@ -0,0 +1,204 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var procFixtures = filepath.Join("testdata", "proc")
+
+// gatherProcesses returns the value of every series of the named family by
+// group, and by mode for CPU
+func gatherProcesses(t *testing.T, c *ProcessCollector, name string) map[string]float64 {
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(c))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	res := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.Metric {
+			key := labelValue(m, "groupname")
+			if mode := labelValue(m, "mode"); mode != "" {
+				key += "/" + mode
+			}
+			res[key] = metricValue(m)
+		}
+	}
+	return res
+}
+
+func metricValue(m *dto.Metric) float64 {
+	if m.Counter != nil {
+		return m.GetCounter().GetValue()
+	}
+	return m.GetGauge().GetValue()
+}
+
+func groupNames(values map[string]float64) []string {
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestProcessCollectorGroups(t *testing.T) {
+	c, err := NewProcessCollector(WithProcRoot(procFixtures), WithProcessGroups(
+		ProcessGroup{Name: "web", Comm: "^nginx$"},
+		ProcessGroup{Name: "app", Cmdline: `gunicorn .*app:wsgi`},
+		ProcessGroup{Name: "mysql", Comm: "^mysqld$"},
+	))
+	require.NoError(t, err)
+
+	count := gatherProcesses(t, c, "process_group_processes")
+	assert.Equal(t, map[string]float64{"web": 2, "app": 1, "mysql": 0}, count)
+
+	cpu := gatherProcesses(t, c, "process_group_cpu_seconds_total")
+	assert.Equal(t, 11.5, cpu["web/user"])
+	assert.Equal(t, 5.5, cpu["web/system"])
+	assert.Equal(t, 30.0, cpu["app/user"])
+
+	page := float64(os.Getpagesize())
+	assert.Equal(t, 3000*page, gatherProcesses(t, c, "process_group_resident_memory_bytes")["web"])
+	assert.Equal(t, float64(4096+1048576), gatherProcesses(t, c, "process_group_read_bytes_total")["web"])
+	assert.Equal(t, 65536.0, gatherProcesses(t, c, "process_group_write_bytes_total")["app"])
+	assert.Equal(t, 12.0, gatherProcesses(t, c, "process_group_open_fds")["web"])
+	assert.Equal(t, 0.5, gatherProcesses(t, c, "process_group_max_fd_usage_ratio")["web"])
+	assert.Equal(t, 4.0, gatherProcesses(t, c, "process_group_threads")["app"])
+}
+
+func TestProcessCollectorTopN(t *testing.T) {
+	c, err := NewProcessCollector(WithProcRoot(procFixtures), WithTopProcesses(1))
+	require.NoError(t, err)
+
+	// python3 uses the most CPU, postgres the most memory
+	count := gatherProcesses(t, c, "process_group_processes")
+	assert.Equal(t, []string{"postgres", "python3"}, groupNames(count))
+
+	c, err = NewProcessCollector(WithProcRoot(procFixtures), WithTopProcesses(2),
+		WithProcessGroups(ProcessGroup{Name: "app", Comm: "^python3$"}))
+	require.NoError(t, err)
+	count = gatherProcesses(t, c, "process_group_processes")
+	assert.Equal(t, []string{"app", "nginx", "postgres"}, groupNames(count))
+}
+
+func TestProcessCollectorRanksByRecentCPU(t *testing.T) {
+	c, err := NewProcessCollector(WithProcRoot(procFixtures), WithTopProcesses(1))
+	require.NoError(t, err)
+	gatherProcesses(t, c, "process_group_processes")
+
+	// only cron used CPU since the previous collection
+	c.prev[procKey{pid: 401, start: 110}] = procCounters{}
+	count := gatherProcesses(t, c, "process_group_processes")
+	assert.Equal(t, []string{"cron", "postgres"}, groupNames(count))
+}
+
+// copyProcFixtures copies the procfs fixtures to a temporary directory which
+// tests can change
+func copyProcFixtures(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "proc")
+	require.NoError(t, err)
+
+	err = filepath.Walk(procFixtures, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(procFixtures, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0755)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, rel), b, 0644)
+	})
+	require.NoError(t, err)
+	return dir
+}
+
+func TestProcessCollectorCountersSurviveExits(t *testing.T) {
+	dir := copyProcFixtures(t)
+	defer os.RemoveAll(dir)
+
+	c, err := NewProcessCollector(WithProcRoot(dir), WithProcessGroups(ProcessGroup{Name: "web", Comm: "^nginx$"}))
+	require.NoError(t, err)
+	assert.Equal(t, 11.5, gatherProcesses(t, c, "process_group_cpu_seconds_total")["web/user"])
+
+	// the worker exits, the master keeps running
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "101")))
+	stat := filepath.Join(dir, "100", "stat")
+	b, err := ioutil.ReadFile(stat)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(stat, []byte(strings.Replace(string(b), " 150 50 ", " 250 50 ", 1)), 0644))
+
+	assert.Equal(t, 12.5, gatherProcesses(t, c, "process_group_cpu_seconds_total")["web/user"])
+	assert.Equal(t, float64(4096+1048576), gatherProcesses(t, c, "process_group_read_bytes_total")["web"])
+	assert.Equal(t, 1.0, gatherProcesses(t, c, "process_group_processes")["web"])
+}
+
+func TestProcessCollectorMatchesCommWithoutCmdline(t *testing.T) {
+	dir := copyProcFixtures(t)
+	defer os.RemoveAll(dir)
+
+	// reading a directory fails like reading the cmdline of a process which
+	// just exited or belongs to another user
+	cmdline := filepath.Join(dir, "101", "cmdline")
+	require.NoError(t, os.Remove(cmdline))
+	require.NoError(t, os.Mkdir(cmdline, 0755))
+
+	c, err := NewProcessCollector(WithProcRoot(dir), WithProcessGroups(
+		ProcessGroup{Name: "web", Comm: "^nginx$"},
+		ProcessGroup{Name: "app", Cmdline: `gunicorn .*app:wsgi`},
+	))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"web": 2, "app": 1}, gatherProcesses(t, c, "process_group_processes"))
+}
+
+func TestProcessCollectorSanitizesNames(t *testing.T) {
+	dir := copyProcFixtures(t)
+	defer os.RemoveAll(dir)
+
+	stat := filepath.Join(dir, "401", "stat")
+	b, err := ioutil.ReadFile(stat)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(stat, []byte(strings.Replace(string(b), "(cron)", "(\xff\xfe)", 1)), 0644))
+
+	c, err := NewProcessCollector(WithProcRoot(dir), WithTopProcesses(10))
+	require.NoError(t, err)
+	count := gatherProcesses(t, c, "process_group_processes")
+	assert.Contains(t, count, "\uFFFD")
+	assert.NotContains(t, count, "cron")
+}
+
+func TestNewProcessCollectorRejectsInvalidGroups(t *testing.T) {
+	invalid := [][]ProcessOptFn{
+		{},
+		{WithTopProcesses(-1)},
+		{WithProcessGroups(ProcessGroup{Comm: "nginx"})},
+		{WithProcessGroups(ProcessGroup{Name: "web"})},
+		{WithProcessGroups(ProcessGroup{Name: "web", Comm: "("})},
+		{WithProcessGroups(ProcessGroup{Name: "web", Comm: "a"}, ProcessGroup{Name: "web", Comm: "b"})},
+	}
+	for i, opts := range invalid {
+		_, err := NewProcessCollector(opts...)
+		assert.Error(t, err, "case %d", i)
+	}
+}
@@ -21,63 +21,310 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/digitalocean/metrics-agent/internal/log"
 	"github.com/digitalocean/metrics-agent/pkg/clients"
+	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
-// NewScraper creates a new scraper to scrape metrics from the provided host
-func NewScraper(name, host string, timeout time.Duration) (*Scraper, error) {
-	host = strings.TrimRight(host, "/")
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/metrics", host), nil)
+// acceptHeader prefers the delimited protobuf format which is cheaper to
+// parse for large payloads. Targets only speaking text still get text
+const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,` +
+	`application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-text;version=0.0.1;q=0.4,` +
+	`text/plain;version=0.0.4;q=0.3,*/*;q=0.1`
+
+// ScraperOpts configure how a target is scraped and how its metrics are
+// parsed
+type ScraperOpts struct {
+	KeepExemplars bool
+	KeepCreated   bool
+
+	BearerToken     string
+	BearerTokenFile string
+	Username        string
+	Password        string
+	TLS             clients.TLSConfig
+
+	// Client replaces the client built from the options above
+	Client clients.HTTPClient
+
+	// Job and Instance are attached to every series along with Labels.
+	// They default to the name of the scraper and the address of the
+	// target. HonorLabels keeps the values of the target when it exposes
+	// one of these labels itself
+	Job         string
+	Instance    string
+	Labels      map[string]string
+	HonorLabels bool
+
+	// BodySizeLimit and SampleLimit fail scrapes whose uncompressed body or
+	// number of samples exceed them. Zero means no limit
+	BodySizeLimit int64
+	SampleLimit   int
+
+	// Pool limits how many scrapers run at once
+	Pool *ScrapePool
+
+	// Names are the families gathered before the scrapers and claimed by
+	// them. Families which conflict with them are dropped
+	Names *FamilyNames
+}
+
+// ScraperOptFn allows for overriding options
+type ScraperOptFn func(*ScraperOpts)
+
+// WithExemplars keeps the values of OpenMetrics exemplars as gauges named
+// after their sample with an _exemplar suffix instead of dropping them. The
+// labels of the exemplars are not kept
+func WithExemplars(keep bool) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.KeepExemplars = keep
+	}
+}
+
+// WithCreatedSeries keeps the _created series of OpenMetrics counters,
+// histograms and summaries as gauges instead of dropping them
+func WithCreatedSeries(keep bool) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.KeepCreated = keep
+	}
+}
+
+// WithBearerToken authenticates with a static bearer token
+func WithBearerToken(token string) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.BearerToken = token
+	}
+}
+
+// WithBearerTokenFile authenticates with the bearer token in path. The file
+// is read again when it changes
+func WithBearerTokenFile(path string) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.BearerTokenFile = path
+	}
+}
+
+// WithBasicAuth authenticates with a username and password
+func WithBasicAuth(username, password string) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.Username = username
+		o.Password = password
+	}
+}
+
+// WithTLSConfig sets the TLS settings used to connect to the target
+func WithTLSConfig(cfg clients.TLSConfig) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.TLS = cfg
+	}
+}
+
+// WithHTTPClient makes requests with c instead of a client built from the
+// other options
+func WithHTTPClient(c clients.HTTPClient) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.Client = c
+	}
+}
+
+// WithJob sets the job label of the scraped series
+func WithJob(job string) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.Job = job
+	}
+}
+
+// WithInstance sets the instance label of the scraped series
+func WithInstance(instance string) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.Instance = instance
+	}
+}
+
+// WithLabels attaches static labels to the scraped series
+func WithLabels(labels map[string]string) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.Labels = labels
+	}
+}
+
+// WithHonorLabels keeps the labels of the target when they conflict with the
+// job, instance or static labels instead of renaming them with an exported_
+// prefix
+func WithHonorLabels(honor bool) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.HonorLabels = honor
+	}
+}
+
+// WithBodySizeLimit fails scrapes whose uncompressed body is larger than n
+// bytes
+func WithBodySizeLimit(n int64) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.BodySizeLimit = n
+	}
+}
+
+// WithSampleLimit fails scrapes returning more than n samples. Nothing of
+// such a scrape is reported
+func WithSampleLimit(n int) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.SampleLimit = n
+	}
+}
+
+// WithScrapePool makes the scraper wait for a free slot in p before scraping
+func WithScrapePool(p *ScrapePool) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.Pool = p
+	}
+}
+
+// WithScrapeFamilyNames drops scraped families which other collectors already
+// reported or which another target reports with a different type, help or
+// label names
+func WithScrapeFamilyNames(n *FamilyNames) ScraperOptFn {
+	return func(o *ScraperOpts) {
+		o.Names = n
+	}
+}
+
+// NewScraper creates a new scraper to scrape metrics from the provided host.
+// See ParseTarget for the accepted forms of host
+func NewScraper(name, host string, timeout time.Duration, opts ...ScraperOptFn) (*Scraper, error) {
+	o := ScraperOpts{}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	if err := checkAuth(o); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := o.TLS.Build()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid TLS config")
+	}
+
+	if err := checkLabels(o.Labels); err != nil {
+		return nil, err
+	}
+	if o.BodySizeLimit < 0 || o.SampleLimit < 0 {
+		return nil, errors.New("scrape limits must not be negative")
+	}
+
+	u, socket, err := ParseTarget(host)
+	if err != nil {
+		return nil, err
+	}
+	if o.Job == "" {
+		o.Job = name
+	}
+	if o.Instance == "" {
+		o.Instance = u.Host
+		if socket != "" {
+			o.Instance = socket
+		}
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create http request")
 	}
-	req.Header.Add("Accept", `text/plain;version=0.0.4;q=1,*/*;q=0.1`)
+	req.Header.Add("Accept", acceptHeader)
 	req.Header.Add("Accept-Encoding", "gzip")
 	req.Header.Set("User-Agent", "Prometheus/2.3.0")
 	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", timeout.Seconds()))
+	switch {
+	case o.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+o.BearerToken)
+	case o.Username != "":
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+
+	client := o.Client
+	switch {
+	case client != nil:
+	case socket != "":
+		client = clients.NewUnixHTTP(socket, timeout)
+	default:
+		client = clients.NewHTTPWithTLS(timeout, tlsConfig)
+	}
 
+	var token *tokenFile
+	if o.BearerTokenFile != "" {
+		token = &tokenFile{path: o.BearerTokenFile}
+	}
+
+	target := prometheus.Labels{model.JobLabel: o.Job, model.InstanceLabel: o.Instance}
 	return &Scraper{
 		req:     req,
 		name:    name,
 		timeout: timeout,
-		client:  clients.NewHTTP(timeout),
-		scrapeDurationDesc: prometheus.NewDesc(
-			prometheus.BuildFQName(name, "scrape", "collector_duration_seconds"),
-			fmt.Sprintf("%s: Duration of a collector scrape.", name),
-			[]string{"collector"},
-			nil,
-		),
-		scrapeSuccessDesc: prometheus.NewDesc(
-			prometheus.BuildFQName(name, "scrape", "collector_success"),
-			fmt.Sprintf("%s: Whether a collector succeeded.", name),
-			[]string{"collector"},
-			nil,
-		),
+		opts:    o,
+		labels:  targetLabels(o),
+		token:   token,
+		client:  client,
+		health: scrapeHealthDescs{
+			up: prometheus.NewDesc("up",
+				"1 if the target was scraped successfully, 0 otherwise.", nil, target),
+			duration: prometheus.NewDesc("scrape_duration_seconds",
+				"Duration of the scrape of the target.", nil, target),
+			scraped: prometheus.NewDesc("scrape_samples_scraped",
+				"Number of samples the target exposed.", nil, target),
+			postRelabeling: prometheus.NewDesc("scrape_samples_post_metric_relabeling",
+				"Number of samples of the target remaining after invalid ones were dropped.", nil, target),
+		},
 	}, nil
 }
 
+// healthMetrics are the names of the metrics describing a scrape. Scraped
+// families of the same name are renamed with an exported_ prefix
+var healthMetrics = map[string]bool{
+	"up":                                    true,
+	"scrape_duration_seconds":               true,
+	"scrape_samples_scraped":                true,
+	"scrape_samples_post_metric_relabeling": true,
+}
+
+// scrapeHealthDescs describe the Prometheus standard metrics about a scrape.
+// Their names do not depend on the target, which is identified by the job and
+// instance labels instead
+type scrapeHealthDescs struct {
+	up             *prometheus.Desc
+	duration       *prometheus.Desc
+	scraped        *prometheus.Desc
+	postRelabeling *prometheus.Desc
+}
+
+// scrapeResult is the number of samples a scrape returned and how many of
+// them were kept
+type scrapeResult struct {
+	scraped int
+	kept    int
+}
+
 // Scraper is a remote metric scraper that scrapes HTTP endpoints
 type Scraper struct {
-	timeout            time.Duration
-	req                *http.Request
-	client             *http.Client
-	name               string
-	scrapeDurationDesc *prometheus.Desc
-	scrapeSuccessDesc  *prometheus.Desc
+	timeout time.Duration
+	opts    ScraperOpts
+	labels  []*dto.LabelPair
+	token   *tokenFile
+	req     *http.Request
+	client  clients.HTTPClient
+	name    string
+	health  scrapeHealthDescs
 }
 
 // readStream makes an HTTP request to the remote and returns the response body
-// upon successful response
-func (s *Scraper) readStream(ctx context.Context) (r io.ReadCloser, outerr error) {
+// and its format upon successful response
+func (s *Scraper) readStream(ctx context.Context) (r io.ReadCloser, format expfmt.Format, outerr error) {
 	// close the reader if we return an error
 	defer func() {
 		if outerr == nil || r == nil {
@@ -90,68 +337,203 @@ func (s *Scraper) readStream(ctx context.Context) (r io.ReadCloser, outerr error
 		}
 	}()
 
-	resp, err := s.client.Do(s.req.WithContext(ctx))
+	req := s.req.WithContext(ctx)
+	if s.token != nil {
+		token, err := s.token.get()
+		if err != nil {
+			return nil, "", err
+		}
+		// the copy made by WithContext shares the headers of s.req
+		req.Header = cloneHeader(req.Header)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "HTTP request failed")
+		return nil, "", errors.Wrap(err, "HTTP request failed")
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("server returned bad HTTP status %s", resp.Status)
+		return resp.Body, "", errors.Errorf("server returned bad HTTP status %s", resp.Status)
 	}
 
+	format = responseFormat(resp.Header)
 	if resp.Header.Get("Content-Encoding") != "gzip" {
-		return resp.Body, nil
+		return resp.Body, format, nil
 	}
 
 	reader, err := gzip.NewReader(bufio.NewReader(resp.Body))
-	return reader, errors.Wrap(err, "failed to create gzip reader")
+	if err != nil {
+		return resp.Body, "", errors.Wrap(err, "failed to create gzip reader")
+	}
+	return gzipReadCloser{Reader: reader, body: resp.Body}, format, nil
+}
+
+// gzipReadCloser closes the response body along with the gzip reader
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+// Close closes the gzip reader and the underlying body
+func (g gzipReadCloser) Close() error {
+	err := g.Reader.Close()
+	if berr := g.body.Close(); err == nil {
+		err = berr
+	}
+	return err
 }
 
 // Describe describes this collector
 func (s *Scraper) Describe(ch chan<- *prometheus.Desc) {
-	ch <- s.scrapeDurationDesc
-	ch <- s.scrapeSuccessDesc
+	ch <- s.health.up
+	ch <- s.health.duration
+	ch <- s.health.scraped
+	ch <- s.health.postRelabeling
 }
 
 // Collect collectrs metrics from the remote endpoint and reports them to ch
 func (s *Scraper) Collect(ch chan<- prometheus.Metric) {
 	var failed bool
+	var res scrapeResult
 	defer func(start time.Time) {
 		dur := time.Since(start).Seconds()
 		var success float64
 		if !failed {
 			success = 1
 		}
-		ch <- prometheus.MustNewConstMetric(s.scrapeDurationDesc, prometheus.GaugeValue, dur, s.Name())
-		ch <- prometheus.MustNewConstMetric(s.scrapeSuccessDesc, prometheus.GaugeValue, success, s.Name())
+		ch <- prometheus.MustNewConstMetric(s.health.up, prometheus.GaugeValue, success)
+		ch <- prometheus.MustNewConstMetric(s.health.duration, prometheus.GaugeValue, dur)
+		ch <- prometheus.MustNewConstMetric(s.health.scraped, prometheus.GaugeValue, float64(res.scraped))
+		ch <- prometheus.MustNewConstMetric(s.health.postRelabeling, prometheus.GaugeValue, float64(res.kept))
 	}(time.Now())
 
+	// the timeout starts once a slot is free
+	s.opts.Pool.acquire()
+	defer s.opts.Pool.release()
+
 	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
 	defer cancel()
 
-	if err := s.scrape(ctx, ch); err != nil {
+	var err error
+	if res, err = s.scrape(ctx, ch); err != nil {
 		failed = true
 		log.Error("collection failed for %q: %v", s.Name(), err)
 	}
 }
 
-func (s *Scraper) scrape(ctx context.Context, ch chan<- prometheus.Metric) (outerr error) {
-	stream, err := s.readStream(ctx)
+func (s *Scraper) scrape(ctx context.Context, ch chan<- prometheus.Metric) (scrapeResult, error) {
+	var res scrapeResult
+	stream, format, err := s.readStream(ctx)
 	if err != nil {
-		return err
+		return res, err
 	}
 	defer stream.Close()
 
-	parsed, err := new(expfmt.TextParser).TextToMetricFamilies(stream)
+	var body io.Reader = stream
+	var limited *limitedReader
+	if s.opts.BodySizeLimit > 0 {
+		limited = newLimitedReader(stream, s.opts.BodySizeLimit)
+		body = limited
+	}
+
+	parsed, err := parse(body, format, s.opts)
+	if limited != nil {
+		// a truncated body fails to parse, report why it was truncated
+		if lerr := limited.check(); lerr != nil {
+			return res, lerr
+		}
+	}
 	if err != nil {
-		return errors.Wrapf(err, "parsing message failed")
+		return res, errors.Wrapf(err, "parsing message failed")
 	}
 
 	for _, mf := range parsed {
+		for _, m := range mf.Metric {
+			n := countSamples(mf.GetType(), m)
+			res.scraped += n
+			if hasValue(mf.GetType(), m) {
+				res.kept += n
+			}
+		}
+	}
+	if s.opts.SampleLimit > 0 && res.scraped > s.opts.SampleLimit {
+		res.kept = 0
+		return res, errors.Errorf("sample limit of %d exceeded with %d samples", s.opts.SampleLimit, res.scraped)
+	}
+
+	applyTargetLabels(parsed, s.labels, s.opts.HonorLabels)
+	for _, mf := range parsed {
+		if healthMetrics[mf.GetName()] {
+			// the registry would reject them next to the health metrics
+			mf.Name = proto.String(exportedPrefix + mf.GetName())
+		}
+		if !s.opts.Names.Claim(mf) {
+			log.Error("dropping metric %q of %q, it conflicts with another target or collector", mf.GetName(), s.Name())
+			for _, m := range mf.Metric {
+				if hasValue(mf.GetType(), m) {
+					res.kept -= countSamples(mf.GetType(), m)
+				}
+			}
+			continue
+		}
 		convertMetricFamily(mf, ch)
 	}
 
-	return nil
+	return res, nil
+}
+
+// countSamples returns the number of samples metric has in the text format.
+// Histograms and summaries have one per bucket or quantile plus their sum and
+// count
+func countSamples(t dto.MetricType, metric *dto.Metric) int {
+	switch {
+	case metric == nil:
+		return 0
+	case t == dto.MetricType_SUMMARY:
+		return len(metric.GetSummary().GetQuantile()) + 2
+	case t == dto.MetricType_HISTOGRAM:
+		n := len(metric.GetHistogram().GetBucket()) + 2
+		for _, b := range metric.GetHistogram().GetBucket() {
+			if math.IsInf(b.GetUpperBound(), +1) {
+				return n
+			}
+		}
+		// the +Inf bucket is implied in protobuf
+		return n + 1
+	}
+	return 1
+}
+
+// parse decodes the metric families in r. Responses which are neither
+// delimited protobuf nor OpenMetrics are parsed as text
+func parse(r io.Reader, format expfmt.Format, opts ScraperOpts) ([]*dto.MetricFamily, error) {
+	if format == fmtOpenMetrics {
+		return parseOpenMetrics(r, opts)
+	}
+	if format != expfmt.FmtProtoDelim {
+		parsed, err := new(expfmt.TextParser).TextToMetricFamilies(r)
+		if err != nil {
+			return nil, err
+		}
+		mfs := make([]*dto.MetricFamily, 0, len(parsed))
+		for _, mf := range parsed {
+			mfs = append(mfs, mf)
+		}
+		return mfs, nil
+	}
+
+	mfs := []*dto.MetricFamily{}
+	dec := expfmt.NewDecoder(r, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			return mfs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		mfs = append(mfs, mf)
+	}
 }
 
 // Name returns the name of this scraper
@@ -180,6 +562,11 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 	}
 
 	for _, metric := range metricFamily.Metric {
+		if !hasValue(metricFamily.GetType(), metric) {
+			log.Error("metric of %q has no %s value", metricFamily.GetName(), metricFamily.GetType())
+			continue
+		}
+
 		labels := metric.GetLabel()
 		var names []string
 		var values []string
@@ -262,3 +649,17 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 		}
 	}
 }
+
+// hasValue reports whether metric has a value of type t. The text parser
+// guarantees this, protobuf payloads may not
+func hasValue(t dto.MetricType, metric *dto.Metric) bool {
+	switch {
+	case metric == nil:
+		return false
+	case t == dto.MetricType_SUMMARY:
+		return metric.Summary != nil
+	case t == dto.MetricType_HISTOGRAM:
+		return metric.Histogram != nil
+	}
+	return true
+}
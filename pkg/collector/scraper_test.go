@@ -0,0 +1,223 @@
+package collector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testFamilies = []*dto.MetricFamily{
+	{
+		Name: proto.String("requests_total"),
+		Help: proto.String("Requests served."),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{
+			Label:   []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}},
+			Counter: &dto.Counter{Value: proto.Float64(42)},
+		}},
+	},
+	{
+		Name: proto.String("latency_seconds"),
+		Help: proto.String("Request latency."),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{{
+			Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(3),
+				SampleSum:   proto.Float64(1.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)},
+				},
+			},
+		}},
+	},
+}
+
+// serveFamilies serves testFamilies in the format negotiated with the scraper
+// and records the Accept header it was sent
+func serveFamilies(t *testing.T, accept *string, gzipped bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*accept = r.Header.Get("Accept")
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+
+		var buf bytes.Buffer
+		enc := expfmt.NewEncoder(&buf, format)
+		for _, mf := range testFamilies {
+			require.NoError(t, enc.Encode(mf))
+		}
+
+		if !gzipped {
+			w.Write(buf.Bytes())
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(buf.Bytes())
+		gz.Close()
+	}))
+}
+
+// gatherScraper registers s and returns the gathered families by name
+func gatherScraper(t *testing.T, s *Scraper) map[string]*dto.MetricFamily {
+	return gatherScrapers(t, s)
+}
+
+// gatherScrapers registers all scrapers and returns the gathered families by
+// name
+func gatherScrapers(t *testing.T, scrapers ...*Scraper) map[string]*dto.MetricFamily {
+	reg := prometheus.NewRegistry()
+	for _, s := range scrapers {
+		require.NoError(t, reg.Register(s))
+	}
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	res := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		res[mf.GetName()] = mf
+	}
+	return res
+}
+
+func TestScraperNegotiatesProtobuf(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		var accept string
+		srv := serveFamilies(t, &accept, gzipped)
+
+		s, err := NewScraper("app", srv.URL, time.Second)
+		require.NoError(t, err)
+		mfs := gatherScraper(t, s)
+		srv.Close()
+
+		assert.True(t, strings.HasPrefix(accept, expfmt.ProtoType), accept)
+		require.Contains(t, mfs, "requests_total")
+		assert.Equal(t, 42.0, mfs["requests_total"].Metric[0].GetCounter().GetValue())
+		require.Contains(t, mfs, "latency_seconds")
+		assert.Equal(t, uint64(3), mfs["latency_seconds"].Metric[0].GetHistogram().GetSampleCount())
+		assert.Equal(t, 1.0, mfs["up"].Metric[0].GetGauge().GetValue())
+	}
+}
+
+func TestParseFallsBackToText(t *testing.T) {
+	text := "# TYPE up gauge\nup 1\n# TYPE requests_total counter\nrequests_total 3\n"
+
+	for _, format := range []expfmt.Format{expfmt.FmtText, expfmt.FmtUnknown} {
+		mfs, err := parse(strings.NewReader(text), format, ScraperOpts{})
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, mf := range mfs {
+			names = append(names, mf.GetName())
+		}
+		sort.Strings(names)
+		assert.Equal(t, []string{"requests_total", "up"}, names)
+	}
+}
+
+func TestParseProtobuf(t *testing.T) {
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, mf := range testFamilies {
+		require.NoError(t, enc.Encode(mf))
+	}
+
+	mfs, err := parse(&buf, expfmt.FmtProtoDelim, ScraperOpts{})
+	require.NoError(t, err)
+	require.Len(t, mfs, len(testFamilies))
+	for i, mf := range mfs {
+		assert.True(t, proto.Equal(testFamilies[i], mf), mf.GetName())
+	}
+
+	_, err = parse(strings.NewReader("up 1\n"), expfmt.FmtProtoDelim, ScraperOpts{})
+	assert.Error(t, err)
+}
+
+func TestScrapersDropConflictingFamilies(t *testing.T) {
+	serve := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", string(expfmt.FmtText))
+			w.Write([]byte(body))
+		}))
+	}
+	a := serve("# HELP http_requests_total A.\n# TYPE http_requests_total counter\nhttp_requests_total 1\nnode_load1 1\n")
+	defer a.Close()
+	b := serve("# HELP http_requests_total B.\n# TYPE http_requests_total counter\nhttp_requests_total 2\n")
+	defer b.Close()
+
+	names := NewFamilyNames()
+	names.Add([]*dto.MetricFamily{{Name: proto.String("node_load1")}})
+	sa, err := NewScraper("a", a.URL, time.Second, WithJob("a"), WithScrapeFamilyNames(names))
+	require.NoError(t, err)
+	sb, err := NewScraper("b", b.URL, time.Second, WithJob("b"), WithScrapeFamilyNames(names))
+	require.NoError(t, err)
+	mfs := gatherScrapers(t, sa, sb)
+
+	assert.NotContains(t, mfs, "node_load1")
+	require.Len(t, mfs["http_requests_total"].Metric, 1)
+	winner := labelValue(mfs["http_requests_total"].Metric[0], "job")
+	assert.Equal(t, map[string]string{"a": "A.", "b": "B."}[winner], mfs["http_requests_total"].GetHelp())
+
+	kept := map[string]float64{}
+	for _, m := range mfs["scrape_samples_post_metric_relabeling"].Metric {
+		kept[labelValue(m, "job")] = m.GetGauge().GetValue()
+	}
+	// node_load1 of a is always dropped
+	assert.Equal(t, map[string]float64{"a": 1, "b": 0}[winner], kept["a"])
+	assert.Equal(t, map[string]float64{"a": 0, "b": 1}[winner], kept["b"])
+}
+
+func TestConvertMetricFamilySkipsMissingValues(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name:   proto.String("broken"),
+		Type:   dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+	}
+
+	ch := make(chan prometheus.Metric, 1)
+	convertMetricFamily(mf, ch)
+	assert.Len(t, ch, 0)
+}
+
+func TestScraperReportsHealthMetrics(t *testing.T) {
+	var accept string
+	srv := serveFamilies(t, &accept, false)
+	defer srv.Close()
+
+	s, err := NewScraper("app", srv.URL, time.Second, WithJob("api"))
+	require.NoError(t, err)
+	down, err := NewScraper("down", "http://127.0.0.1:1", time.Second)
+	require.NoError(t, err)
+	mfs := gatherScrapers(t, s, down)
+
+	values := map[string]float64{}
+	for _, name := range []string{"up", "scrape_samples_scraped", "scrape_samples_post_metric_relabeling", "scrape_duration_seconds"} {
+		require.Contains(t, mfs, name)
+		require.Len(t, mfs[name].Metric, 2, name)
+		for _, m := range mfs[name].Metric {
+			values[name+"/"+labelValue(m, "job")] = m.GetGauge().GetValue()
+		}
+	}
+
+	assert.Equal(t, 1.0, values["up/api"])
+	assert.Equal(t, 0.0, values["up/down"])
+	// a counter, a histogram with one bucket, the implied +Inf bucket, sum
+	// and count
+	assert.Equal(t, 5.0, values["scrape_samples_scraped/api"])
+	assert.Equal(t, 5.0, values["scrape_samples_post_metric_relabeling/api"])
+	assert.Equal(t, 0.0, values["scrape_samples_scraped/down"])
+	assert.True(t, values["scrape_duration_seconds/api"] > 0)
+	assert.NotContains(t, mfs, "app_scrape_collector_success")
+	assert.NotContains(t, mfs, "app_scrape_collector_duration_seconds")
+}
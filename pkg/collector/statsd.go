@@ -0,0 +1,693 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// DefaultStatsDMaxSeries is the number of series kept when no limit is
+	// configured
+	DefaultStatsDMaxSeries = 10000
+
+	// statsdNamespace prefixes the metrics about the listener, received
+	// names may not use it
+	statsdNamespace = "statsd"
+
+	statsdMaxPacketSize = 65535
+	statsdMaxLineSize   = 64 * 1024
+
+	statsdCounter   = "c"
+	statsdGauge     = "g"
+	statsdTimer     = "ms"
+	statsdHistogram = "h"
+	statsdDistrib   = "d"
+	statsdSet       = "s"
+
+	// reasons for dropping a StatsD line
+	dropMalformed     = "malformed"
+	dropUnsupported   = "unsupported"
+	dropTypeConflict  = "type_conflict"
+	dropLabelConflict = "label_conflict"
+	dropSeriesLimit   = "series_limit"
+	dropNameConflict  = "name_conflict"
+)
+
+var (
+	metricNameRe  = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	statsdLabelRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	statsdHelp = map[statsdKind]string{
+		statsdKindCounter:   "Counter received over StatsD.",
+		statsdKindGauge:     "Gauge received over StatsD.",
+		statsdKindHistogram: "Timer or histogram received over StatsD. Timers are in seconds.",
+		statsdKindSet:       "Number of unique values of a StatsD set since the previous collection.",
+	}
+)
+
+// statsdKind is the kind of metric a StatsD type is aggregated into
+type statsdKind int
+
+const (
+	statsdKindCounter statsdKind = iota
+	statsdKindGauge
+	statsdKindHistogram
+	statsdKindSet
+)
+
+// StatsDMapping turns StatsD names matching a pattern into a metric name and
+// labels. Every * in Match matches one dot separated component of the name
+// and can be referred to as $1, $2... in Name and the label values. Use ${1}
+// when the reference is followed by a letter, digit or underscore
+type StatsDMapping struct {
+	Match  string
+	Name   string
+	Labels map[string]string
+}
+
+// StatsDMapper applies the first matching mapping to a StatsD name
+type StatsDMapper struct {
+	rules []statsdRule
+}
+
+type statsdRule struct {
+	re     *regexp.Regexp
+	name   string
+	labels map[string]string
+}
+
+// NewStatsDMapper compiles mappings. They are tried in order
+func NewStatsDMapper(mappings ...StatsDMapping) (*StatsDMapper, error) {
+	m := &StatsDMapper{}
+	for _, mapping := range mappings {
+		if mapping.Match == "" || mapping.Name == "" {
+			return nil, errors.Errorf("mapping %q must have a match and a name", mapping.Match)
+		}
+
+		parts := strings.Split(mapping.Match, ".")
+		for i, p := range parts {
+			if p == "" {
+				return nil, errors.Errorf("mapping %q has an empty component", mapping.Match)
+			}
+			if p == "*" {
+				parts[i] = `([^.]+)`
+				continue
+			}
+			if strings.Contains(p, "*") {
+				return nil, errors.Errorf("mapping %q may only use * for whole components", mapping.Match)
+			}
+			parts[i] = regexp.QuoteMeta(p)
+		}
+
+		for name := range mapping.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				return nil, errors.Errorf("mapping %q has invalid label name %q", mapping.Match, name)
+			}
+		}
+
+		m.rules = append(m.rules, statsdRule{
+			re:     regexp.MustCompile("^" + strings.Join(parts, `\.`) + "$"),
+			name:   mapping.Name,
+			labels: mapping.Labels,
+		})
+	}
+	return m, nil
+}
+
+// Map returns the metric name and labels of a StatsD name. Names without a
+// matching mapping have their dots replaced with underscores
+func (m *StatsDMapper) Map(name string) (string, map[string]string) {
+	if m != nil {
+		for _, r := range m.rules {
+			match := r.re.FindStringSubmatchIndex(name)
+			if match == nil {
+				continue
+			}
+			expand := func(tmpl string) string {
+				return string(r.re.ExpandString(nil, tmpl, name, match))
+			}
+			labels := make(map[string]string, len(r.labels))
+			for k, v := range r.labels {
+				labels[k] = expand(v)
+			}
+			return sanitizeMetricName(expand(r.name)), labels
+		}
+	}
+	return sanitizeMetricName(name), map[string]string{}
+}
+
+func sanitizeMetricName(name string) string {
+	name = metricNameRe.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// statsdLine is a single parsed StatsD sample
+type statsdLine struct {
+	name  string
+	value float64
+	// delta is set for gauges updated with a leading + or -
+	delta bool
+	set   string
+	typ   string
+	rate  float64
+	tags  map[string]string
+}
+
+// parseStatsDLine parses name:value|type[|@rate][|#tag:value,...]. The
+// DogStatsD tags are optional
+func parseStatsDLine(line string) (statsdLine, string, error) {
+	l := statsdLine{rate: 1, tags: map[string]string{}}
+	if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return l, dropUnsupported, errors.New("events and service checks are not supported")
+	}
+
+	colon := strings.LastIndex(line[:pipeIndex(line)], ":")
+	if colon <= 0 {
+		return l, dropMalformed, errors.Errorf("line %q has no name", line)
+	}
+	l.name = line[:colon]
+
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return l, dropMalformed, errors.Errorf("line %q has no type", line)
+	}
+	raw := fields[0]
+	l.typ = fields[1]
+
+	switch l.typ {
+	case statsdSet:
+		l.set = raw
+	case statsdCounter, statsdGauge, statsdTimer, statsdHistogram, statsdDistrib:
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return l, dropMalformed, errors.Errorf("line %q has invalid value", line)
+		}
+		l.value = v
+		l.delta = l.typ == statsdGauge && (raw[0] == '+' || raw[0] == '-')
+	default:
+		return l, dropUnsupported, errors.Errorf("line %q has unsupported type %q", line, l.typ)
+	}
+
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return l, dropMalformed, errors.Errorf("line %q has invalid sample rate", line)
+			}
+			l.rate = rate
+		case strings.HasPrefix(f, "#"):
+			for _, tag := range strings.Split(f[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) != 2 || kv[1] == "" {
+					continue
+				}
+				name := statsdLabelRe.ReplaceAllString(kv[0], "_")
+				if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+					continue
+				}
+				l.tags[name] = kv[1]
+			}
+		}
+	}
+	return l, "", nil
+}
+
+// pipeIndex returns the index of the first | of line or its length
+func pipeIndex(line string) int {
+	if i := strings.Index(line, "|"); i >= 0 {
+		return i
+	}
+	return len(line)
+}
+
+// StatsDOpts configure the listeners and the aggregation of a StatsD
+// collector
+type StatsDOpts struct {
+	UDPAddr   string
+	TCPAddr   string
+	Mapper    *StatsDMapper
+	Buckets   []float64
+	MaxSeries int
+
+	// Names are the families gathered before the StatsD collector. Received
+	// names which are in it are dropped
+	Names *FamilyNames
+}
+
+// StatsDOptFn allows for overriding options
+type StatsDOptFn func(*StatsDOpts)
+
+// WithStatsDUDPAddress listens for StatsD packets on addr, e.g. :8125
+func WithStatsDUDPAddress(addr string) StatsDOptFn {
+	return func(o *StatsDOpts) {
+		o.UDPAddr = addr
+	}
+}
+
+// WithStatsDTCPAddress accepts newline separated StatsD lines on addr
+func WithStatsDTCPAddress(addr string) StatsDOptFn {
+	return func(o *StatsDOpts) {
+		o.TCPAddr = addr
+	}
+}
+
+// WithStatsDMapper maps StatsD names to metric names and labels
+func WithStatsDMapper(m *StatsDMapper) StatsDOptFn {
+	return func(o *StatsDOpts) {
+		o.Mapper = m
+	}
+}
+
+// WithStatsDBuckets sets the upper bounds of the buckets of the histograms
+// created for timers and histograms. Timers are observed in seconds
+func WithStatsDBuckets(buckets []float64) StatsDOptFn {
+	return func(o *StatsDOpts) {
+		o.Buckets = buckets
+	}
+}
+
+// WithStatsDMaxSeries limits the number of series kept. Lines for new series
+// are dropped once it is reached
+func WithStatsDMaxSeries(n int) StatsDOptFn {
+	return func(o *StatsDOpts) {
+		o.MaxSeries = n
+	}
+}
+
+// WithStatsDFamilyNames drops received names which other collectors already
+// reported
+func WithStatsDFamilyNames(n *FamilyNames) StatsDOptFn {
+	return func(o *StatsDOpts) {
+		o.Names = n
+	}
+}
+
+// StatsD listens for StatsD and DogStatsD lines and aggregates them until
+// they are collected. Counters, timers and histograms are cumulative, gauges
+// keep their last value and sets report the number of unique values since
+// the previous collection
+type StatsD struct {
+	opts StatsDOpts
+
+	udp net.PacketConn
+	tcp net.Listener
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	families map[string]*statsdFamily
+	series   int
+	conns    map[net.Conn]struct{}
+	closed   bool
+
+	events  *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+}
+
+type statsdFamily struct {
+	kind       statsdKind
+	labelNames []string
+	desc       *prometheus.Desc
+	series     map[string]*statsdSeries
+}
+
+type statsdSeries struct {
+	labelValues []string
+	value       float64
+	count       uint64
+	sum         float64
+	// buckets holds the number of observations per bucket, not cumulative
+	buckets []uint64
+	set     map[string]struct{}
+}
+
+// NewStatsD creates a StatsD collector and starts listening on the configured
+// addresses
+func NewStatsD(opts ...StatsDOptFn) (*StatsD, error) {
+	o := StatsDOpts{
+		Buckets:   prometheus.DefBuckets,
+		MaxSeries: DefaultStatsDMaxSeries,
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	if o.UDPAddr == "" && o.TCPAddr == "" {
+		return nil, errors.New("statsd needs a UDP or TCP address")
+	}
+	if o.MaxSeries <= 0 {
+		return nil, errors.New("statsd max series must be positive")
+	}
+	if len(o.Buckets) == 0 {
+		return nil, errors.New("statsd needs at least one bucket")
+	}
+	for i := 1; i < len(o.Buckets); i++ {
+		if o.Buckets[i] <= o.Buckets[i-1] {
+			return nil, errors.New("statsd buckets must be in increasing order")
+		}
+	}
+
+	s := &StatsD{
+		opts:     o,
+		families: map[string]*statsdFamily{},
+		conns:    map[net.Conn]struct{}{},
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: statsdNamespace,
+			Name:      "events_total",
+			Help:      "Number of StatsD lines received, by type.",
+		}, []string{"type"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: statsdNamespace,
+			Name:      "events_dropped_total",
+			Help:      "Number of StatsD lines dropped, by reason.",
+		}, []string{"reason"}),
+	}
+
+	var err error
+	if o.UDPAddr != "" {
+		if s.udp, err = net.ListenPacket("udp", o.UDPAddr); err != nil {
+			return nil, errors.Wrap(err, "failed to listen for statsd over udp")
+		}
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+	if o.TCPAddr != "" {
+		if s.tcp, err = net.Listen("tcp", o.TCPAddr); err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "failed to listen for statsd over tcp")
+		}
+		s.wg.Add(1)
+		go s.serveTCP()
+	}
+	return s, nil
+}
+
+// UDPAddr returns the address StatsD packets are received on or nil
+func (s *StatsD) UDPAddr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// TCPAddr returns the address StatsD connections are accepted on or nil
+func (s *StatsD) TCPAddr() net.Addr {
+	if s.tcp == nil {
+		return nil
+	}
+	return s.tcp.Addr()
+}
+
+// Close stops the listeners and waits for open connections to be closed
+func (s *StatsD) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+func (s *StatsD) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, statsdMaxPacketSize)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !s.isClosed() {
+				log.Error("failed to read statsd packet: %v", err)
+			}
+			return
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			s.handle(string(line))
+		}
+	}
+}
+
+func (s *StatsD) serveTCP() {
+	defer s.wg.Done()
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			if !s.isClosed() {
+				log.Error("failed to accept statsd connection: %v", err)
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+func (s *StatsD) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	sc := bufio.NewScanner(c)
+	sc.Buffer(make([]byte, 4096), statsdMaxLineSize)
+	for sc.Scan() {
+		s.handle(sc.Text())
+	}
+	if err := sc.Err(); err != nil && !s.isClosed() {
+		log.Error("statsd connection from %s failed: %v", c.RemoteAddr(), err)
+	}
+}
+
+func (s *StatsD) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// handle parses and aggregates a single line
+func (s *StatsD) handle(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	// malformed lines are only counted, logging them would let a single
+	// client flood the log
+	l, reason, err := parseStatsDLine(line)
+	if err != nil {
+		s.dropped.WithLabelValues(reason).Inc()
+		return
+	}
+	s.events.WithLabelValues(l.typ).Inc()
+
+	if reason := s.observe(l); reason != "" {
+		s.dropped.WithLabelValues(reason).Inc()
+	}
+}
+
+// observe adds l to its series. The reason is returned if it was dropped
+func (s *StatsD) observe(l statsdLine) string {
+	name, labels := s.opts.Mapper.Map(l.name)
+	for k, v := range l.tags {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	if name == "" {
+		return dropMalformed
+	}
+
+	kind := statsdKindCounter
+	switch l.typ {
+	case statsdGauge:
+		kind = statsdKindGauge
+	case statsdTimer, statsdHistogram, statsdDistrib:
+		kind = statsdKindHistogram
+	case statsdSet:
+		kind = statsdKindSet
+	}
+
+	labelNames := make([]string, 0, len(labels))
+	for k, v := range labels {
+		// tags and mapping captures are copied from the line, the registry
+		// fails the whole gather on values which are not valid UTF-8
+		if !utf8.ValidString(v) {
+			return dropMalformed
+		}
+		if v != "" {
+			labelNames = append(labelNames, k)
+		}
+	}
+	sort.Strings(labelNames)
+	labelValues := make([]string, len(labelNames))
+	for i, k := range labelNames {
+		labelValues[i] = labels[k]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.families[name]
+	if !ok {
+		if s.reserved(name) {
+			return dropNameConflict
+		}
+		f = &statsdFamily{
+			kind:       kind,
+			labelNames: labelNames,
+			desc:       prometheus.NewDesc(name, statsdHelp[kind], labelNames, nil),
+			series:     map[string]*statsdSeries{},
+		}
+	} else if f.kind != kind {
+		return dropTypeConflict
+	} else if strings.Join(f.labelNames, ",") != strings.Join(labelNames, ",") {
+		return dropLabelConflict
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	ser, ok := f.series[key]
+	if !ok {
+		if s.series >= s.opts.MaxSeries {
+			return dropSeriesLimit
+		}
+		ser = &statsdSeries{labelValues: labelValues}
+		switch kind {
+		case statsdKindHistogram:
+			ser.buckets = make([]uint64, len(s.opts.Buckets))
+		case statsdKindSet:
+			ser.set = map[string]struct{}{}
+		}
+		s.families[name] = f
+		f.series[key] = ser
+		s.series++
+	}
+
+	switch kind {
+	case statsdKindCounter:
+		if l.value < 0 {
+			return dropMalformed
+		}
+		ser.value += l.value / l.rate
+	case statsdKindGauge:
+		if l.delta {
+			ser.value += l.value
+		} else {
+			ser.value = l.value
+		}
+	case statsdKindHistogram:
+		v := l.value
+		if l.typ == statsdTimer {
+			v /= 1000
+		}
+		n := uint64(1/l.rate + 0.5)
+		ser.count += n
+		ser.sum += v * float64(n)
+		if i := sort.SearchFloat64s(s.opts.Buckets, v); i < len(ser.buckets) {
+			ser.buckets[i] += n
+		}
+	case statsdKindSet:
+		ser.set[l.set] = struct{}{}
+	}
+	return ""
+}
+
+// reserved reports whether name belongs to the metrics about the listener or
+// to another collector
+func (s *StatsD) reserved(name string) bool {
+	return strings.HasPrefix(name, statsdNamespace+"_") || s.opts.Names.Contains(name)
+}
+
+// Describe implements prometheus.Collector. Only the metrics about the
+// listener are described, the received ones are not known in advance
+func (s *StatsD) Describe(ch chan<- *prometheus.Desc) {
+	s.events.Describe(ch)
+	s.dropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (s *StatsD) Collect(ch chan<- prometheus.Metric) {
+	s.events.Collect(ch)
+	s.dropped.Collect(ch)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, f := range s.families {
+		// another collector may have reported the name since the family was
+		// created, it is dropped so the name can no longer be received
+		if s.reserved(name) {
+			log.Error("dropping statsd metric %q, another collector reports it", name)
+			s.series -= len(f.series)
+			delete(s.families, name)
+			continue
+		}
+		for _, ser := range f.series {
+			switch f.kind {
+			case statsdKindCounter:
+				ch <- prometheus.MustNewConstMetric(f.desc, prometheus.CounterValue, ser.value, ser.labelValues...)
+			case statsdKindGauge:
+				ch <- prometheus.MustNewConstMetric(f.desc, prometheus.GaugeValue, ser.value, ser.labelValues...)
+			case statsdKindHistogram:
+				buckets := make(map[float64]uint64, len(s.opts.Buckets))
+				var cum uint64
+				for i, b := range s.opts.Buckets {
+					cum += ser.buckets[i]
+					buckets[b] = cum
+				}
+				ch <- prometheus.MustNewConstHistogram(f.desc, ser.count, ser.sum, buckets, ser.labelValues...)
+			case statsdKindSet:
+				ch <- prometheus.MustNewConstMetric(f.desc, prometheus.GaugeValue, float64(len(ser.set)), ser.labelValues...)
+				ser.set = map[string]struct{}{}
+			}
+		}
+	}
+}
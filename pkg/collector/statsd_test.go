@@ -0,0 +1,277 @@
+package collector
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatherStatsD returns the families of s by name
+func gatherStatsD(t *testing.T, s *StatsD) map[string]*dto.MetricFamily {
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	res := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		res[mf.GetName()] = mf
+	}
+	return res
+}
+
+// waitForEvents waits until the received and dropped lines of s add up to n.
+// Lines dropped after parsing count twice. Only the counters are collected so
+// sets are not reset
+func waitForEvents(t *testing.T, s *StatsD, n float64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ch := make(chan prometheus.Metric, 100)
+		s.events.Collect(ch)
+		s.dropped.Collect(ch)
+		close(ch)
+
+		total := 0.0
+		for m := range ch {
+			var pb dto.Metric
+			require.NoError(t, m.Write(&pb))
+			total += pb.GetCounter().GetValue()
+		}
+		if total >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("statsd did not receive %v lines", n)
+}
+
+func TestParseStatsDLine(t *testing.T) {
+	l, _, err := parseStatsDLine("api.requests:2|c|@0.5|#env:prod,region:nyc3,novalue")
+	require.NoError(t, err)
+	assert.Equal(t, "api.requests", l.name)
+	assert.Equal(t, 2.0, l.value)
+	assert.Equal(t, statsdCounter, l.typ)
+	assert.Equal(t, 0.5, l.rate)
+	assert.Equal(t, map[string]string{"env": "prod", "region": "nyc3"}, l.tags)
+
+	l, _, err = parseStatsDLine("queue.depth:-3|g")
+	require.NoError(t, err)
+	assert.True(t, l.delta)
+
+	l, _, err = parseStatsDLine("users:alice|s")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", l.set)
+
+	invalid := map[string]string{
+		"requests":              dropMalformed,
+		"requests:1":            dropMalformed,
+		"requests:abc|c":        dropMalformed,
+		"requests:1|c|@2":       dropMalformed,
+		"requests:1|x":          dropUnsupported,
+		"_sc|redis.can_connect": dropUnsupported,
+	}
+	for line, want := range invalid {
+		_, reason, err := parseStatsDLine(line)
+		assert.Error(t, err, line)
+		assert.Equal(t, want, reason, line)
+	}
+}
+
+func TestStatsDMapper(t *testing.T) {
+	m, err := NewStatsDMapper(
+		StatsDMapping{Match: "api.*.requests", Name: "api_requests_total", Labels: map[string]string{"endpoint": "$1"}},
+		StatsDMapping{Match: "*.*.latency", Name: "${1}_latency", Labels: map[string]string{"host": "$2"}},
+	)
+	require.NoError(t, err)
+
+	name, labels := m.Map("api.users.requests")
+	assert.Equal(t, "api_requests_total", name)
+	assert.Equal(t, map[string]string{"endpoint": "users"}, labels)
+
+	name, labels = m.Map("db.web-1.latency")
+	assert.Equal(t, "db_latency", name)
+	assert.Equal(t, map[string]string{"host": "web-1"}, labels)
+
+	name, labels = m.Map("api.users.errors")
+	assert.Equal(t, "api_users_errors", name)
+	assert.Empty(t, labels)
+
+	invalid := []StatsDMapping{
+		{Match: "api.*"},
+		{Match: "api..requests", Name: "a"},
+		{Match: "api.user*", Name: "a"},
+		{Match: "api.*", Name: "a", Labels: map[string]string{"__name__": "$1"}},
+	}
+	for _, mapping := range invalid {
+		_, err := NewStatsDMapper(mapping)
+		assert.Error(t, err, mapping.Match)
+	}
+}
+
+func TestStatsDAggregatesUDP(t *testing.T) {
+	mapper, err := NewStatsDMapper(StatsDMapping{
+		Match: "api.*.requests", Name: "api_requests_total", Labels: map[string]string{"endpoint": "$1"},
+	})
+	require.NoError(t, err)
+	s, err := NewStatsD(WithStatsDUDPAddress("127.0.0.1:0"), WithStatsDMapper(mapper),
+		WithStatsDBuckets([]float64{0.1, 1}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("udp", s.UDPAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	lines := []string{
+		"api.users.requests:1|c\napi.users.requests:1|c|@0.5",
+		"api.orders.requests:3|c",
+		"queue.depth:10|g\nqueue.depth:-4|g",
+		"db.query:50|ms|#db:users\ndb.query:500|ms|#db:users\ndb.query:5000|ms|#db:users",
+		"visitors:alice|s\nvisitors:bob|s\nvisitors:alice|s",
+		"queue.depth:1|c",
+		"garbage",
+	}
+	for _, l := range lines {
+		_, err := conn.Write([]byte(l))
+		require.NoError(t, err)
+	}
+	waitForEvents(t, s, 14)
+
+	mfs := gatherStatsD(t, s)
+	requests := map[string]float64{}
+	for _, m := range mfs["api_requests_total"].Metric {
+		requests[labelValue(m, "endpoint")] = m.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"users": 3, "orders": 3}, requests)
+	assert.Equal(t, 6.0, mfs["queue_depth"].Metric[0].GetGauge().GetValue())
+
+	h := mfs["db_query"].Metric[0]
+	assert.Equal(t, "users", labelValue(h, "db"))
+	assert.Equal(t, uint64(3), h.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 5.55, h.GetHistogram().GetSampleSum(), 1e-9)
+	assert.Equal(t, uint64(1), h.GetHistogram().Bucket[0].GetCumulativeCount())
+	assert.Equal(t, uint64(2), h.GetHistogram().Bucket[1].GetCumulativeCount())
+
+	assert.Equal(t, 2.0, mfs["visitors"].Metric[0].GetGauge().GetValue())
+	mfs = gatherStatsD(t, s)
+	assert.Equal(t, 0.0, mfs["visitors"].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, 3.0, mfs["api_requests_total"].Metric[0].GetCounter().GetValue())
+
+	dropped := map[string]float64{}
+	for _, m := range mfs["statsd_events_dropped_total"].Metric {
+		dropped[labelValue(m, "reason")] = m.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{dropTypeConflict: 1, dropMalformed: 1}, dropped)
+}
+
+func TestStatsDAcceptsTCP(t *testing.T) {
+	s, err := NewStatsD(WithStatsDTCPAddress("127.0.0.1:0"))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.TCPAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "jobs.done:2|c|#queue:mail\njobs.done:3|c|#queue:mail\n")
+	waitForEvents(t, s, 2)
+
+	m := gatherStatsD(t, s)["jobs_done"].Metric[0]
+	assert.Equal(t, "mail", labelValue(m, "queue"))
+	assert.Equal(t, 5.0, m.GetCounter().GetValue())
+}
+
+func TestStatsDDropsInconsistentSeries(t *testing.T) {
+	s, err := NewStatsD(WithStatsDUDPAddress("127.0.0.1:0"), WithStatsDMaxSeries(2))
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, l := range []string{
+		"jobs:1|c|#queue:mail",
+		"jobs:1|c",
+		"jobs:1|c|#queue:sms",
+		"jobs:1|c|#queue:push",
+	} {
+		s.handle(l)
+	}
+
+	mfs := gatherStatsD(t, s)
+	assert.Len(t, mfs["jobs"].Metric, 2)
+	dropped := map[string]float64{}
+	for _, m := range mfs["statsd_events_dropped_total"].Metric {
+		dropped[labelValue(m, "reason")] = m.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{dropLabelConflict: 1, dropSeriesLimit: 1}, dropped)
+}
+
+func TestStatsDDropsInvalidUTF8(t *testing.T) {
+	mapper, err := NewStatsDMapper(StatsDMapping{
+		Match: "api.*.requests", Name: "api_requests_total", Labels: map[string]string{"endpoint": "$1"},
+	})
+	require.NoError(t, err)
+	s, err := NewStatsD(WithStatsDUDPAddress("127.0.0.1:0"), WithStatsDMapper(mapper))
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, l := range []string{
+		"jobs:1|c|#env:\xff\xfe",
+		"api.\xff.requests:1|c",
+		"jobs:1|c|#env:prod",
+	} {
+		s.handle(l)
+	}
+
+	mfs := gatherStatsD(t, s)
+	require.Len(t, mfs["jobs"].Metric, 1)
+	assert.Equal(t, "prod", labelValue(mfs["jobs"].Metric[0], "env"))
+	assert.NotContains(t, mfs, "api_requests_total")
+	assert.Equal(t, 2.0, mfs["statsd_events_dropped_total"].Metric[0].GetCounter().GetValue())
+}
+
+func TestStatsDDropsNamesOfOtherCollectors(t *testing.T) {
+	names := NewFamilyNames()
+	s, err := NewStatsD(WithStatsDUDPAddress("127.0.0.1:0"), WithStatsDFamilyNames(names))
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.handle("node_load1:1|g")
+	names.Add([]*dto.MetricFamily{{Name: proto.String("up")}, {Name: proto.String("node_load1")}})
+	for _, l := range []string{"up:1|g", "statsd_events_total:1|c", "jobs:1|c"} {
+		s.handle(l)
+	}
+
+	mfs := gatherStatsD(t, s)
+	assert.Contains(t, mfs, "jobs")
+	assert.NotContains(t, mfs, "up")
+	// received before another collector reported it
+	assert.NotContains(t, mfs, "node_load1")
+	assert.Equal(t, "Number of StatsD lines received, by type.", mfs["statsd_events_total"].GetHelp())
+
+	dropped := map[string]float64{}
+	for _, m := range mfs["statsd_events_dropped_total"].Metric {
+		dropped[labelValue(m, "reason")] = m.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{dropNameConflict: 2}, dropped)
+
+	s.handle("node_load1:1|g")
+	assert.NotContains(t, gatherStatsD(t, s), "node_load1")
+}
+
+func TestNewStatsDRejectsInvalidOptions(t *testing.T) {
+	invalid := [][]StatsDOptFn{
+		{},
+		{WithStatsDUDPAddress("127.0.0.1:0"), WithStatsDMaxSeries(0)},
+		{WithStatsDUDPAddress("127.0.0.1:0"), WithStatsDBuckets([]float64{1, 0.5})},
+		{WithStatsDTCPAddress("256.0.0.1:0")},
+	}
+	for i, opts := range invalid {
+		_, err := NewStatsD(opts...)
+		assert.Error(t, err, "case %d", i)
+	}
+}
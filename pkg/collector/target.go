@@ -0,0 +1,69 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	unixScheme     = "unix://"
+	defaultPath    = "/metrics"
+	unixSocketHost = "localhost"
+)
+
+// ParseTarget returns the URL to request the metrics of a target from and, for
+// targets listening on a unix socket, the path of the socket.
+//
+// Targets are either http(s) URLs or unix:///path/to.sock:/metrics/path where
+// the metrics path is optional. Both may carry a query. /metrics is requested
+// when the URL has no path
+func ParseTarget(raw string) (u *url.URL, socket string, err error) {
+	if strings.HasPrefix(raw, unixScheme) {
+		rest := strings.TrimPrefix(raw, unixScheme)
+		path := ""
+		if i := strings.Index(rest, ":/"); i >= 0 {
+			socket, path = rest[:i], rest[i+1:]
+		} else if i := strings.IndexByte(rest, '?'); i >= 0 {
+			socket, path = rest[:i], rest[i:]
+		} else {
+			socket = rest
+		}
+		if !filepath.IsAbs(socket) {
+			return nil, "", errors.Errorf("unix socket path %q must be absolute", socket)
+		}
+		raw = "http://" + unixSocketHost + path
+	}
+
+	u, err = url.Parse(raw)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "invalid target url %q", raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", errors.Errorf("target url %q must use http, https or unix", raw)
+	}
+	if u.Host == "" {
+		return nil, "", errors.Errorf("target url %q has no host", raw)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = defaultPath
+	}
+	return u, socket, nil
+}
@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/pkg/clients"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		raw    string
+		url    string
+		socket string
+	}{
+		{"http://localhost:9100", "http://localhost:9100/metrics", ""},
+		{"http://localhost:9100/", "http://localhost:9100/metrics", ""},
+		{"https://envoy:9901/stats/prometheus", "https://envoy:9901/stats/prometheus", ""},
+		{"http://app:8080/metrics?format=prometheus&x=1", "http://app:8080/metrics?format=prometheus&x=1", ""},
+		{"http://app:8080?module=http", "http://app:8080/metrics?module=http", ""},
+		{"unix:///run/app/metrics.sock", "http://localhost/metrics", "/run/app/metrics.sock"},
+		{"unix:///run/app/metrics.sock:/custom/path", "http://localhost/custom/path", "/run/app/metrics.sock"},
+		{"unix:///run/app/metrics.sock:/stats?filter=a", "http://localhost/stats?filter=a", "/run/app/metrics.sock"},
+		{"unix:///run/app/metrics.sock?filter=a", "http://localhost/metrics?filter=a", "/run/app/metrics.sock"},
+		{"unix:///run/app:v2.sock:/metrics", "http://localhost/metrics", "/run/app:v2.sock"},
+	}
+	for _, test := range tests {
+		u, socket, err := ParseTarget(test.raw)
+		require.NoError(t, err, test.raw)
+		assert.Equal(t, test.url, u.String(), test.raw)
+		assert.Equal(t, test.socket, socket, test.raw)
+	}
+
+	for _, raw := range []string{"unix://run/app.sock", "ftp://host/metrics", "localhost:9100", "http://"} {
+		_, _, err := ParseTarget(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestScraperUsesHTTPClient(t *testing.T) {
+	var requested string
+	client := &clients.FakeHTTPClient{
+		DoFunc: func(r *http.Request) (*http.Response, error) {
+			requested = r.URL.String()
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/plain; version=0.0.4"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("# TYPE up gauge\nup 1\n")),
+			}, nil
+		},
+	}
+
+	s, err := NewScraper("envoy", "http://envoy:9901/stats/prometheus?usedonly", time.Second, WithHTTPClient(client))
+	require.NoError(t, err)
+	mfs := gatherScraper(t, s)
+
+	assert.Equal(t, "http://envoy:9901/stats/prometheus?usedonly", requested)
+	assert.Contains(t, mfs, "exported_up")
+}
+
+func TestScraperUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scraper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "metrics.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	var path string
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.RequestURI()
+		w.Write([]byte("sidecar_up 1\n"))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	s, err := NewScraper("sidecar", "unix://"+socket+":/custom/path?x=1", time.Second)
+	require.NoError(t, err)
+	mfs := gatherScraper(t, s)
+
+	assert.Equal(t, "/custom/path?x=1", path)
+	assert.Contains(t, mfs, "sidecar_up")
+}
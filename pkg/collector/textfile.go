@@ -0,0 +1,227 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	"github.com/digitalocean/metrics-agent/internal/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	textfileNamespace = "textfile"
+	textfileExt       = ".prom"
+
+	// DefaultTextfileMaxFileSize is the size above which a file is skipped
+	// when no limit is configured
+	DefaultTextfileMaxFileSize = 1 << 20
+
+	// DefaultTextfileMaxSeries is the number of series above which a file is
+	// skipped when no limit is configured
+	DefaultTextfileMaxSeries = 10000
+)
+
+var (
+	textfileMtimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(textfileNamespace, "", "mtime_seconds"),
+		"Modification time of a textfile.",
+		[]string{"file"}, nil,
+	)
+	textfileErrorDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(textfileNamespace, "", "error"),
+		"Whether a textfile could not be read, failed to parse, exceeded a limit or conflicted with another file or collector.",
+		[]string{"file"}, nil,
+	)
+	textfileStaleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(textfileNamespace, "", "stale"),
+		"Whether a textfile is older than the staleness window and its metrics are ignored.",
+		[]string{"file"}, nil,
+	)
+)
+
+// TextfileOpts limit the textfiles read by a collector
+type TextfileOpts struct {
+	MaxFileSize int64
+	MaxSeries   int
+
+	// Staleness is the age after which the metrics of a file are ignored,
+	// 0 never ignores them
+	Staleness time.Duration
+
+	// Names are the families gathered before the textfile collector. Files
+	// reporting one of them are skipped
+	Names *FamilyNames
+}
+
+// TextfileOptFn allows for overriding options
+type TextfileOptFn func(*TextfileOpts)
+
+// WithTextfileMaxFileSize skips files larger than n bytes
+func WithTextfileMaxFileSize(n int64) TextfileOptFn {
+	return func(o *TextfileOpts) {
+		o.MaxFileSize = n
+	}
+}
+
+// WithTextfileMaxSeries skips files with more than n series
+func WithTextfileMaxSeries(n int) TextfileOptFn {
+	return func(o *TextfileOpts) {
+		o.MaxSeries = n
+	}
+}
+
+// WithTextfileStaleness ignores the metrics of files not modified within d
+func WithTextfileStaleness(d time.Duration) TextfileOptFn {
+	return func(o *TextfileOpts) {
+		o.Staleness = d
+	}
+}
+
+// WithTextfileFamilyNames skips files reporting families which other
+// collectors already reported
+func WithTextfileFamilyNames(n *FamilyNames) TextfileOptFn {
+	return func(o *TextfileOpts) {
+		o.Names = n
+	}
+}
+
+// NewTextfileCollector creates a collector reading the *.prom files in dir.
+// They are read in the Prometheus text format on every collection
+func NewTextfileCollector(dir string, opts ...TextfileOptFn) (*TextfileCollector, error) {
+	o := TextfileOpts{
+		MaxFileSize: DefaultTextfileMaxFileSize,
+		MaxSeries:   DefaultTextfileMaxSeries,
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	if dir == "" {
+		return nil, errors.New("textfile directory is required")
+	}
+	if o.MaxFileSize <= 0 || o.MaxSeries <= 0 {
+		return nil, errors.New("textfile limits must be positive")
+	}
+	if o.Staleness < 0 {
+		return nil, errors.New("textfile staleness must not be negative")
+	}
+	return &TextfileCollector{dir: dir, opts: o, now: time.Now}, nil
+}
+
+// TextfileCollector exposes the metrics written to a directory by other
+// programs, e.g. cron jobs. A file which cannot be used is skipped and
+// reported by textfile_error without affecting the other files
+type TextfileCollector struct {
+	dir  string
+	opts TextfileOpts
+	now  func() time.Time
+}
+
+// Describe implements prometheus.Collector. Only the metrics about the files
+// are described, their contents are not known in advance
+func (c *TextfileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- textfileMtimeDesc
+	ch <- textfileErrorDesc
+	ch <- textfileStaleDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *TextfileCollector) Collect(ch chan<- prometheus.Metric) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.Error("failed to read textfile directory: %v", err)
+		return
+	}
+
+	m := newFamilyMerger(textfileNamespace+"_", c.opts.Names)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || filepath.Ext(name) != textfileExt {
+			continue
+		}
+		// the name is a label value, which the registry requires to be valid
+		// UTF-8. Sanitized names could collide, so the file is skipped
+		if !utf8.ValidString(name) {
+			log.Error("skipping textfile %q: name is not valid UTF-8", name)
+			continue
+		}
+
+		stale := c.opts.Staleness > 0 && c.now().Sub(info.ModTime()) > c.opts.Staleness
+		var ferr error
+		if !stale {
+			ferr = c.read(m, filepath.Join(c.dir, name), info)
+		}
+		if ferr != nil {
+			log.Error("skipping textfile %q: %v", name, ferr)
+		}
+
+		ch <- prometheus.MustNewConstMetric(textfileMtimeDesc, prometheus.GaugeValue,
+			float64(info.ModTime().UnixNano())/1e9, name)
+		ch <- prometheus.MustNewConstMetric(textfileErrorDesc, prometheus.GaugeValue, boolValue(ferr != nil), name)
+		ch <- prometheus.MustNewConstMetric(textfileStaleDesc, prometheus.GaugeValue, boolValue(stale), name)
+	}
+
+	for _, mf := range m.families() {
+		convertMetricFamily(mf, ch)
+	}
+}
+
+// read parses the file at path and adds its families to m unless it breaks
+// a limit or conflicts with the files added before or another collector
+func (c *TextfileCollector) read(m *familyMerger, path string, info os.FileInfo) error {
+	if info.Size() > c.opts.MaxFileSize {
+		return errors.Errorf("size limit of %d bytes exceeded", c.opts.MaxFileSize)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the file may have grown since it was listed
+	r := newLimitedReader(f, c.opts.MaxFileSize)
+	parsed, err := new(expfmt.TextParser).TextToMetricFamilies(r)
+	if lerr := r.check(); lerr != nil {
+		return errors.Errorf("size limit of %d bytes exceeded", c.opts.MaxFileSize)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to parse")
+	}
+
+	series := 0
+	for _, mf := range parsed {
+		series += len(mf.Metric)
+	}
+	if series > c.opts.MaxSeries {
+		return errors.Errorf("series limit of %d exceeded with %d series", c.opts.MaxSeries, series)
+	}
+	return m.add(parsed)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// textfileDir creates a directory with the given files, all modified an hour
+// ago
+func textfileDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "textfile")
+	require.NoError(t, err)
+
+	mtime := time.Now().Add(-time.Hour)
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	return dir
+}
+
+func gatherTextfiles(t *testing.T, c *TextfileCollector) map[string]*dto.MetricFamily {
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(c))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	res := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		res[mf.GetName()] = mf
+	}
+	return res
+}
+
+// fileValues returns the value of a textfile_* family by file
+func fileValues(mf *dto.MetricFamily) map[string]float64 {
+	res := map[string]float64{}
+	for _, m := range mf.Metric {
+		res[labelValue(m, "file")] = m.GetGauge().GetValue()
+	}
+	return res
+}
+
+func TestTextfileCollectorMergesFiles(t *testing.T) {
+	dir := textfileDir(t, map[string]string{
+		"backup.prom": `# HELP backup_last_success_timestamp_seconds Last successful backup.
+# TYPE backup_last_success_timestamp_seconds gauge
+backup_last_success_timestamp_seconds{db="users"} 1.5e9
+`,
+		"restore.prom": `# TYPE backup_last_success_timestamp_seconds gauge
+backup_last_success_timestamp_seconds{db="orders"} 1.6e9
+backup_last_success_timestamp_seconds 1.7e9
+`,
+		"notes.txt": "not metrics",
+	})
+	defer os.RemoveAll(dir)
+
+	c, err := NewTextfileCollector(dir)
+	require.NoError(t, err)
+	mfs := gatherTextfiles(t, c)
+
+	mf := mfs["backup_last_success_timestamp_seconds"]
+	require.NotNil(t, mf)
+	assert.Equal(t, "Last successful backup.", mf.GetHelp())
+	values := map[string]float64{}
+	for _, m := range mf.Metric {
+		values[labelValue(m, "db")] = m.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"users": 1.5e9, "orders": 1.6e9, "": 1.7e9}, values)
+
+	assert.Equal(t, map[string]float64{"backup.prom": 0, "restore.prom": 0}, fileValues(mfs["textfile_error"]))
+	mtime := fileValues(mfs["textfile_mtime_seconds"])["backup.prom"]
+	assert.InDelta(t, float64(time.Now().Add(-time.Hour).Unix()), mtime, 5)
+}
+
+func TestTextfileCollectorSkipsBadFiles(t *testing.T) {
+	dir := textfileDir(t, map[string]string{
+		"a_good.prom":      "jobs_processed_total 10\n",
+		"b_invalid.prom":   "jobs_processed_total{\n",
+		"c_conflict.prom":  "# TYPE jobs_processed_total gauge\njobs_processed_total{queue=\"mail\"} 1\n",
+		"d_duplicate.prom": "jobs_processed_total 11\n",
+		"e_timestamp.prom": "queue_depth 3 1500000000000\n",
+		"f_reserved.prom":  "textfile_error 0\n",
+		"g_large.prom":     strings.Repeat("# padding\n", 20) + "large 1\n",
+		"h_series.prom":    "many{i=\"1\"} 1\nmany{i=\"2\"} 1\nmany{i=\"3\"} 1\n",
+		"i_taken.prom":     "node_load1 1\nbackup_size_bytes 10\n",
+		"j_\xff.prom":      "invalid_name 1\n",
+	})
+	defer os.RemoveAll(dir)
+
+	names := NewFamilyNames()
+	names.Add([]*dto.MetricFamily{{Name: proto.String("node_load1")}})
+	c, err := NewTextfileCollector(dir, WithTextfileMaxFileSize(150), WithTextfileMaxSeries(2),
+		WithTextfileFamilyNames(names))
+	require.NoError(t, err)
+	mfs := gatherTextfiles(t, c)
+
+	assert.Equal(t, map[string]float64{
+		"a_good.prom":      0,
+		"b_invalid.prom":   1,
+		"c_conflict.prom":  1,
+		"d_duplicate.prom": 1,
+		"e_timestamp.prom": 1,
+		"f_reserved.prom":  1,
+		"g_large.prom":     1,
+		"h_series.prom":    1,
+		"i_taken.prom":     1,
+	}, fileValues(mfs["textfile_error"]))
+
+	require.Len(t, mfs["jobs_processed_total"].Metric, 1)
+	assert.Equal(t, 10.0, mfs["jobs_processed_total"].Metric[0].GetUntyped().GetValue())
+	for _, name := range []string{"queue_depth", "large", "many", "node_load1", "backup_size_bytes", "invalid_name"} {
+		assert.NotContains(t, mfs, name)
+	}
+}
+
+func TestTextfileCollectorIgnoresStaleFiles(t *testing.T) {
+	dir := textfileDir(t, map[string]string{
+		"hourly.prom": "cron_hourly_success 1\n",
+	})
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fresh.prom"), []byte("cron_fresh_success 1\n"), 0644))
+
+	c, err := NewTextfileCollector(dir, WithTextfileStaleness(30*time.Minute))
+	require.NoError(t, err)
+	mfs := gatherTextfiles(t, c)
+
+	assert.NotContains(t, mfs, "cron_hourly_success")
+	assert.Contains(t, mfs, "cron_fresh_success")
+	assert.Equal(t, map[string]float64{"hourly.prom": 1, "fresh.prom": 0}, fileValues(mfs["textfile_stale"]))
+	assert.Contains(t, fileValues(mfs["textfile_mtime_seconds"]), "hourly.prom")
+
+	c.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	assert.Contains(t, gatherTextfiles(t, c), "cron_hourly_success")
+}
+
+func TestNewTextfileCollectorRejectsInvalidOptions(t *testing.T) {
+	invalid := [][]TextfileOptFn{
+		{WithTextfileMaxFileSize(0)},
+		{WithTextfileMaxSeries(-1)},
+		{WithTextfileStaleness(-time.Second)},
+	}
+	for i, opts := range invalid {
+		_, err := NewTextfileCollector("/var/lib/metrics-agent/textfile", opts...)
+		assert.Error(t, err, "case %d", i)
+	}
+	_, err := NewTextfileCollector("")
+	assert.Error(t, err)
+}
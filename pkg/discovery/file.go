@@ -0,0 +1,224 @@
+// Copyright 2018 DigitalOcean
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery finds scrape targets at runtime
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TargetGroup is a list of targets sharing the same labels, in the format of
+// Prometheus' file_sd_configs
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+
+	// Source is the file the group was read from
+	Source string `json:"-" yaml:"-"`
+}
+
+// UpdateFunc receives all target groups currently known and the errors of
+// the files which could not be read
+type UpdateFunc func(groups []TargetGroup, errs []error)
+
+// FileWatcher reads target groups from the JSON and YAML files of a directory
+// and reports them again whenever the files change
+type FileWatcher struct {
+	dir      string
+	interval time.Duration
+	debounce time.Duration
+
+	// groups are the groups of every file as of its last successful read
+	groups map[string][]TargetGroup
+	// seen is the state of the directory when it was last read
+	seen map[string]fileState
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// NewFileWatcher creates a watcher for dir which looks for changes every
+// interval. Changes are only read once the files did not change for debounce
+func NewFileWatcher(dir string, interval, debounce time.Duration) *FileWatcher {
+	return &FileWatcher{
+		dir:      dir,
+		interval: interval,
+		debounce: debounce,
+		groups:   map[string][]TargetGroup{},
+	}
+}
+
+// Refresh reads every file of the directory and returns the groups of all of
+// them. A file which cannot be read keeps the groups of its last successful
+// read, the groups of removed files are dropped
+func (w *FileWatcher) Refresh() ([]TargetGroup, []error) {
+	var errs []error
+	state, err := w.scan()
+	if err != nil {
+		// keep everything until the directory is readable again
+		return w.all(), []error{err}
+	}
+
+	for path := range w.groups {
+		if _, ok := state[path]; !ok {
+			delete(w.groups, path)
+		}
+	}
+	for path := range state {
+		groups, err := readFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		w.groups[path] = groups
+	}
+	w.seen = state
+
+	return w.all(), errs
+}
+
+// Run calls update with the result of Refresh whenever the files change,
+// until ctx is done. Refresh has to be called once before so changes are
+// detected against the initial state
+func (w *FileWatcher) Run(ctx context.Context, update UpdateFunc) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var (
+		pending bool
+		last    map[string]fileState
+		settled <-chan time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			state, err := w.scan()
+			if err != nil {
+				update(w.all(), []error{err})
+				continue
+			}
+			if !pending && sameState(state, w.seen) {
+				continue
+			}
+			// every further change restarts the debounce period
+			if !pending || !sameState(state, last) {
+				pending, last = true, state
+				settled = time.After(w.debounce)
+			}
+		case <-settled:
+			pending, settled = false, nil
+			update(w.Refresh())
+		}
+	}
+}
+
+// scan returns the size and modification time of every target file
+func (w *FileWatcher) scan() (map[string]fileState, error) {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read discovery directory")
+	}
+
+	state := map[string]fileState{}
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || !isTargetFile(fi.Name()) {
+			continue
+		}
+		state[filepath.Join(w.dir, fi.Name())] = fileState{size: fi.Size(), modTime: fi.ModTime()}
+	}
+	return state, nil
+}
+
+// all returns the groups of every file, ordered by file
+func (w *FileWatcher) all() []TargetGroup {
+	paths := make([]string, 0, len(w.groups))
+	for path := range w.groups {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	res := []TargetGroup{}
+	for _, path := range paths {
+		res = append(res, w.groups[path]...)
+	}
+	return res
+}
+
+func sameState(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, st := range a {
+		other, ok := b[path]
+		if !ok || other.size != st.size || !other.modTime.Equal(st.modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTargetFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".json", ".yml", ".yaml":
+		return true
+	}
+	return false
+}
+
+// readFile parses the target groups of a JSON or YAML file
+func readFile(path string) ([]TargetGroup, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed since the directory was read
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read target file")
+	}
+
+	var groups []TargetGroup
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(b, &groups)
+	} else {
+		err = yaml.UnmarshalStrict(b, &groups)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse target file %q", path)
+	}
+
+	for i := range groups {
+		groups[i].Source = path
+		for _, t := range groups[i].Targets {
+			if t == "" {
+				return nil, errors.Errorf("empty target in group %d of %q", i, path)
+			}
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "discovery")
+	require.NoError(t, err)
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+}
+
+func TestRefreshReadsJSONAndYAML(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, dir, "api.json", `[{"targets": ["10.0.0.1:8080", "10.0.0.2:8080"], "labels": {"env": "prod"}}]`)
+	writeFile(t, dir, "worker.yml", "- targets: ['localhost:9000']\n  labels:\n    job: worker\n")
+	writeFile(t, dir, "README.md", "not a target file")
+
+	groups, errs := NewFileWatcher(dir, time.Second, 0).Refresh()
+	assert.Empty(t, errs)
+	require.Len(t, groups, 2)
+
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, groups[0].Targets)
+	assert.Equal(t, map[string]string{"env": "prod"}, groups[0].Labels)
+	assert.Equal(t, filepath.Join(dir, "api.json"), groups[0].Source)
+	assert.Equal(t, "worker", groups[1].Labels["job"])
+}
+
+func TestRefreshKeepsGroupsOfBrokenFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := NewFileWatcher(dir, time.Second, 0)
+	writeFile(t, dir, "api.json", `[{"targets": ["10.0.0.1:8080"]}]`)
+	writeFile(t, dir, "db.yaml", "- targets: ['10.0.0.5:9187']\n")
+	groups, errs := w.Refresh()
+	require.Empty(t, errs)
+	require.Len(t, groups, 2)
+
+	// a half written file does not drop its targets
+	writeFile(t, dir, "api.json", `[{"targets": ["10.0.0.1:8080"`)
+	groups, errs = w.Refresh()
+	assert.Len(t, errs, 1)
+	require.Len(t, groups, 2)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, groups[0].Targets)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "db.yaml")))
+	groups, errs = w.Refresh()
+	assert.Len(t, errs, 1)
+	require.Len(t, groups, 1)
+
+	// unknown keys are rejected
+	writeFile(t, dir, "api.json", `[{"targets": ["10.0.0.1:8080"]}]`)
+	writeFile(t, dir, "db.yaml", "- targets: ['10.0.0.5:9187']\n  lables: {}\n")
+	groups, errs = w.Refresh()
+	assert.Len(t, errs, 1)
+	assert.Len(t, groups, 1)
+}
+
+func TestRunDebouncesChanges(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := NewFileWatcher(dir, 10*time.Millisecond, 200*time.Millisecond)
+	_, errs := w.Refresh()
+	require.Empty(t, errs)
+
+	var (
+		mu      sync.Mutex
+		updates [][]TargetGroup
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx, func(groups []TargetGroup, errs []error) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, groups)
+	})
+
+	// rapid changes are applied together once the directory settles
+	for i, target := range []string{"a:1", "b:1", "c:1"} {
+		writeFile(t, dir, string('a'+rune(i))+".json", `[{"targets": ["`+target+`"]}]`)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		mu.Lock()
+		n := len(updates)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, updates, 1)
+	assert.Len(t, updates[0], 3)
+}
@@ -16,6 +16,9 @@
 package writer
 
 import (
+	"math"
+	"strconv"
+
 	"github.com/digitalocean/metrics-agent/pkg/clients/tsclient"
 	dto "github.com/prometheus/client_model/go"
 )
@@ -37,6 +40,11 @@ func NewSonar(client tsclient.Client) *Sonar {
 func (s *Sonar) Write(mets []*dto.MetricFamily) error {
 	for _, mf := range mets {
 		for _, metric := range mf.Metric {
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[*label.Name] = *label.Value
+			}
+
 			var value float64
 			switch *mf.Type {
 			case dto.MetricType_GAUGE:
@@ -45,20 +53,15 @@ func (s *Sonar) Write(mets []*dto.MetricFamily) error {
 				value = *metric.Counter.Value
 			case dto.MetricType_UNTYPED:
 				value = *metric.Untyped.Value
+			case dto.MetricType_HISTOGRAM:
+				s.addHistogram(*mf.Name, labels, metric.Histogram)
+				continue
 			default:
 				// FIXME -- expand this to support other types
 				continue
 			}
 
-			labels := map[string]string{}
-			for _, label := range metric.Label {
-				labels[*label.Name] = *label.Value
-			}
-
-			s.client.AddMetric(
-				tsclient.NewDefinition(*mf.Name, tsclient.WithCommonLabels(labels)),
-				value)
-
+			s.add(*mf.Name, labels, value)
 		}
 
 	}
@@ -66,6 +69,51 @@ func (s *Sonar) Write(mets []*dto.MetricFamily) error {
 	return s.client.Flush()
 }
 
+// addHistogram adds h as the _sum, _count and cumulative _bucket series used
+// by the Prometheus text format
+func (s *Sonar) addHistogram(name string, labels map[string]string, h *dto.Histogram) {
+	s.add(name+"_sum", labels, h.GetSampleSum())
+	s.add(name+"_count", labels, float64(h.GetSampleCount()))
+
+	inf := false
+	for _, b := range h.Bucket {
+		inf = inf || math.IsInf(b.GetUpperBound(), +1)
+		s.add(name+"_bucket", withLabel(labels, "le", formatBound(b.GetUpperBound())), float64(b.GetCumulativeCount()))
+	}
+	if !inf {
+		s.add(name+"_bucket", withLabel(labels, "le", "+Inf"), float64(h.GetSampleCount()))
+	}
+}
+
+func (s *Sonar) add(name string, labels map[string]string, value float64) {
+	s.client.AddMetric(
+		tsclient.NewDefinition(name, tsclient.WithCommonLabels(labels)),
+		value)
+}
+
+// withLabel returns a copy of labels with name set to value
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	l := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[name] = value
+	return l
+}
+
+func formatBound(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Flush sends any buffered metrics to Sonar immediately, even when the server
+// asked for a longer wait between writes
+func (s *Sonar) Flush() error {
+	return s.client.ForceFlush()
+}
+
 // Name is the name of this writer
 func (s *Sonar) Name() string {
 	return "sonar"
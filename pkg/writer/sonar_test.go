@@ -0,0 +1,74 @@
+package writer
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/metrics-agent/pkg/clients/tsclient"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClient struct {
+	tsclient.Client
+	values map[string]float64
+}
+
+func (c *fakeClient) AddMetric(def *tsclient.Definition, value float64, labels ...string) error {
+	lfm, err := tsclient.GetLFM(def, labels)
+	if err != nil {
+		return err
+	}
+	c.values[lfm] = value
+	return nil
+}
+
+func (c *fakeClient) Flush() error { return nil }
+
+func (c *fakeClient) WaitDuration() time.Duration { return 0 }
+
+func lfm(t *testing.T, name string, labels map[string]string) string {
+	s, err := tsclient.GetLFM(tsclient.NewDefinition(name, tsclient.WithCommonLabels(labels)), nil)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestSonarWritesHistograms(t *testing.T) {
+	c := &fakeClient{values: map[string]float64{}}
+	mf := &dto.MetricFamily{
+		Name: proto.String("latency_seconds"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("stage"), Value: proto.String("write")}},
+			Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(3),
+				SampleSum:   proto.Float64(1.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(1)},
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+				},
+			},
+		}},
+	}
+
+	assert.NoError(t, NewSonar(c).Write([]*dto.MetricFamily{mf}))
+
+	stage := map[string]string{"stage": "write"}
+	bucket := func(le string) map[string]string {
+		return map[string]string{"stage": "write", "le": le}
+	}
+	assert.Equal(t, map[string]float64{
+		lfm(t, "latency_seconds_sum", stage):             1.5,
+		lfm(t, "latency_seconds_count", stage):           3,
+		lfm(t, "latency_seconds_bucket", bucket("0.1")):  1,
+		lfm(t, "latency_seconds_bucket", bucket("1")):    2,
+		lfm(t, "latency_seconds_bucket", bucket("+Inf")): 3,
+	}, c.values)
+}
+
+func TestFormatBound(t *testing.T) {
+	assert.Equal(t, "0.25", formatBound(0.25))
+	assert.Equal(t, "+Inf", formatBound(math.Inf(+1)))
+}